@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/josexy/gsocks5/socks/forward"
+	"github.com/josexy/gsocks5/transport"
+	"github.com/josexy/gsocks5/util"
+)
+
+type mappingFlags struct {
+	list  *[]forward.Mapping
+	parse func(string) (forward.Mapping, error)
+}
+
+func (f *mappingFlags) String() string {
+	if f.list == nil {
+		return ""
+	}
+	var list []string
+	for _, m := range *f.list {
+		list = append(list, m.String())
+	}
+	return strings.Join(list, ", ")
+}
+
+func (f *mappingFlags) Set(s string) error {
+	m, err := f.parse(s)
+	if err != nil {
+		return err
+	}
+	*f.list = append(*f.list, m)
+	return nil
+}
+
+func runForward(args []string) {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	server := fs.String("s", "127.0.0.1:10086", "socks5 server address")
+	user := fs.String("u", "", "socks5 username and password, username:password")
+	useMux := fs.Bool("mux", false, "multiplex the -L mappings over one connection, the server must enable mux")
+	wsPath := fs.String("ws", "", "tunnel the connections inside WebSocket on the path, such as /socks")
+	var opts transport.Options
+	fs.StringVar(&opts.Type, "transport", "", "transport to the server, tls or aead")
+	fs.StringVar(&opts.Password, "key", "", "password of the aead transport")
+	fs.StringVar(&opts.CA, "ca", "", "CA certificate file to verify the tls server")
+	fs.StringVar(&opts.ServerName, "sni", "", "server name to verify the tls server")
+	fs.BoolVar(&opts.Insecure, "insecure", false, "skip the verification of the tls server")
+	var mappings []forward.Mapping
+	fs.Var(&mappingFlags{&mappings, forward.ParseMapping}, "L",
+		"forward mapping, [tcp/|udp/][local_host:]local_port:remote_host:remote_port, can be repeated")
+	fs.Var(&mappingFlags{&mappings, forward.ParseReverseMapping}, "R",
+		"reverse mapping, [remote_host:]remote_port:local_host:local_port, can be repeated")
+	fs.Parse(args)
+	if len(mappings) == 0 {
+		fmt.Fprintln(os.Stderr, "at least one -L or -R mapping is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	t, err := transport.NewClient(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	f := forward.NewForwarder(*server, mappings...)
+	f.SetTransport(t)
+	f.SetWebSocket(*wsPath)
+	if *user != "" {
+		username, password, _ := strings.Cut(*user, ":")
+		f.SetSocksAuth(username, password)
+	}
+	if *useMux {
+		f.EnableMux()
+	}
+	done := make(chan struct{})
+	go func() {
+		f.Start()
+		close(done)
+	}()
+
+	waitSignal()
+	f.Close()
+	<-done
+	util.Logger.Warn("forwarder closed")
+}
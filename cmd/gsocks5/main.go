@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: gsocks5 <command> [flags]
+
+Commands:
+  server   run the socks5 server
+  forward  forward the local ports through the socks5 server
+  user     manage the users of the user store
+
+Run "gsocks5 <command> -h" for the flags of the command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "server":
+		runServer(os.Args[2:])
+	case "forward":
+		runForward(os.Args[2:])
+	case "user":
+		runUser(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks"
+	"github.com/josexy/gsocks5/tcpserver"
+	"github.com/josexy/gsocks5/util"
+)
+
+func runServer(args []string) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	configFile := fs.String("c", "./config.yaml", "socks5 server config file")
+	fs.Parse(args)
+
+	config.ParseConfig(*configFile)
+
+	svr := socks.NewSocks5Server(config.Cfg.ListenAddr, config.Cfg.Listeners...)
+	if config.Cfg.ListenAddr != "" {
+		util.Logger.Infof("start socks server: %s", config.Cfg.ListenAddr)
+	}
+	for _, l := range config.Cfg.Listeners {
+		util.Logger.Infof("start socks server: %s://%s", l.Network, l.Addr)
+	}
+	go func() {
+		if err := svr.Start(); err != nil && err != tcpserver.ErrServerClosed {
+			util.Logger.ErrorBy(err)
+			os.Exit(1)
+		}
+	}()
+
+	waitSignal()
+	svr.Close()
+	util.Logger.Warn("socks5 server closed")
+}
+
+func waitSignal() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	<-interrupt
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/josexy/gsocks5/socks/user"
+)
+
+const userUsage = `Usage: gsocks5 user <command> [flags] [name]
+
+Commands:
+  list     list the users and their usage of this month
+  add      add a user, -password is required
+  set      change the flags given of a user
+  del      delete a user
+  enable   enable a user
+  disable  disable a user
+  reset    reset the usage of a user in this month
+
+The users file is edited directly and reloaded by the running server, while the usage
+file is saved by the server, so reset the usage of a running server with -api.
+`
+
+// userBackend manages the users of the files or of the admin api of a running server.
+// The password of put is the plain text password, empty keeps the current one.
+type userBackend interface {
+	list() ([]user.Info, error)
+	get(name string) (user.Info, error)
+	put(u user.User, password string) error
+	del(name string) error
+	reset(name string) error
+}
+
+type userFlags struct {
+	password string
+	expire   string
+	commands string
+	cidrs    string
+	upRate   string
+	downRate string
+	quota    string
+}
+
+func runUser(args []string) {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "help" {
+		fmt.Fprint(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("user "+cmd, flag.ExitOnError)
+	file := fs.String("f", "./users.yaml", "users file")
+	usageFile := fs.String("usage", "", "usage file, the users file with the .usage suffix by default")
+	api := fs.String("api", "", "admin api of a running server instead of the files, such as http://127.0.0.1:9091")
+	token := fs.String("token", "", "bearer token of the admin api")
+	var uf userFlags
+	if cmd == "add" || cmd == "set" {
+		fs.StringVar(&uf.password, "password", "", "password")
+		fs.StringVar(&uf.expire, "expire", "", "expiry date, 2006-01-02 or RFC 3339, never for no expiry")
+		fs.StringVar(&uf.commands, "commands", "", "allowed commands separated by commas: connect, udp and reverse, all for any")
+		fs.StringVar(&uf.cidrs, "cidrs", "", "allowed source CIDRs separated by commas, all for any")
+		fs.StringVar(&uf.upRate, "up-rate", "", "upload rate in bytes per second, such as 1M, 0 for no limit")
+		fs.StringVar(&uf.downRate, "down-rate", "", "download rate in bytes per second, such as 1M, 0 for no limit")
+		fs.StringVar(&uf.quota, "quota", "", "monthly traffic quota in bytes, such as 100G, 0 for no limit")
+	}
+	fs.Parse(args[1:])
+
+	var backend userBackend
+	if *api != "" {
+		backend = &apiBackend{base: strings.TrimSuffix(*api, "/"), token: *token}
+	} else {
+		if *usageFile == "" {
+			*usageFile = *file + ".usage"
+		}
+		store, err := user.Open(*file, *usageFile)
+		if err != nil {
+			exitUser(err)
+		}
+		backend = &fileBackend{store}
+	}
+
+	if cmd == "list" {
+		infos, err := backend.list()
+		if err != nil {
+			exitUser(err)
+		}
+		printUsers(infos)
+		return
+	}
+	name := fs.Arg(0)
+	if name == "" {
+		fmt.Fprintln(os.Stderr, "the user name is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch cmd {
+	case "add":
+		if _, err = backend.get(name); err == nil {
+			exitUser(fmt.Errorf("user %s exists", name))
+		}
+		if uf.password == "" {
+			exitUser(fmt.Errorf("the password is required"))
+		}
+		u := user.User{Name: name}
+		if err = uf.apply(fs, &u); err == nil {
+			err = backend.put(u, uf.password)
+		}
+	case "set", "enable", "disable":
+		var info user.Info
+		if info, err = backend.get(name); err != nil {
+			break
+		}
+		u := info.User
+		switch cmd {
+		case "set":
+			err = uf.apply(fs, &u)
+		case "enable":
+			u.Disabled = false
+		case "disable":
+			u.Disabled = true
+		}
+		if err == nil {
+			err = backend.put(u, uf.password)
+		}
+	case "del":
+		err = backend.del(name)
+	case "reset":
+		err = backend.reset(name)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown user command %q\n\n%s", cmd, userUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		exitUser(err)
+	}
+}
+
+func exitUser(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// apply sets the fields of the flags given
+func (uf *userFlags) apply(fs *flag.FlagSet, u *user.User) (err error) {
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch f.Name {
+		case "expire":
+			u.ExpiresAt, err = parseExpiry(uf.expire)
+		case "commands":
+			u.Commands = nil
+			if uf.commands != "all" {
+				u.Commands = splitList(uf.commands)
+			}
+		case "cidrs":
+			u.CIDRs = nil
+			if uf.cidrs != "all" {
+				for _, s := range splitList(uf.cidrs) {
+					var p netip.Prefix
+					if p, err = netip.ParsePrefix(s); err != nil {
+						return
+					}
+					u.CIDRs = append(u.CIDRs, p)
+				}
+			}
+		case "up-rate":
+			u.UploadRate, err = parseSize(uf.upRate)
+		case "down-rate":
+			u.DownloadRate, err = parseSize(uf.downRate)
+		case "quota":
+			u.MonthlyQuota, err = parseSize(uf.quota)
+		}
+	})
+	return
+}
+
+func parseExpiry(s string) (time.Time, error) {
+	if s == "never" || s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
+const sizeUnits = "KMGT"
+
+// parseSize parses the bytes with an optional binary unit, such as 512K or 10G
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(s), "B"))
+	if s == "" {
+		return 0, fmt.Errorf("invalid size")
+	}
+	shift := 0
+	if i := strings.IndexByte(sizeUnits, s[len(s)-1]); i >= 0 {
+		shift = 10 * (i + 1)
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(v * float64(int64(1)<<shift)), nil
+}
+
+func formatSize(n int64) string {
+	if n < 1024 {
+		return strconv.FormatInt(n, 10)
+	}
+	v, i := float64(n)/1024, 0
+	for v >= 1024 && i < len(sizeUnits)-1 {
+		v /= 1024
+		i++
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + sizeUnits[i:i+1]
+}
+
+func printUsers(infos []user.Info) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tEXPIRES\tCOMMANDS\tCIDRS\tUP/DOWN RATE\tUSED/QUOTA")
+	for _, info := range infos {
+		u := info.User
+		status := "enabled"
+		if u.Disabled {
+			status = "disabled"
+		} else if u.Expired(time.Now()) {
+			status = "expired"
+		}
+		expires, cidrs, commands := "never", "all", "all"
+		if !u.ExpiresAt.IsZero() {
+			expires = u.ExpiresAt.Format(time.RFC3339)
+		}
+		if len(u.Commands) > 0 {
+			commands = strings.Join(u.Commands, ",")
+		}
+		if len(u.CIDRs) > 0 {
+			var list []string
+			for _, p := range u.CIDRs {
+				list = append(list, p.String())
+			}
+			cidrs = strings.Join(list, ",")
+		}
+		quota := "-"
+		if u.MonthlyQuota > 0 {
+			quota = formatSize(u.MonthlyQuota)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s/%s\t%s/%s\n", u.Name, status, expires, commands, cidrs,
+			formatRate(u.UploadRate), formatRate(u.DownloadRate), formatSize(info.Usage.Total()), quota)
+	}
+	w.Flush()
+}
+
+func formatRate(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return formatSize(n)
+}
+
+type fileBackend struct {
+	store *user.Store
+}
+
+func (b *fileBackend) list() ([]user.Info, error) {
+	var infos []user.Info
+	for _, u := range b.store.List() {
+		infos = append(infos, user.Info{User: u, Usage: b.store.Usage(u.Name)})
+	}
+	return infos, nil
+}
+
+func (b *fileBackend) get(name string) (user.Info, error) {
+	u, ok := b.store.Get(name)
+	if !ok {
+		return user.Info{}, fmt.Errorf("user %s not found", name)
+	}
+	return user.Info{User: u, Usage: b.store.Usage(name)}, nil
+}
+
+func (b *fileBackend) put(u user.User, password string) (err error) {
+	if password != "" {
+		if u.Password, err = user.HashPassword(password); err != nil {
+			return err
+		}
+	}
+	return b.store.Put(u)
+}
+
+func (b *fileBackend) del(name string) error {
+	return b.store.Delete(name)
+}
+
+func (b *fileBackend) reset(name string) error {
+	if err := b.store.ResetUsage(name); err != nil {
+		return err
+	}
+	return b.store.SaveUsage()
+}
+
+type apiBackend struct {
+	base  string
+	token string
+}
+
+func (b *apiBackend) do(method, path string, body, v any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, b.base+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, e.Error)
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (b *apiBackend) list() (infos []user.Info, err error) {
+	err = b.do(http.MethodGet, "/users", nil, &infos)
+	return
+}
+
+func (b *apiBackend) get(name string) (info user.Info, err error) {
+	err = b.do(http.MethodGet, "/users/"+url.PathEscape(name), nil, &info)
+	return
+}
+
+func (b *apiBackend) put(u user.User, password string) error {
+	u.Password = password
+	return b.do(http.MethodPut, "/users/"+url.PathEscape(u.Name), &u, nil)
+}
+
+func (b *apiBackend) del(name string) error {
+	return b.do(http.MethodDelete, "/users/"+url.PathEscape(name), nil, nil)
+}
+
+func (b *apiBackend) reset(name string) error {
+	return b.do(http.MethodPost, "/users/"+url.PathEscape(name)+"/reset", nil, nil)
+}
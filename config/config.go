@@ -1,24 +1,400 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/josexy/gsocks5/socks/auth"
 	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/route"
+	"github.com/josexy/gsocks5/transport"
 	"gopkg.in/yaml.v3"
 )
 
 type AppConfig struct {
-	ListenAddr  string
-	SocksMethod []constant.Socks5Method
-	Auth        []auth.Socks5Auth
+	ListenAddr    string
+	SocksMethod   []constant.Socks5Method
+	Auth          []auth.Socks5Auth
+	ProxyProtocol []*net.IPNet
+	Transport     transport.Transport
+	Listeners     []ListenerConfig
+	UDP           UDPConfig
+	DNS           DNSConfig
+	Outbound      OutboundConfig
+	Timeout       TimeoutConfig
+	Limit         LimitConfig
+	AuthGuard     AuthGuardConfig
+	Admin         AdminConfig
+	Reverse       ReverseConfig
+	Mux           MuxConfig
+	Upstream      UpstreamConfig
+	Users         UsersConfig
+	Route         RouteConfig
+}
+
+// Listener modes, the transparent modes accept the traffic diverted by the iptables
+// REDIRECT or TPROXY target instead of the socks requests
+const (
+	ModeSocks    = "socks"
+	ModeRedirect = "redirect"
+	ModeTProxy   = "tproxy"
+)
+
+// ListenerConfig describes an extra listener of the socks server. ProxyProtocol is the
+// trusted networks whose connections carry the PROXY header. Empty SocksMethod, Auth,
+// ProxyProtocol and Transport fall back to the top-level settings. With WebSocketPath,
+// the listener serves HTTP and the sessions are tunneled inside the WebSocket connections
+// upgraded on the path.
+type ListenerConfig struct {
+	Network       string
+	Addr          string
+	Mode          string
+	SocksMethod   []constant.Socks5Method
+	Auth          []auth.Socks5Auth
+	ProxyProtocol []*net.IPNet
+	Transport     transport.Transport
+	WebSocketPath string
+}
+
+// UDPConfig describes the udp relay. An empty BindAddr makes every tcp listener relay
+// udp on its own address. With a port range, each association gets its own relay port.
+type UDPConfig struct {
+	BindAddr      string
+	AdvertiseAddr net.IP
+	PortMin       int
+	PortMax       int
+}
+
+// DNSConfig describes how the destinations are resolved and dialed. Empty Servers uses
+// the system resolver.
+type DNSConfig struct {
+	Servers      []string
+	Timeout      time.Duration
+	Prefer       string
+	AttemptDelay time.Duration
+	CacheMinTTL  time.Duration
+	CacheMaxTTL  time.Duration
+	DisableCache bool
+}
+
+// OutboundBind describes the local address, interface and socket mark of the outbound sockets.
+// ProxyProtocol is the version of the PROXY header sent to the tcp destinations, zero means none.
+type OutboundBind struct {
+	BindAddr      net.IP
+	Interface     string
+	Mark          int
+	ProxyProtocol int
+}
+
+// OutboundConfig describes the default outbound binding and the rules which select
+// another binding by the authenticated user and the destination. The first matched rule wins.
+type OutboundConfig struct {
+	OutboundBind
+	Rules []OutboundRule
+}
+
+// OutboundRule matches if both of the users and the destinations match, an empty list matches any.
+// Domains matches the domain itself and its subdomains, CIDRs matches the ip destination.
+type OutboundRule struct {
+	OutboundBind
+	Users   []string
+	Domains []string
+	CIDRs   []*net.IPNet
+}
+
+// TimeoutConfig describes the timeouts of the sessions. Handshake limits the negotiation,
+// authentication and request, Idle is the maximum duration without data in both directions
+// of the relay, and Session is the maximum lifetime of a session. Zero Idle and Session mean no limit.
+type TimeoutConfig struct {
+	Handshake time.Duration
+	Dial      time.Duration
+	Idle      time.Duration
+	Session   time.Duration
+}
+
+// LimitConfig describes the limits of the concurrent connections, zero means no limit.
+// MaxConns and MaxConnsPerIP are shared by all listeners, the connections over MaxConns
+// wait in the listen backlog if Queue is true. AcceptRate and AcceptBurst limit the
+// accepted connections per second of each listener.
+type LimitConfig struct {
+	MaxConns           int
+	MaxConnsPerIP      int
+	MaxSessionsPerUser int
+	MaxUDPPerUser      int
+	Queue              bool
+	AcceptRate         float64
+	AcceptBurst        int
+}
+
+// AuthGuardConfig describes the brute-force protection of the username/password authentication.
+// The client ip and the username are banned for BanTime after MaxFailures consecutive failures,
+// and the ban time is doubled on each lockout up to MaxBanTime.
+type AuthGuardConfig struct {
+	Disable     bool
+	MaxFailures int
+	BanTime     time.Duration
+	MaxBanTime  time.Duration
+}
+
+// AdminConfig describes the admin API, which serves the ban list of the authentication
+// guard and the users of the user store on Addr. Every request must carry the bearer token
+// Token. The API is served over TLS with Cert and Key, which are required unless Addr is
+// a loopback address, and an empty host of Addr is the loopback address.
+type AdminConfig struct {
+	Addr  string
+	Token string
+	Cert  string
+	Key   string
+}
+
+// ReverseConfig describes the users allowed to listen for the reverse tunnels, no rule
+// means the reverse tunnel is disabled.
+type ReverseConfig struct {
+	Rules []ReverseRule
+}
+
+// ReverseRule allows Users to listen on the ports in [PortMin, PortMax] of BindAddrs. An
+// empty Users matches any user, a zero range matches any port, and an empty BindAddrs only
+// allows the wildcard address.
+type ReverseRule struct {
+	Users     []string
+	PortMin   int
+	PortMax   int
+	BindAddrs []net.IP
+}
+
+// MuxConfig enables the stream multiplexing for the gsocks5 clients which offer the private
+// method. MaxStreams limits the streams of a connection and StreamWindow is the receive
+// window in bytes of each stream, zero means the defaults.
+type MuxConfig struct {
+	Enable       bool
+	MaxStreams   int
+	StreamWindow int
+}
+
+// UpstreamConfig makes the server a local front end, which relays the requests to the remote
+// gsocks5 server at Addr through the transport. The udp flows are always carried by the
+// mux, and Mux carries the tcp connections too. WebSocketPath tunnels the connections
+// inside WebSocket.
+type UpstreamConfig struct {
+	Addr          string
+	Username      string
+	Password      string
+	Transport     transport.Transport
+	Mux           bool
+	WebSocketPath string
+}
+
+// UsersConfig describes the user store in File, whose users authenticate with the
+// username/password method besides Auth. The file is edited by the admin API or the user
+// command and reloaded when it's modified. The usage is saved to UsageFile every
+// SaveInterval, and CutOnQuota closes the live sessions of the users over their quotas.
+// The users are managed by the admin API of AdminConfig.
+type UsersConfig struct {
+	File         string
+	UsageFile    string
+	SaveInterval time.Duration
+	CutOnQuota   bool
+}
+
+// Outbound types of RouteOutbound
+const (
+	OutboundDirect = "direct"
+	OutboundSocks5 = "socks5"
+	OutboundGroup  = "group"
+)
+
+// RouteConfig describes the policy routing of the CONNECT and UDP destinations, each
+// destination goes to the outbound of the first matched rule or Final. The built-in
+// outbounds are route.Direct and route.Reject, and empty Final keeps the upstream server
+// or the direct dialing. RuleSets maps the names of the rule sets to their files.
+type RouteConfig struct {
+	Outbounds []RouteOutbound
+	RuleSets  map[string]string
+	Rules     []route.Rule
+	Final     string
+}
+
+// RouteOutbound is a named outbound. A direct outbound dials with its own Bind, a socks5
+// outbound relays through the socks server Upstream, whose udp flows are carried by UDP
+// ASSOCIATE or by the mux with Upstream.Mux. A group dials its Outbounds in order and fails
+// over to the next one, the members are defined before the group.
+type RouteOutbound struct {
+	Name      string
+	Type      string
+	Bind      OutboundBind
+	Upstream  UpstreamConfig
+	Outbounds []string
 }
 
 type yamlConfig struct {
-	ListenAddr  string   `yaml:"listen_addr"`
-	SocksMethod []string `yaml:"socks_method"`
-	Auth        []string `yaml:"auth"`
+	ListenAddr    string               `yaml:"listen_addr"`
+	SocksMethod   []string             `yaml:"socks_method"`
+	Auth          []string             `yaml:"auth"`
+	ProxyProtocol []string             `yaml:"proxy_protocol"`
+	Transport     yamlTransportConfig  `yaml:"transport"`
+	Listeners     []yamlListenerConfig `yaml:"listeners"`
+	UDP           yamlUDPConfig        `yaml:"udp"`
+	DNS           yamlDNSConfig        `yaml:"dns"`
+	Outbound      yamlOutboundConfig   `yaml:"outbound"`
+	Timeout       yamlTimeoutConfig    `yaml:"timeout"`
+	Limit         yamlLimitConfig      `yaml:"limit"`
+	AuthGuard     yamlAuthGuardConfig  `yaml:"auth_guard"`
+	Admin         yamlAdminConfig      `yaml:"admin"`
+	Reverse       yamlReverseConfig    `yaml:"reverse"`
+	Mux           yamlMuxConfig        `yaml:"mux"`
+	Upstream      yamlUpstreamConfig   `yaml:"upstream"`
+	Users         yamlUsersConfig      `yaml:"users"`
+	Route         yamlRouteConfig      `yaml:"route"`
+}
+
+type yamlListenerConfig struct {
+	Network       string              `yaml:"network"`
+	Addr          string              `yaml:"addr"`
+	Mode          string              `yaml:"mode"`
+	SocksMethod   []string            `yaml:"socks_method"`
+	Auth          []string            `yaml:"auth"`
+	ProxyProtocol []string            `yaml:"proxy_protocol"`
+	Transport     yamlTransportConfig `yaml:"transport"`
+	WebSocketPath string              `yaml:"websocket_path"`
+}
+
+type yamlTransportConfig struct {
+	Type       string `yaml:"type"`
+	Password   string `yaml:"password"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	CA         string `yaml:"ca"`
+	ServerName string `yaml:"server_name"`
+	Insecure   bool   `yaml:"insecure"`
+}
+
+type yamlUpstreamConfig struct {
+	Addr          string              `yaml:"addr"`
+	Auth          string              `yaml:"auth"`
+	Transport     yamlTransportConfig `yaml:"transport"`
+	Mux           bool                `yaml:"mux"`
+	WebSocketPath string              `yaml:"websocket_path"`
+}
+
+type yamlUDPConfig struct {
+	BindAddr      string `yaml:"bind_addr"`
+	AdvertiseAddr string `yaml:"advertise_addr"`
+	PortRange     string `yaml:"port_range"`
+}
+
+type yamlDNSConfig struct {
+	Servers      []string      `yaml:"servers"`
+	Timeout      time.Duration `yaml:"timeout"`
+	Prefer       string        `yaml:"prefer"`
+	AttemptDelay time.Duration `yaml:"attempt_delay"`
+	CacheMinTTL  time.Duration `yaml:"cache_min_ttl"`
+	CacheMaxTTL  time.Duration `yaml:"cache_max_ttl"`
+	DisableCache bool          `yaml:"disable_cache"`
+}
+
+type yamlOutboundBind struct {
+	BindAddr      string `yaml:"bind_addr"`
+	Interface     string `yaml:"interface"`
+	Mark          int    `yaml:"mark"`
+	ProxyProtocol int    `yaml:"proxy_protocol"`
+}
+
+type yamlOutboundConfig struct {
+	yamlOutboundBind `yaml:",inline"`
+	Rules            []yamlOutboundRule `yaml:"rules"`
+}
+
+type yamlOutboundRule struct {
+	yamlOutboundBind `yaml:",inline"`
+	Users            []string `yaml:"users"`
+	Dest             []string `yaml:"dest"`
+}
+
+type yamlTimeoutConfig struct {
+	Handshake time.Duration `yaml:"handshake"`
+	Dial      time.Duration `yaml:"dial"`
+	Idle      time.Duration `yaml:"idle"`
+	Session   time.Duration `yaml:"session"`
+}
+
+type yamlLimitConfig struct {
+	MaxConns           int     `yaml:"max_conns"`
+	MaxConnsPerIP      int     `yaml:"max_conns_per_ip"`
+	MaxSessionsPerUser int     `yaml:"max_sessions_per_user"`
+	MaxUDPPerUser      int     `yaml:"max_udp_per_user"`
+	Queue              bool    `yaml:"queue"`
+	AcceptRate         float64 `yaml:"accept_rate"`
+	AcceptBurst        int     `yaml:"accept_burst"`
+}
+
+type yamlAuthGuardConfig struct {
+	Disable     bool          `yaml:"disable"`
+	MaxFailures int           `yaml:"max_failures"`
+	BanTime     time.Duration `yaml:"ban_time"`
+	MaxBanTime  time.Duration `yaml:"max_ban_time"`
+}
+
+type yamlAdminConfig struct {
+	Addr  string `yaml:"addr"`
+	Token string `yaml:"token"`
+	Cert  string `yaml:"cert"`
+	Key   string `yaml:"key"`
+}
+
+type yamlMuxConfig struct {
+	Enable       bool `yaml:"enable"`
+	MaxStreams   int  `yaml:"max_streams"`
+	StreamWindow int  `yaml:"stream_window"`
+}
+
+type yamlUsersConfig struct {
+	File         string        `yaml:"file"`
+	UsageFile    string        `yaml:"usage_file"`
+	SaveInterval time.Duration `yaml:"save_interval"`
+	CutOnQuota   bool          `yaml:"cut_on_quota"`
+}
+
+type yamlRouteConfig struct {
+	Outbounds []yamlRouteOutbound `yaml:"outbounds"`
+	RuleSets  map[string]string   `yaml:"rule_sets"`
+	Rules     []yamlRouteRule     `yaml:"rules"`
+	Final     string              `yaml:"final"`
+}
+
+type yamlRouteOutbound struct {
+	yamlOutboundBind   `yaml:",inline"`
+	yamlUpstreamConfig `yaml:",inline"`
+	Name               string   `yaml:"name"`
+	Type               string   `yaml:"type"`
+	Outbounds          []string `yaml:"outbounds"`
+}
+
+type yamlRouteRule struct {
+	Domain        []string `yaml:"domain"`
+	DomainSuffix  []string `yaml:"domain_suffix"`
+	DomainKeyword []string `yaml:"domain_keyword"`
+	DomainRegex   []string `yaml:"domain_regex"`
+	CIDR          []string `yaml:"cidr"`
+	RuleSet       []string `yaml:"rule_set"`
+	Port          []string `yaml:"port"`
+	Users         []string `yaml:"users"`
+	Outbound      string   `yaml:"outbound"`
+}
+
+type yamlReverseConfig struct {
+	Rules []yamlReverseRule `yaml:"rules"`
+}
+
+type yamlReverseRule struct {
+	Users     []string `yaml:"users"`
+	Ports     string   `yaml:"ports"`
+	BindAddrs []string `yaml:"bind_addrs"`
 }
 
 var Cfg = new(AppConfig)
@@ -33,16 +409,286 @@ func ParseConfig(path string) {
 		panic(err)
 	}
 	Cfg.ListenAddr = cfg.ListenAddr
-	for _, method := range cfg.SocksMethod {
+	Cfg.SocksMethod = parseSocksMethod(cfg.SocksMethod)
+	Cfg.Auth = parseAuth(cfg.Auth)
+	Cfg.ProxyProtocol = parseCIDRs(cfg.ProxyProtocol)
+	Cfg.Transport = parseTransport(cfg.Transport, true)
+	for _, l := range cfg.Listeners {
+		network := l.Network
+		if network == "" {
+			network = "tcp"
+		}
+		switch l.Mode {
+		case "":
+			l.Mode = ModeSocks
+		case ModeSocks, ModeRedirect, ModeTProxy:
+		default:
+			panic(fmt.Errorf("invalid listener mode: %s", l.Mode))
+		}
+		if l.WebSocketPath != "" && (l.Mode != ModeSocks || !strings.HasPrefix(l.WebSocketPath, "/")) {
+			panic(fmt.Errorf("invalid listener websocket path: %s", l.WebSocketPath))
+		}
+		Cfg.Listeners = append(Cfg.Listeners, ListenerConfig{
+			Network:       network,
+			Addr:          l.Addr,
+			Mode:          l.Mode,
+			SocksMethod:   parseSocksMethod(l.SocksMethod),
+			Auth:          parseAuth(l.Auth),
+			ProxyProtocol: parseCIDRs(l.ProxyProtocol),
+			Transport:     parseTransport(l.Transport, true),
+			WebSocketPath: l.WebSocketPath,
+		})
+	}
+	Cfg.UDP.BindAddr = cfg.UDP.BindAddr
+	if cfg.UDP.AdvertiseAddr != "" {
+		if Cfg.UDP.AdvertiseAddr = net.ParseIP(cfg.UDP.AdvertiseAddr); Cfg.UDP.AdvertiseAddr == nil {
+			panic(fmt.Errorf("invalid udp advertise address: %s", cfg.UDP.AdvertiseAddr))
+		}
+	}
+	if cfg.UDP.PortRange != "" {
+		if Cfg.UDP.PortMin, Cfg.UDP.PortMax, err = parsePortRange(cfg.UDP.PortRange); err != nil {
+			panic(err)
+		}
+	}
+	Cfg.Outbound.OutboundBind = parseOutboundBind(cfg.Outbound.yamlOutboundBind)
+	for _, r := range cfg.Outbound.Rules {
+		rule := OutboundRule{OutboundBind: parseOutboundBind(r.yamlOutboundBind), Users: r.Users}
+		for _, dest := range r.Dest {
+			if ipNet := parseCIDR(dest); ipNet != nil {
+				rule.CIDRs = append(rule.CIDRs, ipNet)
+			} else {
+				rule.Domains = append(rule.Domains, strings.ToLower(strings.TrimPrefix(dest, "*.")))
+			}
+		}
+		Cfg.Outbound.Rules = append(Cfg.Outbound.Rules, rule)
+	}
+	Cfg.DNS = DNSConfig(cfg.DNS)
+	Cfg.Timeout = TimeoutConfig(cfg.Timeout)
+	Cfg.Limit = LimitConfig(cfg.Limit)
+	Cfg.AuthGuard = AuthGuardConfig(cfg.AuthGuard)
+	Cfg.Admin = parseAdmin(cfg.Admin)
+	Cfg.Mux = MuxConfig(cfg.Mux)
+	Cfg.Users = UsersConfig(cfg.Users)
+	if Cfg.Users.File != "" && Cfg.Users.UsageFile == "" {
+		Cfg.Users.UsageFile = Cfg.Users.File + ".usage"
+	}
+	Cfg.Upstream = parseUpstream(cfg.Upstream)
+	Cfg.Route = parseRoute(cfg.Route)
+	for _, r := range cfg.Reverse.Rules {
+		rule := ReverseRule{Users: r.Users}
+		if r.Ports != "" {
+			if rule.PortMin, rule.PortMax, err = parsePortRange(r.Ports); err != nil {
+				panic(err)
+			}
+		}
+		for _, addr := range r.BindAddrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				panic(fmt.Errorf("invalid reverse bind address: %s", addr))
+			}
+			rule.BindAddrs = append(rule.BindAddrs, ip)
+		}
+		Cfg.Reverse.Rules = append(Cfg.Reverse.Rules, rule)
+	}
+	switch Cfg.DNS.Prefer {
+	case "", "ipv4", "ipv6", "ipv4_only", "ipv6_only":
+	default:
+		panic(fmt.Errorf("invalid dns prefer: %s", Cfg.DNS.Prefer))
+	}
+}
+
+func parseTransport(t yamlTransportConfig, server bool) (tr transport.Transport) {
+	var err error
+	if server {
+		tr, err = transport.NewServer(transport.Options(t))
+	} else {
+		tr, err = transport.NewClient(transport.Options(t))
+	}
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// parseAdmin binds the admin api on the loopback address unless the host is given, the
+// other addresses require tls since the passwords of the users are sent in plain text
+func parseAdmin(a yamlAdminConfig) AdminConfig {
+	admin := AdminConfig(a)
+	if admin.Addr == "" {
+		return admin
+	}
+	if admin.Token == "" {
+		panic(fmt.Errorf("admin api requires the token"))
+	}
+	if (admin.Cert == "") != (admin.Key == "") {
+		panic(fmt.Errorf("admin api tls requires the cert and the key"))
+	}
+	host, port, err := net.SplitHostPort(admin.Addr)
+	if err != nil {
+		panic(err)
+	}
+	if host == "" {
+		admin.Addr = net.JoinHostPort("127.0.0.1", port)
+	} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) && admin.Cert == "" {
+		panic(fmt.Errorf("admin api on the non-loopback address %s requires tls", admin.Addr))
+	}
+	return admin
+}
+
+func parseUpstream(u yamlUpstreamConfig) UpstreamConfig {
+	upstream := UpstreamConfig{
+		Addr:          u.Addr,
+		Transport:     parseTransport(u.Transport, false),
+		Mux:           u.Mux,
+		WebSocketPath: u.WebSocketPath,
+	}
+	upstream.Username, upstream.Password, _ = strings.Cut(u.Auth, ":")
+	return upstream
+}
+
+func parseRoute(r yamlRouteConfig) RouteConfig {
+	rc := RouteConfig{RuleSets: r.RuleSets, Final: r.Final}
+	names := map[string]bool{route.Direct: true, route.Reject: true}
+	for _, o := range r.Outbounds {
+		if o.Name == "" || names[o.Name] {
+			panic(fmt.Errorf("invalid route outbound name: %q", o.Name))
+		}
+		out := RouteOutbound{Name: o.Name, Type: o.Type}
+		switch o.Type {
+		case OutboundDirect:
+			out.Bind = parseOutboundBind(o.yamlOutboundBind)
+		case OutboundSocks5:
+			if o.Addr == "" {
+				panic(fmt.Errorf("route outbound %s: the address is required", o.Name))
+			}
+			out.Upstream = parseUpstream(o.yamlUpstreamConfig)
+		case OutboundGroup:
+			if len(o.Outbounds) == 0 {
+				panic(fmt.Errorf("route outbound %s: the outbounds are required", o.Name))
+			}
+			for _, name := range o.Outbounds {
+				if !names[name] {
+					panic(fmt.Errorf("route outbound %s: outbound %s not defined before", o.Name, name))
+				}
+			}
+			out.Outbounds = o.Outbounds
+		default:
+			panic(fmt.Errorf("invalid route outbound type: %s", o.Type))
+		}
+		names[o.Name] = true
+		rc.Outbounds = append(rc.Outbounds, out)
+	}
+	if r.Final != "" && !names[r.Final] {
+		panic(fmt.Errorf("route final outbound %s not defined", r.Final))
+	}
+	for _, x := range r.Rules {
+		if !names[x.Outbound] {
+			panic(fmt.Errorf("route outbound %q not defined", x.Outbound))
+		}
+		rule := route.Rule{
+			Domains:        x.Domain,
+			DomainSuffixes: x.DomainSuffix,
+			DomainKeywords: x.DomainKeyword,
+			RuleSets:       x.RuleSet,
+			Users:          x.Users,
+			Outbound:       x.Outbound,
+		}
+		for _, expr := range x.DomainRegex {
+			rule.DomainRegexps = append(rule.DomainRegexps, regexp.MustCompile(expr))
+		}
+		for _, s := range x.CIDR {
+			prefix, err := route.ParsePrefix(s)
+			if err != nil {
+				panic(err)
+			}
+			rule.CIDRs = append(rule.CIDRs, prefix)
+		}
+		for _, s := range x.Port {
+			min, max, err := parsePortRange(s)
+			if err != nil {
+				panic(err)
+			}
+			rule.Ports = append(rule.Ports, route.PortRange{Min: min, Max: max})
+		}
+		for _, name := range x.RuleSet {
+			if _, ok := r.RuleSets[name]; !ok {
+				panic(fmt.Errorf("route rule set %s not defined", name))
+			}
+		}
+		rc.Rules = append(rc.Rules, rule)
+	}
+	return rc
+}
+
+func parseOutboundBind(b yamlOutboundBind) OutboundBind {
+	bind := OutboundBind{Interface: b.Interface, Mark: b.Mark, ProxyProtocol: b.ProxyProtocol}
+	if b.ProxyProtocol < 0 || b.ProxyProtocol > 2 {
+		panic(fmt.Errorf("invalid outbound proxy protocol version: %d", b.ProxyProtocol))
+	}
+	if b.BindAddr != "" {
+		if bind.BindAddr = net.ParseIP(b.BindAddr); bind.BindAddr == nil {
+			panic(fmt.Errorf("invalid outbound bind address: %s", b.BindAddr))
+		}
+	}
+	return bind
+}
+
+// parseCIDR parses a CIDR or an ip address, which is a single host network
+func parseCIDR(s string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return ipNet
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	}
+	return nil
+}
+
+func parseCIDRs(list []string) (nets []*net.IPNet) {
+	for _, s := range list {
+		ipNet := parseCIDR(s)
+		if ipNet == nil {
+			panic(fmt.Errorf("invalid CIDR: %s", s))
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+// parsePortRange parses "min-max" or a single port
+func parsePortRange(s string) (min, max int, err error) {
+	lo, hi, found := strings.Cut(s, "-")
+	if min, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return
+	}
+	max = min
+	if found {
+		if max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+			return
+		}
+	}
+	if min <= 0 || max > 65535 || min > max {
+		err = fmt.Errorf("invalid port range: %s", s)
+	}
+	return
+}
+
+func parseSocksMethod(methods []string) (list []constant.Socks5Method) {
+	for _, method := range methods {
 		switch method {
 		case "username":
-			Cfg.SocksMethod = append(Cfg.SocksMethod, constant.MethodUsernamePassword)
+			list = append(list, constant.MethodUsernamePassword)
 		case "none":
-			Cfg.SocksMethod = append(Cfg.SocksMethod, constant.MethodNoAuthRequired)
+			list = append(list, constant.MethodNoAuthRequired)
 		}
 	}
-	for _, x := range cfg.Auth {
+	return
+}
+
+func parseAuth(auths []string) (list []auth.Socks5Auth) {
+	for _, x := range auths {
 		parts := strings.Split(x, ":")
-		Cfg.Auth = append(Cfg.Auth, auth.NewSocksAuth(parts[0], parts[1]))
+		list = append(list, auth.NewSocksAuth(parts[0], parts[1]))
 	}
+	return
 }
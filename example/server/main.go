@@ -31,8 +31,11 @@ func main() {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	svr := socks.NewSocks5Server(config.Cfg.ListenAddr)
+	svr := socks.NewSocks5Server(config.Cfg.ListenAddr, config.Cfg.Listeners...)
 	util.Logger.Infof("start socks server: %s", config.Cfg.ListenAddr)
+	for _, l := range config.Cfg.Listeners {
+		util.Logger.Infof("start socks server: %s://%s", l.Network, l.Addr)
+	}
 
 	done := make(chan struct{})
 	go func() {
@@ -5,11 +5,12 @@ go 1.20
 require (
 	github.com/fatih/color v1.15.0
 	github.com/josexy/logx v0.0.0-20230322134056-c1406f401be8
+	golang.org/x/net v0.19.0
+	golang.org/x/sys v0.15.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.18 // indirect
-	golang.org/x/sys v0.6.0 // indirect
 )
@@ -0,0 +1,62 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// the frame is VER(1) CMD(1) LEN(2) SID(4) followed by LEN bytes of payload
+const (
+	version       = 0x01
+	headerSize    = 8
+	maxPayload    = 1<<16 - 1
+	flagDatagram  = 0x01
+	windowPayload = 4
+	synPayload    = 1 + windowPayload
+)
+
+const (
+	// cmdSYN opens a stream, the payload is the flags of the stream followed by the uint32
+	// receive window of the opener. The acceptor replies its own window with cmdUPD.
+	cmdSYN byte = iota
+	// cmdPSH carries the data of a stream
+	cmdPSH
+	// cmdFIN closes the write side of a stream
+	cmdFIN
+	// cmdRST aborts a stream
+	cmdRST
+	// cmdUPD grows the send window of a stream by the uint32 payload
+	cmdUPD
+)
+
+type header [headerSize]byte
+
+func (h *header) cmd() byte {
+	return h[1]
+}
+
+func (h *header) length() int {
+	return int(binary.BigEndian.Uint16(h[2:]))
+}
+
+func (h *header) sid() uint32 {
+	return binary.BigEndian.Uint32(h[4:])
+}
+
+func readHeader(r io.Reader, h *header) error {
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return err
+	}
+	if h[0] != version || h.cmd() > cmdUPD {
+		return ErrInvalidFrame
+	}
+	return nil
+}
+
+func newHeader(cmd byte, sid uint32, length int) (h header) {
+	h[0] = version
+	h[1] = cmd
+	binary.BigEndian.PutUint16(h[2:], uint16(length))
+	binary.BigEndian.PutUint32(h[4:], sid)
+	return
+}
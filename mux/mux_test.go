@@ -0,0 +1,182 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func newPair(t *testing.T, cfg *Config) (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	client, server := Client(c1, cfg), Server(c2, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreamEcho(t *testing.T) {
+	client, server := newPair(t, &Config{StreamWindow: 64 << 10})
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	for i := 0; i < 4; i++ {
+		st, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			st.Write(data)
+			st.CloseWrite()
+		}()
+		got, err := io.ReadAll(st)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("echo: %d bytes, %v", len(got), err)
+		}
+		st.Close()
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, server := newPair(t, &Config{StreamWindow: 1024})
+	slow, _ := client.OpenStream()
+	fast, _ := client.OpenStream()
+	s1, _ := server.Accept()
+	s2, _ := server.Accept()
+
+	// the window of the slow stream is full, the writer blocks until the deadline
+	slow.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := slow.Write(make([]byte, 4096))
+	if n != 1024 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("slow write: %d %v", n, err)
+	}
+
+	// the other streams aren't blocked
+	go fast.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	if n, err := s2.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("fast read: %q %v", buf[:n], err)
+	}
+
+	// reading the slow stream opens its window again
+	go io.Copy(io.Discard, s1)
+	slow.SetWriteDeadline(time.Time{})
+	if _, err := slow.Write(make([]byte, 8192)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamWindowMismatch(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := Client(c1, nil), Server(c2, &Config{StreamWindow: 64 << 10})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	// the client sends no more than the window of the server, and the other way around
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	go func() {
+		st.Write(data)
+		st.CloseWrite()
+	}()
+	got, err := io.ReadAll(st)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("echo: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	client, server := newPair(t, nil)
+	st, _ := client.OpenDatagram()
+	for _, msg := range []string{"first", "second message"} {
+		st.Write([]byte(msg))
+	}
+	peer, _ := server.Accept()
+	if !peer.Datagram() {
+		t.Fatal("not a datagram stream")
+	}
+	buf := make([]byte, 6)
+	for _, want := range []string{"first", "second"} {
+		n, err := peer.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("got %q %v, want %q", buf[:n], err, want)
+		}
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := newPair(t, &Config{MaxStreams: 1})
+	st1, _ := client.OpenStream()
+	st2, _ := client.OpenStream()
+	if _, err := st2.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("over the limit: %v", err)
+	}
+
+	peer, _ := server.Accept()
+	peer.Close()
+	st1.SetWriteDeadline(time.Now().Add(time.Second))
+	var err error
+	for err == nil {
+		_, err = st1.Write([]byte("data"))
+	}
+	if err != ErrStreamReset {
+		t.Fatalf("write to the closed stream: %v", err)
+	}
+}
+
+func TestSynParity(t *testing.T) {
+	for _, sid := range []uint32{0, 2} {
+		c1, c2 := net.Pipe()
+		server := Server(c2, nil)
+		payload := make([]byte, synPayload)
+		binary.BigEndian.PutUint32(payload[1:], defaultStreamWindow)
+		h := newHeader(cmdSYN, sid, len(payload))
+		go c1.Write(append(h[:], payload...))
+		select {
+		case <-server.CloseChan():
+		case <-time.After(time.Second):
+			t.Fatalf("syn of the local id %d is accepted", sid)
+		}
+		c1.Close()
+	}
+}
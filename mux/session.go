@@ -0,0 +1,324 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	defaultMaxStreams   = 1024
+	defaultStreamWindow = 256 << 10
+	acceptBacklog       = 256
+	controlBacklog      = 1024
+)
+
+var (
+	ErrSessionClosed   = errors.New("mux: session closed")
+	ErrInvalidFrame    = errors.New("mux: invalid frame")
+	ErrStreamReset     = errors.New("mux: stream reset by peer")
+	ErrMessageTooLarge = errors.New("mux: datagram too large")
+)
+
+// Config tunes a session. MaxStreams limits the streams opened by the peer and
+// StreamWindow is the receive window of each stream, the zero values use the defaults.
+type Config struct {
+	MaxStreams   int
+	StreamWindow int
+}
+
+func (c *Config) maxStreams() int {
+	if c == nil || c.MaxStreams <= 0 {
+		return defaultMaxStreams
+	}
+	return c.MaxStreams
+}
+
+func (c *Config) streamWindow() int {
+	if c == nil || c.StreamWindow <= 0 {
+		return defaultStreamWindow
+	}
+	return c.StreamWindow
+}
+
+// Session multiplexes the streams over one connection. Each stream has its own flow
+// control window, so a slow stream doesn't block the others. The datagram streams keep
+// the message boundaries and drop the messages instead of blocking when the window is full.
+type Session struct {
+	conn       net.Conn
+	maxStreams int
+	window     int
+	parity     uint32 // parity of the local stream ids
+
+	mu      sync.Mutex
+	nextID  uint32
+	streams map[uint32]*Stream
+
+	writeMu   sync.Mutex
+	controlCh chan controlFrame
+	acceptCh  chan *Stream
+	die       chan struct{}
+	dieOnce   sync.Once
+	err       error
+}
+
+// Client creates the session of the side which opens the streams
+func Client(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, 1)
+}
+
+// Server creates the session of the side which accepts the streams
+func Server(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, 2)
+}
+
+func newSession(conn net.Conn, cfg *Config, nextID uint32) *Session {
+	s := &Session{
+		conn:       conn,
+		maxStreams: cfg.maxStreams(),
+		window:     cfg.streamWindow(),
+		nextID:     nextID,
+		parity:     nextID & 1,
+		streams:    make(map[uint32]*Stream),
+		controlCh:  make(chan controlFrame, controlBacklog),
+		acceptCh:   make(chan *Stream, acceptBacklog),
+		die:        make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.controlLoop()
+	return s
+}
+
+// OpenStream opens a byte stream
+func (s *Session) OpenStream() (*Stream, error) {
+	return s.open(false)
+}
+
+// OpenDatagram opens a stream which keeps the message boundaries, each Write is read
+// by one Read of the peer
+func (s *Session) OpenDatagram() (*Stream, error) {
+	return s.open(true)
+}
+
+func (s *Session) open(datagram bool) (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	st := newStream(s, s.nextID, datagram, 0)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	var payload [synPayload]byte
+	if datagram {
+		payload[0] = flagDatagram
+	}
+	binary.BigEndian.PutUint32(payload[1:], uint32(s.window))
+	if err := s.writeFrame(cmdSYN, st.id, payload[:]); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.die:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.dieOnce.Do(func() {
+		s.err = err
+		close(s.die)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan is closed when the session is closed
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.die
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) writeFrame(cmd byte, sid uint32, payload []byte) error {
+	h := newHeader(cmd, sid, len(payload))
+	bufs := net.Buffers{h[:], payload}
+	s.writeMu.Lock()
+	_, err := bufs.WriteTo(s.conn)
+	s.writeMu.Unlock()
+	if err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+type controlFrame struct {
+	cmd     byte
+	sid     uint32
+	payload []byte
+}
+
+// control queues the frame replied by the receive loop, which never blocks on writing. It
+// returns false if the queue is full.
+func (s *Session) control(cmd byte, sid uint32, payload []byte) bool {
+	select {
+	case s.controlCh <- controlFrame{cmd: cmd, sid: sid, payload: payload}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case f := <-s.controlCh:
+			if s.writeFrame(f.cmd, f.sid, f.payload) != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// reset aborts the stream of the peer, the frame is dropped if the control queue is full
+func (s *Session) reset(sid uint32) {
+	s.control(cmdRST, sid, nil)
+}
+
+func (s *Session) recvLoop() {
+	var h header
+	for {
+		if err := readHeader(s.conn, &h); err != nil {
+			if err == io.EOF {
+				err = ErrSessionClosed
+			}
+			s.closeWithError(err)
+			return
+		}
+		var payload []byte
+		if n := h.length(); n > 0 {
+			payload = make([]byte, n)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.closeWithError(err)
+				return
+			}
+		}
+		sid := h.sid()
+		switch h.cmd() {
+		case cmdSYN:
+			if len(payload) != synPayload {
+				s.closeWithError(ErrInvalidFrame)
+				return
+			}
+			window := int(binary.BigEndian.Uint32(payload[1:]))
+			// the peer opens the streams with the ids of the other parity
+			if window == 0 || sid == 0 || sid&1 == s.parity {
+				s.closeWithError(ErrInvalidFrame)
+				return
+			}
+			s.accept(sid, payload[0]&flagDatagram != 0, window)
+		case cmdPSH:
+			if st := s.stream(sid); st == nil {
+				// the stream has been closed locally
+				s.reset(sid)
+			} else if !st.push(payload) {
+				st.abort()
+				s.reset(sid)
+			}
+		case cmdFIN:
+			if st := s.stream(sid); st != nil {
+				st.remoteClose()
+			}
+		case cmdRST:
+			if st := s.stream(sid); st != nil {
+				st.abort()
+			}
+		case cmdUPD:
+			if len(payload) != windowPayload {
+				s.closeWithError(ErrInvalidFrame)
+				return
+			}
+			if st := s.stream(sid); st != nil {
+				st.grow(int(binary.BigEndian.Uint32(payload)))
+			}
+		}
+	}
+}
+
+// accept queues the stream opened by the peer, whose receive window is window, and
+// replies the receive window of the stream
+func (s *Session) accept(sid uint32, datagram bool, window int) {
+	s.mu.Lock()
+	if _, ok := s.streams[sid]; ok || len(s.streams) >= s.maxStreams {
+		s.mu.Unlock()
+		s.reset(sid)
+		return
+	}
+	st := newStream(s, sid, datagram, window)
+	s.streams[sid] = st
+	s.mu.Unlock()
+	payload := make([]byte, windowPayload)
+	binary.BigEndian.PutUint32(payload, uint32(s.window))
+	if !s.control(cmdUPD, sid, payload) {
+		// the control queue is full, the stream can't be established
+		s.remove(sid)
+		return
+	}
+	select {
+	case s.acceptCh <- st:
+	default:
+		s.remove(sid)
+		s.reset(sid)
+	}
+}
@@ -0,0 +1,329 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection of the session
+type Stream struct {
+	id       uint32
+	sess     *Session
+	datagram bool
+
+	mu         sync.Mutex
+	chunks     [][]byte
+	buffered   int
+	consumed   int
+	sendWindow int
+	// established is set once the receive window of the peer is known
+	established bool
+	finRecv     bool
+	finSent     bool
+	reset       bool
+	closed      bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readNotify    chan struct{}
+	writeNotify   chan struct{}
+}
+
+// newStream creates a stream whose send window is the receive window of the peer, the
+// window of a stream opened locally is 0 until the peer replies it
+func newStream(sess *Session, id uint32, datagram bool, window int) *Stream {
+	return &Stream{
+		id:          id,
+		sess:        sess,
+		datagram:    datagram,
+		sendWindow:  window,
+		established: window > 0,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Datagram reports whether the stream keeps the message boundaries
+func (st *Stream) Datagram() bool {
+	return st.datagram
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			err = ErrStreamReset
+		case st.closed:
+			err = net.ErrClosed
+		case len(st.chunks) > 0:
+			n = st.read(b)
+		case st.finRecv:
+			err = io.EOF
+		case st.sess.IsClosed():
+			err = st.sess.err
+		}
+		deadline := st.readDeadline
+		var update int
+		if n > 0 && st.consumed >= st.sess.window/2 {
+			update, st.consumed = st.consumed, 0
+		}
+		st.mu.Unlock()
+
+		if update > 0 {
+			var payload [windowPayload]byte
+			binary.BigEndian.PutUint32(payload[:], uint32(update))
+			st.sess.writeFrame(cmdUPD, st.id, payload[:])
+		}
+		if n > 0 || err != nil {
+			return
+		}
+		if err = st.wait(st.readNotify, deadline); err != nil {
+			return
+		}
+	}
+}
+
+// read consumes the buffered data, the rest of a message which doesn't fit in b is discarded
+func (st *Stream) read(b []byte) int {
+	chunk := st.chunks[0]
+	n := copy(b, chunk)
+	consumed := n
+	if st.datagram || n == len(chunk) {
+		consumed = len(chunk)
+		st.chunks[0] = nil
+		st.chunks = st.chunks[1:]
+	} else {
+		st.chunks[0] = chunk[n:]
+	}
+	st.buffered -= consumed
+	st.consumed += consumed
+	return n
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	if st.datagram {
+		return st.writeMessage(b)
+	}
+	for len(b) > 0 {
+		st.mu.Lock()
+		if err = st.writeErr(); err != nil {
+			st.mu.Unlock()
+			return
+		}
+		size := st.sendWindow
+		deadline := st.writeDeadline
+		if size > len(b) {
+			size = len(b)
+		}
+		if size > maxPayload {
+			size = maxPayload
+		}
+		st.sendWindow -= size
+		st.mu.Unlock()
+
+		if size == 0 {
+			if err = st.wait(st.writeNotify, deadline); err != nil {
+				return
+			}
+			continue
+		}
+		if err = st.sess.writeFrame(cmdPSH, st.id, b[:size]); err != nil {
+			return
+		}
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// writeMessage sends b as one message, it's dropped if the window of the peer is full.
+// It waits for the window of the peer if the stream isn't established yet.
+func (st *Stream) writeMessage(b []byte) (int, error) {
+	if len(b) > maxPayload {
+		return 0, ErrMessageTooLarge
+	}
+	st.mu.Lock()
+	for {
+		if err := st.writeErr(); err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+		if st.established {
+			break
+		}
+		deadline := st.writeDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.writeNotify, deadline); err != nil {
+			return 0, err
+		}
+		st.mu.Lock()
+	}
+	if st.sendWindow < len(b) {
+		st.mu.Unlock()
+		return len(b), nil
+	}
+	st.sendWindow -= len(b)
+	st.mu.Unlock()
+	if err := st.sess.writeFrame(cmdPSH, st.id, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (st *Stream) writeErr() error {
+	switch {
+	case st.reset:
+		return ErrStreamReset
+	case st.closed:
+		return net.ErrClosed
+	case st.finSent:
+		return io.ErrClosedPipe
+	case st.sess.IsClosed():
+		return st.sess.err
+	case !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-st.sess.die:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// CloseWrite sends FIN to the peer, which reads EOF after the data sent
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.closed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+	notify(st.writeNotify)
+	return st.sess.writeFrame(cmdFIN, st.id, nil)
+}
+
+// Close closes both directions, the data sent by the peer afterwards is answered with RST
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendFIN := !st.finSent && !st.reset
+	st.finSent = true
+	st.chunks, st.buffered = nil, 0
+	st.mu.Unlock()
+	notify(st.readNotify)
+	notify(st.writeNotify)
+	st.sess.remove(st.id)
+	if sendFIN && !st.sess.IsClosed() {
+		return st.sess.writeFrame(cmdFIN, st.id, nil)
+	}
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readNotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeNotify)
+	return nil
+}
+
+// push buffers the data from the peer, it returns false if the peer exceeds the window
+func (st *Stream) push(b []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed || st.reset {
+		return true
+	}
+	if st.buffered+len(b) > st.sess.window {
+		return false
+	}
+	if len(b) > 0 {
+		st.chunks = append(st.chunks, b)
+		st.buffered += len(b)
+		notify(st.readNotify)
+	}
+	return true
+}
+
+func (st *Stream) grow(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.established = true
+	st.mu.Unlock()
+	notify(st.writeNotify)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+	notify(st.readNotify)
+}
+
+func (st *Stream) abort() {
+	st.mu.Lock()
+	st.reset = true
+	st.chunks, st.buffered = nil, 0
+	st.mu.Unlock()
+	notify(st.readNotify)
+	notify(st.writeNotify)
+	st.sess.remove(st.id)
+}
@@ -0,0 +1,69 @@
+package proxyproto
+
+import (
+	"net"
+	"time"
+)
+
+// Conn replaces the addresses of the connection with the addresses of the PROXY header
+type Conn struct {
+	net.Conn
+	Header *Header
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header.Source != nil {
+		return c.Header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Header.Destination != nil {
+		return c.Header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// TCP returns the underlying tcp connection for the zero-copy relay, no data after the
+// header is buffered
+func (c *Conn) TCP() *net.TCPConn {
+	conn, _ := c.Conn.(*net.TCPConn)
+	return conn
+}
+
+// Policy decides which connections must carry a PROXY header, only the connections from
+// the Trusted networks are parsed and the others are kept as is.
+type Policy struct {
+	Trusted []*net.IPNet
+	Timeout time.Duration
+}
+
+func (p *Policy) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.Trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap reads the PROXY header of the trusted connection within Timeout
+func (p *Policy) Wrap(conn net.Conn) (net.Conn, error) {
+	if !p.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	if p.Timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(p.Timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	h, err := ReadHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, Header: h}, nil
+}
@@ -0,0 +1,189 @@
+// Package proxyproto implements the PROXY protocol version 1 and 2 of HAProxy, which
+// carries the address of the original client through the load balancers.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	Version1 = 1
+	Version2 = 2
+
+	maxV1HeaderLen = 107
+)
+
+var (
+	ErrNoHeader      = errors.New("proxyproto: no PROXY header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Header is the PROXY protocol header. A LOCAL header (or an UNKNOWN/unspecified one) has
+// nil addresses, which means the addresses of the connection itself should be used.
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ReadHeader reads the PROXY header without reading any byte after it
+func ReadHeader(r io.Reader) (*Header, error) {
+	var buf [maxV1HeaderLen]byte
+	if _, err := io.ReadFull(r, buf[:12]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(buf[:12], v2Signature) {
+		return readV2(r)
+	}
+	if !bytes.HasPrefix(buf[:12], []byte("PROXY ")) {
+		return nil, ErrNoHeader
+	}
+	// the v1 header is a single line, so read it byte by byte
+	n := 12
+	for n < 2 || buf[n-2] != '\r' || buf[n-1] != '\n' {
+		if n == len(buf) {
+			return nil, ErrInvalidHeader
+		}
+		if _, err := io.ReadFull(r, buf[n:n+1]); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	return parseV1(string(buf[:n-2]))
+}
+
+func parseV1(line string) (*Header, error) {
+	fields := strings.Split(line, " ")
+	h := &Header{Version: Version1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	var err error
+	if h.Source, err = parseV1Addr(fields[1], fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Addr(fields[1], fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil && !strings.Contains(host, ":")) {
+		return nil, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r io.Reader) (*Header, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	h := &Header{Version: Version2}
+	switch hdr[0] & 0x0f {
+	case 0x00:
+		// LOCAL, such as the health check of the load balancer
+		return h, nil
+	case 0x01:
+	default:
+		return nil, ErrInvalidHeader
+	}
+	var ipLen int
+	switch hdr[1] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry no usable ip address
+		return h, nil
+	}
+	if len(data) < 2*ipLen+4 {
+		return nil, ErrInvalidHeader
+	}
+	// the TLVs after the addresses are ignored
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLen+2:])),
+	}
+	return h, nil
+}
+
+// Format returns the header in the wire format of its version
+func (h *Header) Format() []byte {
+	src, dst := h.Source, h.Destination
+	v4 := src != nil && dst != nil && src.IP.To4() != nil && dst.IP.To4() != nil
+	if h.Version == Version1 {
+		switch {
+		case src == nil || dst == nil:
+			return []byte("PROXY UNKNOWN\r\n")
+		case v4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", to16(src.IP), to16(dst.IP), src.Port, dst.Port))
+		}
+	}
+	buf := append([]byte(nil), v2Signature...)
+	switch {
+	case src == nil || dst == nil:
+		return append(buf, 0x20, 0x00, 0, 0)
+	case v4:
+		buf = append(buf, 0x21, 0x11, 0, 12)
+		buf = append(append(buf, src.IP.To4()...), dst.IP.To4()...)
+	default:
+		buf = append(buf, 0x21, 0x21, 0, 36)
+		buf = append(append(buf, src.IP.To16()...), dst.IP.To16()...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(buf, uint16(dst.Port))
+}
+
+// to16 formats the ip as an IPv6 address, the IPv4 address is mapped into IPv6
+func to16(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// WriteHeader writes the PROXY header of the version for the client address src and the
+// destination address dst, the header is UNKNOWN/LOCAL if any of them isn't a tcp address
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	h := &Header{Version: version}
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if ok1 && ok2 {
+		h.Source, h.Destination = s, d
+	}
+	_, err := w.Write(h.Format())
+	return err
+}
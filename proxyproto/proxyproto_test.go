@@ -0,0 +1,54 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		src, dst string
+	}{
+		{"192.0.2.1:1234", "198.51.100.1:1080"},
+		{"[2001:db8::1]:1234", "[2001:db8::2]:1080"},
+		{"192.0.2.1:1234", "[2001:db8::2]:1080"},
+	} {
+		src, _ := net.ResolveTCPAddr("tcp", tt.src)
+		dst, _ := net.ResolveTCPAddr("tcp", tt.dst)
+		for _, version := range []int{Version1, Version2} {
+			var buf bytes.Buffer
+			WriteHeader(&buf, version, src, dst)
+			buf.WriteString("payload")
+			h, err := ReadHeader(&buf)
+			if err != nil {
+				t.Fatalf("v%d %s: %v", version, tt.src, err)
+			}
+			if h.Version != version || !h.Source.IP.Equal(src.IP) || h.Source.Port != src.Port ||
+				!h.Destination.IP.Equal(dst.IP) || h.Destination.Port != dst.Port {
+				t.Fatalf("v%d: got %v %v", version, h.Source, h.Destination)
+			}
+			if rest, _ := io.ReadAll(&buf); string(rest) != "payload" {
+				t.Fatalf("v%d: data after header: %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	for _, data := range []string{
+		"\x05\x01\x00\x05\x01\x00\x01\x7f\x00\x00\x01\x00",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 1234\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 1234 1080\r\n",
+		"PROXY " + string(bytes.Repeat([]byte("a"), 120)),
+	} {
+		if _, err := ReadHeader(bytes.NewBufferString(data)); err == nil {
+			t.Fatalf("%q: no error", data)
+		}
+	}
+	h, err := ReadHeader(bytes.NewBufferString("PROXY UNKNOWN\r\n"))
+	if err != nil || h.Source != nil {
+		t.Fatalf("unknown: %v %v", h, err)
+	}
+}
@@ -0,0 +1,94 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/josexy/gsocks5/util"
+)
+
+// Server is the admin API server, the features register their handlers with Handle and
+// every request must carry the bearer token
+type Server struct {
+	// CertFile and KeyFile serve the admin API over TLS
+	CertFile string
+	KeyFile  string
+
+	srv   *http.Server
+	mux   *http.ServeMux
+	token string
+}
+
+func NewServer(addr, token string, readHeaderTimeout time.Duration) *Server {
+	s := &Server{mux: http.NewServeMux(), token: token}
+	s.srv = &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	return s
+}
+
+// Handle registers h for the path pattern and the paths under it, such as /users and
+// /users/{name}
+func (s *Server) Handle(pattern string, h http.Handler) {
+	pattern = "/" + strings.Trim(pattern, "/")
+	s.mux.Handle(pattern, h)
+	s.mux.Handle(pattern+"/", h)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Authorize(s.token, s.mux).ServeHTTP(w, r)
+}
+
+func (s *Server) Addr() string {
+	return s.srv.Addr
+}
+
+// Serve serves the admin API in the background
+func (s *Server) Serve() {
+	util.Logger.Infof("start admin api: %s", s.srv.Addr)
+	go func() {
+		var err error
+		if s.CertFile != "" {
+			err = s.srv.ListenAndServeTLS(s.CertFile, s.KeyFile)
+		} else {
+			err = s.srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			util.Logger.ErrorBy(err)
+		}
+	}()
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// Authorize serves the requests carrying the bearer token with h, an empty token rejects
+// every request
+func Authorize(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			WriteError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WriteError writes the error as {"error": "..."}
+func WriteError(w http.ResponseWriter, status int, err error) {
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,64 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer("", "secret", 0)
+	s.Handle("/ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, r.URL.Path)
+	}))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/ping", "secret", http.StatusOK},
+		{"/ping/x", "secret", http.StatusOK},
+		{"/ping", "bad", http.StatusUnauthorized},
+		{"/ping", "", http.StatusUnauthorized},
+		{"/pong", "bad", http.StatusUnauthorized},
+		{"/pong", "secret", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s with %q: %s", tt.path, tt.token, resp.Status)
+		}
+	}
+}
+
+func TestServerEmptyToken(t *testing.T) {
+	s := NewServer("", "", 0)
+	s.Handle("/ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for _, header := range []string{"", "Bearer "} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/ping", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%q: %s", header, resp.Status)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package auth
 
+import "crypto/subtle"
+
 type Socks5Auth struct {
 	Username string
 	Password string
@@ -12,6 +14,9 @@ func NewSocksAuth(username string, password string) Socks5Auth {
 	}
 }
 
+// Auth compares the credentials in constant time
 func (a Socks5Auth) Auth(username string, password string) bool {
-	return a.Username == username && a.Password == password
+	u := subtle.ConstantTimeCompare([]byte(a.Username), []byte(username))
+	p := subtle.ConstantTimeCompare([]byte(a.Password), []byte(password))
+	return u&p == 1
 }
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultGuardSize = 4096
+
+// Ban describes a banned key
+type Ban struct {
+	Key      string    `json:"key"`
+	Lockouts int       `json:"lockouts"`
+	Until    time.Time `json:"until"`
+}
+
+type guardEntry struct {
+	failures int
+	lockouts int
+	last     time.Time
+	until    time.Time
+}
+
+// Guard counts the authentication failures of the keys (client ips or usernames). A key is
+// banned for BanTime after MaxFailures consecutive failures, and the ban time is doubled on
+// each lockout up to MaxBanTime. The failures are forgotten after MaxBanTime without failure.
+type Guard struct {
+	MaxFailures int
+	BanTime     time.Duration
+	MaxBanTime  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*guardEntry
+}
+
+func NewGuard(maxFailures int, banTime, maxBanTime time.Duration) *Guard {
+	if maxBanTime < banTime {
+		maxBanTime = banTime
+	}
+	return &Guard{
+		MaxFailures: maxFailures,
+		BanTime:     banTime,
+		MaxBanTime:  maxBanTime,
+		entries:     make(map[string]*guardEntry),
+	}
+}
+
+// Banned reports whether the key is banned
+func (g *Guard) Banned(key string) bool {
+	if g == nil || key == "" {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e, ok := g.entries[key]
+	return ok && time.Now().Before(e.until)
+}
+
+// Fail records a failure of the key, it returns the ban time if the key is locked out
+func (g *Guard) Fail(key string) (time.Duration, bool) {
+	if g == nil || key == "" {
+		return 0, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	e, ok := g.entries[key]
+	if !ok || (now.Sub(e.last) > g.MaxBanTime && now.After(e.until)) {
+		if len(g.entries) >= defaultGuardSize {
+			g.sweep(now)
+		}
+		e = &guardEntry{}
+		g.entries[key] = e
+	}
+	e.last = now
+	if e.failures++; e.failures < g.MaxFailures {
+		return 0, false
+	}
+	d := g.BanTime << e.lockouts
+	if d <= 0 || d > g.MaxBanTime {
+		d = g.MaxBanTime
+	}
+	e.failures = 0
+	e.lockouts++
+	e.until = now.Add(d)
+	return d, true
+}
+
+// Success resets the failures of the key
+func (g *Guard) Success(key string) {
+	if g == nil || key == "" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e, ok := g.entries[key]; ok {
+		e.failures = 0
+	}
+}
+
+// Unban removes the ban and the failures of the key
+func (g *Guard) Unban(key string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.entries, key)
+}
+
+// Bans returns the banned keys ordered by the expiration time
+func (g *Guard) Bans() (list []Ban) {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	now := time.Now()
+	for k, e := range g.entries {
+		if now.Before(e.until) {
+			list = append(list, Ban{Key: k, Lockouts: e.lockouts, Until: e.until})
+		}
+	}
+	g.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return
+}
+
+func (g *Guard) sweep(now time.Time) {
+	for k, e := range g.entries {
+		if now.Sub(e.last) > g.MaxBanTime && now.After(e.until) {
+			delete(g.entries, k)
+		}
+	}
+	// drop random entries which aren't banned if the guard is still full
+	for k, e := range g.entries {
+		if len(g.entries) < defaultGuardSize {
+			break
+		}
+		if now.After(e.until) {
+			delete(g.entries, k)
+		}
+	}
+}
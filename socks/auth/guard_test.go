@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	g := NewGuard(2, 50*time.Millisecond, 80*time.Millisecond)
+	if _, locked := g.Fail("a"); locked {
+		t.Fatal("locked out after one failure")
+	}
+	d, locked := g.Fail("a")
+	if !locked || d != 50*time.Millisecond || !g.Banned("a") {
+		t.Fatalf("lockout: %v %s", locked, d)
+	}
+	if bans := g.Bans(); len(bans) != 1 || bans[0].Key != "a" {
+		t.Fatalf("bans: %v", bans)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if g.Banned("a") {
+		t.Fatal("ban not expired")
+	}
+	// the next lockout is doubled and capped
+	g.Fail("a")
+	if d, _ = g.Fail("a"); d != 80*time.Millisecond {
+		t.Fatalf("second ban time: %s", d)
+	}
+	g.Unban("a")
+	if g.Banned("a") {
+		t.Fatal("unban failed")
+	}
+}
+
+func TestAuthConstantTime(t *testing.T) {
+	a := NewSocksAuth("user", "pass")
+	if !a.Auth("user", "pass") || a.Auth("user", "pas") || a.Auth("use", "pass") {
+		t.Fatal("unexpected auth result")
+	}
+}
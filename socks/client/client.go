@@ -3,9 +3,11 @@ package client
 import (
 	"bufio"
 	"context"
+	"io"
 	"net"
+	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/josexy/gsocks5/socks/auth"
@@ -13,7 +15,7 @@ import (
 	"github.com/josexy/gsocks5/socks/constant"
 	"github.com/josexy/gsocks5/socks/packet"
 	"github.com/josexy/gsocks5/socks/sc"
-	"github.com/josexy/gsocks5/util"
+	"github.com/josexy/gsocks5/transport"
 )
 
 var defaultSupportMethods = []constant.Socks5Method{
@@ -30,6 +32,9 @@ type Socks5Client struct {
 	dialer     *net.Dialer
 	authMethod constant.Socks5Method
 	authInfo   auth.Socks5Auth
+	transport  transport.Transport
+	wsPath     string
+	fastOpen   bool
 }
 
 func NewSocks5Client(addr string) *Socks5Client {
@@ -49,6 +54,24 @@ func (c *Socks5Client) SetSocksAuth(username, password string) {
 	c.authMethod = constant.MethodUsernamePassword
 }
 
+// SetTransport wraps the connections to the server, such as TLS or the AEAD encryption
+func (c *Socks5Client) SetTransport(t transport.Transport) {
+	c.transport = t
+}
+
+// SetWebSocket tunnels the connections to the server inside WebSocket on the path, the
+// transport is applied below the WebSocket, so that the tls transport makes it wss
+func (c *Socks5Client) SetWebSocket(path string) {
+	c.wsPath = path
+}
+
+// SetFastOpen sends the negotiation, the authentication and the request at once without
+// waiting for the replies, which saves two round trips. Only the method of the client is
+// offered, so the server must accept it.
+func (c *Socks5Client) SetFastOpen(enable bool) {
+	c.fastOpen = enable
+}
+
 func (c *Socks5Client) Close() (err error) {
 	if c.conn != nil {
 		err = c.conn.Close()
@@ -70,21 +93,48 @@ func (c *Socks5Client) Dial(ctx context.Context, addr string) (sc.Conn, error) {
 }
 
 func (c *Socks5Client) DialUDP(ctx context.Context, addr string) (sc.Conn, error) {
-	bindAddr, err := c.handshake(ctx, "tcp", addr, constant.UDP)
+	pc, err := c.associate(ctx)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := connection.DialUDP(bindAddr)
+	ucw, err := newUdpConnWrapper(pc, addr)
 	if err != nil {
+		pc.Close()
 		return nil, err
 	}
-	ucw, err := newUdpConnWrapper(conn, addr)
 	c.udpConn = ucw
 	return ucw, err
 }
 
+// ListenPacket requests a udp association which sends the datagrams to any destination,
+// including the domain names resolved by the server. ReadFrom returns the origin address
+// of each datagram, and the association ends with the control connection.
+func (c *Socks5Client) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	pc, err := c.associate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.udpConn = pc
+	return pc, nil
+}
+
+// associate requests a udp association, the client doesn't know the address it sends the
+// datagrams from before the reply, so DST.ADDR and DST.PORT are zeros (RFC 1928)
+func (c *Socks5Client) associate(ctx context.Context) (*udpPacketConn, error) {
+	bindAddr, err := c.handshake(ctx, "tcp", "0.0.0.0:0", constant.UDP)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := connection.DialUDP(bindAddr)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return newUdpPacketConn(conn, c.conn), nil
+}
+
 func (c *Socks5Client) handshake(ctx context.Context, network, address string, cmd constant.Socks5Cmd) (string, error) {
-	conn, err := connection.Dial(ctx, network, c.Addr, c.timeout)
+	conn, err := dialServer(ctx, network, c.Addr, c.timeout, c.transport, c.wsPath)
 	if err != nil {
 		return "", err
 	}
@@ -93,7 +143,19 @@ func (c *Socks5Client) handshake(ctx context.Context, network, address string, c
 	writer := bufio.NewWriter(conn)
 	rw := bufio.NewReadWriter(reader, writer)
 
-	if err = c.negotiate(rw); err != nil {
+	if c.fastOpen {
+		bindAddr, err := c.pipelineHandshake(rw, address, cmd)
+		if err != nil {
+			_ = conn.Close()
+			return "", err
+		}
+		// the data sent by the target right after the reply may be buffered
+		if reader.Buffered() > 0 {
+			c.conn = &bufferedConn{Conn: conn, r: reader}
+		}
+		return bindAddr, nil
+	}
+	if err = c.negotiate(rw, defaultSupportMethods); err != nil {
 		_ = conn.Close()
 		return "", err
 	}
@@ -103,19 +165,96 @@ func (c *Socks5Client) handshake(ctx context.Context, network, address string, c
 		return "", err
 	}
 	var bindAddr string
-	if bindAddr, err = c.handleRequest(rw, address, cmd); err != nil {
+	if bindAddr, err = handleRequest(conn, rw, address, cmd); err != nil {
 		_ = conn.Close()
 		return "", err
 	}
 	return bindAddr, nil
 }
 
-func (c *Socks5Client) negotiate(rw *bufio.ReadWriter) error {
+// dialServer dials the gsocks5 server and wraps the connection with the transport. With
+// wsPath, the connection is tunneled inside WebSocket, through the http proxy of the
+// environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY) if any.
+func dialServer(ctx context.Context, network, addr string, timeout time.Duration, t transport.Transport, wsPath string) (net.Conn, error) {
+	secure := transport.IsTLS(t)
+	var proxy *url.URL
+	if wsPath != "" {
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		proxy, _ = http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+	}
+	var conn net.Conn
+	var err error
+	if proxy != nil {
+		conn, err = connection.DialHTTPProxy(ctx, proxy, addr, timeout)
+	} else {
+		conn, err = connection.Dial(ctx, network, addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		conn = t.Wrap(conn)
+	}
+	if wsPath == "" {
+		return conn, nil
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	ws, err := transport.WebSocketClient(conn, addr, wsPath, secure)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// pipelineHandshake sends the messages of the handshake in one write and then reads
+// their replies
+func (c *Socks5Client) pipelineHandshake(rw *bufio.ReadWriter, target string, cmd constant.Socks5Cmd) (string, error) {
+	req, err := newRequest(target, cmd)
+	if err != nil {
+		return "", err
+	}
+	methods := []constant.Socks5Method{c.authMethod}
+	msgs := []packet.Serializer{&packet.SocksNegotiateRequest{NMethods: len(methods), Methods: methods}}
+	if c.authMethod == constant.MethodUsernamePassword {
+		msgs = append(msgs, &packet.SocksAuthRequest{Username: c.authInfo.Username, Password: c.authInfo.Password})
+	}
+	msgs = append(msgs, req)
+	buffer := packet.GetBuffer(false)
+	defer packet.ReleaseBuffer(buffer, false)
+	for _, msg := range msgs {
+		n, _ := packet.SerializeDirectTo(*buffer, msg)
+		rw.Write((*buffer)[:n])
+	}
+	if err = rw.Flush(); err != nil {
+		return "", err
+	}
+
+	if err = c.readMethod(rw, methods); err != nil {
+		return "", err
+	}
+	if c.authMethod == constant.MethodUsernamePassword {
+		if err = readAuthReply(rw); err != nil {
+			return "", err
+		}
+	}
+	return readReply(rw.Reader)
+}
+
+func (c *Socks5Client) negotiate(rw *bufio.ReadWriter, methods []constant.Socks5Method) error {
 	packet.SerializeTo(rw, &packet.SocksNegotiateRequest{
-		NMethods: len(defaultSupportMethods),
-		Methods:  defaultSupportMethods,
+		NMethods: len(methods),
+		Methods:  methods,
 	})
+	return c.readMethod(rw, methods)
+}
 
+// readMethod reads the method chosen by the server among methods
+func (c *Socks5Client) readMethod(rw *bufio.ReadWriter, methods []constant.Socks5Method) error {
 	res, err := packet.SerializeFrom[*packet.SocksNegotiateResponse](rw)
 	if err != nil {
 		return err
@@ -127,21 +266,32 @@ func (c *Socks5Client) negotiate(rw *bufio.ReadWriter) error {
 	if res.Version != constant.Socks5Version05 {
 		return constant.ErrVersion5Invalid
 	}
-
-	c.authMethod = res.Method
-	return nil
+	// the server replies X'FF' if none of the methods is acceptable
+	for _, m := range methods {
+		if m == res.Method {
+			c.authMethod = res.Method
+			return nil
+		}
+	}
+	return constant.ErrUnsupportedMethod
 }
 
 func (c *Socks5Client) authentication(rw *bufio.ReadWriter) error {
 	if c.authMethod != constant.MethodUsernamePassword {
 		return nil
 	}
+	return c.authenticate(rw)
+}
 
+func (c *Socks5Client) authenticate(rw *bufio.ReadWriter) error {
 	packet.SerializeTo(rw, &packet.SocksAuthRequest{
 		Username: c.authInfo.Username,
 		Password: c.authInfo.Password,
 	})
+	return readAuthReply(rw)
+}
 
+func readAuthReply(rw *bufio.ReadWriter) error {
 	res, err := packet.SerializeFrom[*packet.SocksAuthResponse](rw)
 	if err != nil {
 		return err
@@ -156,24 +306,40 @@ func (c *Socks5Client) authentication(rw *bufio.ReadWriter) error {
 	return nil
 }
 
-func (c *Socks5Client) handleRequest(rw *bufio.ReadWriter, target string, cmd constant.Socks5Cmd) (string, error) {
-	var host string
-	var port int
-	hp := strings.Split(target, ":")
-	host = hp[0]
-	if len(hp) == 1 {
-		port = 80
-	} else {
-		port, _ = strconv.Atoi(hp[1])
+// handleRequest sends the request over rw and reads the reply from r
+func handleRequest(r io.Reader, rw *bufio.ReadWriter, target string, cmd constant.Socks5Cmd) (string, error) {
+	req, err := newRequest(target, cmd)
+	if err != nil {
+		return "", err
+	}
+	packet.SerializeTo(rw, req)
+	return readReply(r)
+}
+
+func newRequest(target string, cmd constant.Socks5Cmd) (*packet.SocksRequest, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "80")
+	}
+	// the domain name is resolved by the socks server
+	addr, err := packet.ParseAddrSpec(target)
+	if err != nil {
+		return nil, err
+	}
+	host := addr.FQDN
+	if addr.IP != nil {
+		host = addr.IP.String()
 	}
-	packet.SerializeTo(rw, &packet.SocksRequest{
+	return &packet.SocksRequest{
 		Cmd:     cmd,
-		AType:   constant.IPv4,
-		DstAddr: util.ResolveDomain(host),
-		DstPort: port,
-	})
+		AType:   addr.AddrType,
+		DstAddr: host,
+		DstPort: addr.Port,
+	}, nil
+}
 
-	res, err := packet.SerializeFrom[*packet.SocksResponse](rw)
+func readReply(r io.Reader) (string, error) {
+	// read the reply exactly, the data after it belongs to the command
+	res, err := packet.ReadSocksResponse(r)
 	if err != nil {
 		return "", err
 	}
@@ -2,19 +2,62 @@ package client
 
 import (
 	"bufio"
+	"io"
 	"net"
 
 	"github.com/josexy/gsocks5/socks/constant"
 	"github.com/josexy/gsocks5/socks/packet"
 )
 
+// targetAddr is the target address which may be an unresolved domain name
+type targetAddr struct {
+	network string
+	packet.AddrSpec
+}
+
+func newTargetAddr(network, target string) (net.Addr, packet.AddrSpec, error) {
+	addr, err := packet.ParseAddrSpec(target)
+	if err != nil {
+		return nil, addr, err
+	}
+	switch {
+	case addr.IP == nil:
+		return targetAddr{network: network, AddrSpec: addr}, addr, nil
+	case network == "udp":
+		return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, addr, nil
+	default:
+		return &net.TCPAddr{IP: addr.IP, Port: addr.Port}, addr, nil
+	}
+}
+
+// ParseAddr returns the address of the network, the domain name is kept unresolved to be
+// resolved by the server, such as the destination of WriteTo of the udp association
+func ParseAddr(network, address string) (net.Addr, error) {
+	addr, _, err := newTargetAddr(network, address)
+	return addr, err
+}
+
+func (a targetAddr) Network() string {
+	return a.network
+}
+
+// bufferedConn reads the data buffered during the handshake first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 type tcpConnWrapper struct {
 	net.Conn
 	remoteAddr net.Addr // target address
 }
 
 func newTcpConnWrapper(conn net.Conn, target string) (*tcpConnWrapper, error) {
-	addr, err := net.ResolveTCPAddr("tcp", target)
+	addr, _, err := newTargetAddr("tcp", target)
 	if err != nil {
 		return nil, err
 	}
@@ -29,28 +72,114 @@ func (c *tcpConnWrapper) RemoteAddr() net.Addr {
 }
 
 func (c *tcpConnWrapper) TCP() *net.TCPConn {
-	return c.Conn.(*net.TCPConn)
+	conn, _ := c.Conn.(*net.TCPConn)
+	return conn
 }
 
 func (c *tcpConnWrapper) UDP() *net.UDPConn {
 	return nil
 }
 
-type udpConnWrapper struct {
+// udpPacketConn is the udp association of the socks server, the datagrams carry the socks
+// udp header with their destinations or origins. The association ends with the control
+// connection, and closing it closes the control connection.
+type udpPacketConn struct {
 	*net.UDPConn
-	rw         *bufio.ReadWriter
+	ctrl net.Conn
+}
+
+func newUdpPacketConn(conn *net.UDPConn, ctrl net.Conn) *udpPacketConn {
+	go func() {
+		// the server closes the control connection when the association ends
+		io.Copy(io.Discard, ctrl)
+		conn.Close()
+	}()
+	return &udpPacketConn{UDPConn: conn, ctrl: ctrl}
+}
+
+func (c *udpPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// ReadFrom returns the payload and the origin address of the datagram relayed by the
+// server, the invalid datagrams are skipped
+func (c *udpPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
+	for {
+		n, err := c.UDPConn.Read(*buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		origin, payload, err := packet.ReadUDPPacket((*buffer)[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), originAddr(origin), nil
+	}
+}
+
+// WriteTo sends b to addr through the server, addr may be a domain name resolved by the server
+func (c *udpPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		return c.writeTo(b, packet.AddrFromAddrPort(ua.AddrPort()))
+	}
+	a, err := packet.AddrFromString(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return c.writeTo(b, a)
+}
+
+func (c *udpPacketConn) writeTo(b []byte, a packet.Addr) (int, error) {
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
+	n, err := packet.PutUDPPacket(*buffer, a, b)
+	if err != nil {
+		if err == io.ErrShortBuffer {
+			err = constant.ErrUDPPacketTooLarge
+		}
+		return 0, err
+	}
+	if _, err := c.UDPConn.Write((*buffer)[:n]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// originAddr returns the origin address of the packet relayed by the server
+func originAddr(a packet.Addr) net.Addr {
+	if a.IsDomain() {
+		return targetAddr{network: "udp", AddrSpec: packet.AddrSpec{
+			FQDN:     string(a.Domain),
+			Port:     int(a.Port),
+			AddrType: constant.DomainName,
+		}}
+	}
+	return &net.UDPAddr{IP: a.IP.AsSlice(), Port: int(a.Port)}
+}
+
+// udpConnWrapper is the udp association bound to the target address of DialUDP
+type udpConnWrapper struct {
+	*udpPacketConn
 	remoteAddr net.Addr // target address
+	target     packet.Addr
 }
 
-func newUdpConnWrapper(conn *net.UDPConn, target string) (*udpConnWrapper, error) {
-	addr, err := net.ResolveUDPAddr("udp", target)
+func newUdpConnWrapper(pc *udpPacketConn, target string) (*udpConnWrapper, error) {
+	addr, _, err := newTargetAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	a, err := packet.AddrFromString(target)
 	if err != nil {
 		return nil, err
 	}
 	return &udpConnWrapper{
-		UDPConn:    conn,
-		rw:         bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
-		remoteAddr: addr,
+		udpPacketConn: pc,
+		remoteAddr:    addr,
+		target:        a,
 	}, nil
 }
 
@@ -67,27 +196,10 @@ func (c *udpConnWrapper) UDP() *net.UDPConn {
 }
 
 func (c *udpConnWrapper) Read(b []byte) (int, error) {
-	res, err := packet.SerializeFrom[*packet.SocksUDPPacket](c.rw)
-	if err != nil {
-		return 0, err
-	}
-	defer res.Release()
-	n := copy(b, res.UDPData)
-	return n, nil
+	n, _, err := c.ReadFrom(b)
+	return n, err
 }
 
 func (c *udpConnWrapper) Write(b []byte) (int, error) {
-	addr := c.remoteAddr.(*net.UDPAddr)
-	var atype constant.Socks5AddressType
-	if addr.IP.Equal(addr.IP.To4()) {
-		atype = constant.IPv4
-	} else {
-		atype = constant.IPv6
-	}
-	return packet.SerializeTo(c.rw, &packet.SocksUDPPacket{
-		AType:   atype,
-		DstAddr: addr.IP.String(),
-		DstPort: addr.Port,
-		UDPData: b,
-	})
+	return c.writeTo(b, c.target)
 }
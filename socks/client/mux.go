@@ -0,0 +1,219 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/josexy/gsocks5/mux"
+	"github.com/josexy/gsocks5/socks/auth"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/packet"
+	"github.com/josexy/gsocks5/socks/sc"
+	"github.com/josexy/gsocks5/transport"
+)
+
+// MuxClient multiplexes the connections and the udp flows over one authenticated connection
+// to a gsocks5 server with the mux enabled, which saves the handshake of each connection.
+// The connection is dialed on demand and again after it's closed.
+type MuxClient struct {
+	Addr string
+
+	timeout   time.Duration
+	authInfo  auth.Socks5Auth
+	config    *mux.Config
+	transport transport.Transport
+	wsPath    string
+
+	mu   sync.Mutex
+	sess *mux.Session
+}
+
+func NewMuxClient(addr string) *MuxClient {
+	return &MuxClient{
+		Addr:    addr,
+		timeout: time.Second * 10,
+	}
+}
+
+func (c *MuxClient) SetSocksAuth(username, password string) {
+	c.authInfo = auth.NewSocksAuth(username, password)
+}
+
+// SetConfig sets the stream window and the stream limit of the mux session
+func (c *MuxClient) SetConfig(cfg *mux.Config) {
+	c.config = cfg
+}
+
+// SetTransport wraps the connection to the server, such as TLS or the AEAD encryption
+func (c *MuxClient) SetTransport(t transport.Transport) {
+	c.transport = t
+}
+
+// SetWebSocket tunnels the connection to the server inside WebSocket on the path
+func (c *MuxClient) SetWebSocket(path string) {
+	c.wsPath = path
+}
+
+func (c *MuxClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil {
+		c.sess.Close()
+		c.sess = nil
+	}
+	return nil
+}
+
+func (c *MuxClient) Dial(ctx context.Context, addr string) (sc.Conn, error) {
+	st, err := c.open(ctx, addr, constant.Connect)
+	if err != nil {
+		return nil, err
+	}
+	return newTcpConnWrapper(st, addr)
+}
+
+// DialUDP opens a udp flow to addr, the packets are carried by a datagram stream
+func (c *MuxClient) DialUDP(ctx context.Context, addr string) (sc.Conn, error) {
+	st, err := c.open(ctx, addr, constant.UDP)
+	if err != nil {
+		return nil, err
+	}
+	remoteAddr, _, err := newTargetAddr("udp", addr)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	target, err := packet.AddrFromString(addr)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	return &muxUdpConnWrapper{Stream: st, remoteAddr: remoteAddr, target: target}, nil
+}
+
+// open opens a stream and sends the request, a stale session is dialed again once
+func (c *MuxClient) open(ctx context.Context, addr string, cmd constant.Socks5Cmd) (st *mux.Stream, err error) {
+	for i := 0; i < 2; i++ {
+		var sess *mux.Session
+		if sess, err = c.session(ctx); err != nil {
+			return
+		}
+		if cmd == constant.UDP {
+			st, err = sess.OpenDatagram()
+		} else {
+			st, err = sess.OpenStream()
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	st.SetDeadline(deadline)
+	rw := bufio.NewReadWriter(bufio.NewReader(st), bufio.NewWriter(st))
+	// the reply is one message of the datagram stream, which must be read at once
+	var r io.Reader = st
+	if st.Datagram() {
+		r = rw.Reader
+	}
+	if _, err = handleRequest(r, rw, addr, cmd); err != nil {
+		st.Close()
+		return nil, err
+	}
+	st.SetDeadline(time.Time{})
+	return
+}
+
+func (c *MuxClient) session(ctx context.Context) (*mux.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil && !c.sess.IsClosed() {
+		return c.sess, nil
+	}
+	conn, err := dialServer(ctx, "tcp", c.Addr, c.timeout, c.transport, c.wsPath)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	cli := &Socks5Client{conn: conn, authInfo: c.authInfo}
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err = cli.negotiate(rw, []constant.Socks5Method{constant.MethodMux}); err == constant.ErrUnsupportedMethod {
+		err = constant.ErrMuxNotSupported
+	} else if err == nil {
+		err = cli.authenticate(rw)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.sess = mux.Client(conn, c.config)
+	return c.sess, nil
+}
+
+type muxUdpConnWrapper struct {
+	*mux.Stream
+	remoteAddr net.Addr // target address
+	target     packet.Addr
+}
+
+func (c *muxUdpConnWrapper) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *muxUdpConnWrapper) TCP() *net.TCPConn {
+	return nil
+}
+
+func (c *muxUdpConnWrapper) UDP() *net.UDPConn {
+	return nil
+}
+
+func (c *muxUdpConnWrapper) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// ReadFrom returns the packet and its origin address replied by the server
+func (c *muxUdpConnWrapper) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
+	n, err := c.Stream.Read(*buffer)
+	if err != nil {
+		return 0, nil, err
+	}
+	origin, payload, err := packet.ReadUDPPacket((*buffer)[:n])
+	if err != nil {
+		return 0, nil, err
+	}
+	var addr net.Addr = c.remoteAddr
+	if !origin.IsDomain() {
+		addr = originAddr(origin)
+	}
+	return copy(b, payload), addr, nil
+}
+
+func (c *muxUdpConnWrapper) Write(b []byte) (int, error) {
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
+	n, err := packet.PutUDPPacket(*buffer, c.target, b)
+	if err != nil {
+		if err == io.ErrShortBuffer {
+			err = constant.ErrUDPPacketTooLarge
+		}
+		return 0, err
+	}
+	if _, err := c.Stream.Write((*buffer)[:n]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
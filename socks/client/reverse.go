@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/packet"
+)
+
+// Listen asks the socks server to listen on addr for the reverse tunnel. The returned
+// listener accepts the inbound connections of the server, each of them is claimed over a
+// new connection to the server. Closing the listener stops the listening of the server.
+func (c *Socks5Client) Listen(ctx context.Context, addr string) (net.Listener, error) {
+	bindAddr, err := c.handshake(ctx, "tcp", addr, constant.ReverseListen)
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", bindAddr)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return &reverseListener{client: c, control: c.conn, addr: tcpAddr}, nil
+}
+
+type reverseListener struct {
+	client  *Socks5Client
+	control net.Conn
+	addr    net.Addr
+	mu      sync.Mutex
+}
+
+// Accept waits for the next inbound connection announced on the control connection,
+// the connection which can't be claimed is skipped
+func (l *reverseListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		res, err := packet.ReadSocksResponse(l.control)
+		l.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		token := res.BindAddr
+		res.Release()
+		if conn, err := l.claim(token); err == nil {
+			return conn, nil
+		}
+	}
+}
+
+func (l *reverseListener) claim(token string) (net.Conn, error) {
+	c := &Socks5Client{
+		Addr:      l.client.Addr,
+		timeout:   l.client.timeout,
+		dialer:    l.client.dialer,
+		authInfo:  l.client.authInfo,
+		transport: l.client.transport,
+		wsPath:    l.client.wsPath,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	peer, err := c.handshake(ctx, "tcp", net.JoinHostPort(token, "0"), constant.ReverseAccept)
+	if err != nil {
+		return nil, err
+	}
+	host, port, _ := net.SplitHostPort(peer)
+	p, _ := strconv.Atoi(port)
+	return &tcpConnWrapper{
+		Conn:       c.conn,
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP(host), Port: p},
+	}, nil
+}
+
+func (l *reverseListener) Close() error {
+	return l.control.Close()
+}
+
+func (l *reverseListener) Addr() net.Addr {
+	return l.addr
+}
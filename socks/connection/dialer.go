@@ -0,0 +1,215 @@
+package connection
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/josexy/gsocks5/socks/resolver"
+)
+
+const (
+	defaultDialTimeout  = time.Second * 10
+	defaultAttemptDelay = time.Millisecond * 250
+)
+
+type IPPreference = string
+
+const (
+	PreferIPv6 IPPreference = "ipv6"
+	PreferIPv4 IPPreference = "ipv4"
+	OnlyIPv4   IPPreference = "ipv4_only"
+	OnlyIPv6   IPPreference = "ipv6_only"
+)
+
+// Dialer resolves the address with Resolver and races the connection attempts to
+// the resolved addresses as described in RFC 8305 (Happy Eyeballs Version 2).
+// The outbound sockets can be bound to the local address BindAddr, the network
+// interface Interface (SO_BINDTODEVICE) and marked with Mark (SO_MARK).
+type Dialer struct {
+	Timeout      time.Duration
+	AttemptDelay time.Duration
+	Prefer       IPPreference
+	Resolver     resolver.Resolver
+	BindAddr     net.IP
+	Interface    string
+	Mark         int
+}
+
+func (d *Dialer) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return defaultDialTimeout
+	}
+	return d.Timeout
+}
+
+func (d *Dialer) attemptDelay() time.Duration {
+	if d.AttemptDelay <= 0 {
+		return defaultAttemptDelay
+	}
+	return d.AttemptDelay
+}
+
+func (d *Dialer) netDialer(network string) *net.Dialer {
+	nd := &net.Dialer{}
+	if d.BindAddr != nil {
+		if network[:3] == "udp" {
+			nd.LocalAddr = &net.UDPAddr{IP: d.BindAddr}
+		} else {
+			nd.LocalAddr = &net.TCPAddr{IP: d.BindAddr}
+		}
+	}
+	if d.Interface != "" || d.Mark != 0 {
+		nd.Control = d.control
+	}
+	return nd
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	ips, port, err := d.resolve(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.race(ctx, network, ips, port)
+}
+
+func (d *Dialer) DialUDP(ctx context.Context, address string) (*net.UDPConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	ips, port, err := d.resolve(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.netDialer("udp").DialContext(ctx, "udp", net.JoinHostPort(ips[0].String(), port))
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// resolve returns the addresses of the host ordered by the preference
+func (d *Dialer) resolve(ctx context.Context, network, address string) ([]net.IP, string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, "", err
+	}
+	ips, err := resolver.LookupIP(ctx, d.Resolver, host)
+	if err != nil {
+		return nil, "", err
+	}
+	prefer := d.Prefer
+	switch {
+	case network[len(network)-1] == '4':
+		prefer = OnlyIPv4
+	case network[len(network)-1] == '6':
+		prefer = OnlyIPv6
+	case d.BindAddr != nil && d.BindAddr.To4() != nil:
+		// the local address can only connect to the same address family
+		prefer = OnlyIPv4
+	case d.BindAddr != nil:
+		prefer = OnlyIPv6
+	}
+	if ips = sortAddrs(ips, prefer); len(ips) == 0 {
+		return nil, "", &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return ips, port, nil
+}
+
+// sortAddrs interleaves the address families, beginning with the preferred family
+func sortAddrs(ips []net.IP, prefer IPPreference) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	var first, second []net.IP
+	switch prefer {
+	case OnlyIPv4:
+		return v4
+	case OnlyIPv6:
+		return v6
+	case PreferIPv4:
+		first, second = v4, v6
+	default:
+		first, second = v6, v4
+	}
+	list := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			list = append(list, first[i])
+		}
+		if i < len(second) {
+			list = append(list, second[i])
+		}
+	}
+	return list
+}
+
+// race starts a new connection attempt every attempt delay, or as soon as the previous
+// attempt failed. The first established connection wins and the others are closed.
+func (d *Dialer) race(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(ips))
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	var next, pending int
+	startNext := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		go func() {
+			conn, err := d.netDialer(network).DialContext(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+		next++
+		pending++
+		timer.Reset(d.attemptDelay())
+	}
+
+	var firstErr error
+	startNext()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				startNext()
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				startNext()
+			}
+		}
+	}
+	return nil, firstErr
+}
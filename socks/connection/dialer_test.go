@@ -0,0 +1,71 @@
+package connection
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestSortAddrs(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+	}
+	for _, tt := range []struct {
+		prefer IPPreference
+		want   []string
+	}{
+		{"", []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}},
+		{PreferIPv4, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"}},
+		{OnlyIPv4, []string{"192.0.2.1", "192.0.2.2"}},
+		{OnlyIPv6, []string{"2001:db8::1", "2001:db8::2"}},
+	} {
+		got := sortAddrs(ips, tt.prefer)
+		if len(got) != len(tt.want) {
+			t.Fatalf("prefer %q: got %v, want %v", tt.prefer, got, tt.want)
+		}
+		for i := range got {
+			if got[i].String() != tt.want[i] {
+				t.Fatalf("prefer %q: got %v, want %v", tt.prefer, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestDialerFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// the closed port on 127.0.0.2 is refused, then the next address is tried at once
+	d := &Dialer{
+		Prefer:   PreferIPv4,
+		Resolver: staticResolver{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")},
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("example.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Fatalf("remote address: %s", got)
+	}
+}
@@ -0,0 +1,22 @@
+package connection
+
+import (
+	"syscall"
+)
+
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if d.Interface != "" {
+			if err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, d.Interface); err != nil {
+				return
+			}
+		}
+		if d.Mark != 0 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, d.Mark)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package connection
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errSockoptUnsupported = errors.New("binding interface and socket mark are only supported on linux")
+
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	return errSockoptUnsupported
+}
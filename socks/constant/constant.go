@@ -3,6 +3,7 @@ package constant
 const (
 	MaxBufferSize    = 515
 	MaxUdpBufferSize = 1 << 13
+	RelayBufferSize  = 1 << 15
 )
 
 const (
@@ -21,6 +22,11 @@ const (
 	MethodNotAcceptable    = 0xFF
 )
 
+// MethodMux is the private method of the stream multiplexing between the gsocks5 client and
+// server, the username/password sub-negotiation follows it and then the connection carries
+// the mux frames
+const MethodMux Socks5Method = 0x88
+
 type Socks5Cmd = byte
 
 const (
@@ -29,6 +35,13 @@ const (
 	UDP
 )
 
+// the private commands of the reverse tunnel, ReverseListen asks the server to listen on
+// DST.ADDR and ReverseAccept claims the inbound connection of the token in DST.ADDR
+const (
+	ReverseListen Socks5Cmd = 0x80
+	ReverseAccept Socks5Cmd = 0x81
+)
+
 type Socks5AddressType = byte
 
 const (
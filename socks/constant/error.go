@@ -11,4 +11,23 @@ var (
 	ErrUnsupportedReqAType = errors.New("socks unsupported request address type")
 	ErrAuthFailure         = errors.New("socks authentication failure")
 	ErrRequestFailure      = errors.New("socks request failure")
+	ErrNoListener          = errors.New("socks server has no listener")
+	ErrNoAvailablePort     = errors.New("socks udp relay has no available port")
+	ErrHandshakeTimeout    = errors.New("socks handshake timeout")
+	ErrLimitExceeded       = errors.New("socks user limit exceeded")
+	ErrClientBanned        = errors.New("socks client banned")
+	ErrReverseNotAllowed   = errors.New("socks reverse tunnel not allowed")
+	ErrReverseNotFound     = errors.New("socks reverse connection not found")
+	ErrMuxNotSupported     = errors.New("socks mux not supported by server")
+	ErrUDPPacketTooLarge   = errors.New("socks udp packet too large")
+	ErrPacketTooShort      = errors.New("socks packet too short")
+	ErrUDPFragment         = errors.New("socks udp fragment not supported")
+	ErrDomainTooLong       = errors.New("socks domain name too long")
+	ErrUserNotFound        = errors.New("socks user not found")
+	ErrUserDisabled        = errors.New("socks user disabled")
+	ErrUserExpired         = errors.New("socks user expired")
+	ErrSourceNotAllowed    = errors.New("socks source address not allowed")
+	ErrCommandNotAllowed   = errors.New("socks command not allowed")
+	ErrQuotaExceeded       = errors.New("socks user quota exceeded")
+	ErrRouteRejected       = errors.New("socks destination rejected by route")
 )
@@ -0,0 +1,385 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/josexy/gsocks5/socks/client"
+	"github.com/josexy/gsocks5/socks/packet"
+	"github.com/josexy/gsocks5/socks/relay"
+	"github.com/josexy/gsocks5/socks/sc"
+	"github.com/josexy/gsocks5/tcpserver"
+	"github.com/josexy/gsocks5/transport"
+	"github.com/josexy/gsocks5/udpserver"
+	"github.com/josexy/gsocks5/util"
+)
+
+const (
+	defaultUDPTimeout = time.Second * 60
+	minRetryInterval  = time.Second
+	maxRetryInterval  = time.Second * 30
+	dialAttempts      = 3
+)
+
+var ErrForwarderClosed = errors.New("forward: forwarder closed")
+
+// Forwarder forwards the local ports to the remote addresses through the socks server.
+// The failed dials are retried, and the listeners are restarted with backoff.
+type Forwarder struct {
+	Server     string
+	Mappings   []Mapping
+	UDPTimeout time.Duration
+
+	username  string
+	password  string
+	transport transport.Transport
+	wsPath    string
+	useMux    bool
+	muxCli    *client.MuxClient
+
+	mu       sync.Mutex
+	closed   bool
+	doneChan chan struct{}
+	closers  map[interface{ Close() error }]struct{}
+}
+
+func NewForwarder(server string, mappings ...Mapping) *Forwarder {
+	return &Forwarder{
+		Server:     server,
+		Mappings:   mappings,
+		UDPTimeout: defaultUDPTimeout,
+		doneChan:   make(chan struct{}),
+		closers:    make(map[interface{ Close() error }]struct{}),
+	}
+}
+
+func (f *Forwarder) SetSocksAuth(username, password string) {
+	f.username, f.password = username, password
+}
+
+// SetTransport wraps the connections to the server, such as TLS or the AEAD encryption
+func (f *Forwarder) SetTransport(t transport.Transport) {
+	f.transport = t
+}
+
+// SetWebSocket tunnels the connections to the server inside WebSocket on the path
+func (f *Forwarder) SetWebSocket(path string) {
+	f.wsPath = path
+}
+
+// EnableMux carries the connections and the udp flows of the local mappings over one
+// multiplexed connection, which requires the mux enabled on the server
+func (f *Forwarder) EnableMux() {
+	f.useMux = true
+}
+
+func (f *Forwarder) muxClient() *client.MuxClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.muxCli == nil {
+		f.muxCli = client.NewMuxClient(f.Server)
+		if f.username != "" {
+			f.muxCli.SetSocksAuth(f.username, f.password)
+		}
+		f.muxCli.SetTransport(f.transport)
+		f.muxCli.SetWebSocket(f.wsPath)
+	}
+	return f.muxCli
+}
+
+func (f *Forwarder) newClient() *client.Socks5Client {
+	cli := client.NewSocks5Client(f.Server)
+	if f.username != "" {
+		cli.SetSocksAuth(f.username, f.password)
+	}
+	cli.SetTransport(f.transport)
+	cli.SetWebSocket(f.wsPath)
+	return cli
+}
+
+// Start runs all mappings until the forwarder is closed
+func (f *Forwarder) Start() error {
+	var wg sync.WaitGroup
+	for _, m := range f.Mappings {
+		wg.Add(1)
+		go func(m Mapping) {
+			defer wg.Done()
+			f.run(m)
+		}(m)
+	}
+	wg.Wait()
+	return ErrForwarderClosed
+}
+
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrForwarderClosed
+	}
+	f.closed = true
+	close(f.doneChan)
+	for c := range f.closers {
+		c.Close()
+	}
+	if f.muxCli != nil {
+		f.muxCli.Close()
+	}
+	return nil
+}
+
+// track registers the server to be closed with the forwarder, it returns false if the forwarder is closed
+func (f *Forwarder) track(c interface{ Close() error }, add bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if add {
+		if f.closed {
+			return false
+		}
+		f.closers[c] = struct{}{}
+	} else {
+		delete(f.closers, c)
+	}
+	return true
+}
+
+// run serves the mapping and restarts it with backoff when the listener fails
+func (f *Forwarder) run(m Mapping) {
+	interval := minRetryInterval
+	for {
+		start := time.Now()
+		var err error
+		if m.Reverse {
+			err = f.serveReverse(m)
+		} else if m.Network == "udp" {
+			err = f.serveUDP(m)
+		} else {
+			err = f.serveTCP(m)
+		}
+		if err == ErrForwarderClosed {
+			return
+		}
+		if time.Since(start) > maxRetryInterval {
+			interval = minRetryInterval
+		}
+		util.Logger.Errorf("[forward] %s stopped: %v, restart after %s", m, err, interval)
+		select {
+		case <-f.doneChan:
+			return
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+func (f *Forwarder) serveTCP(m Mapping) error {
+	svr := tcpserver.NewTcpServer(m.Local, tcpserver.TcpHandlerFunc(func(ctx context.Context, conn net.Conn) {
+		remote, err := f.dial(ctx, m.Remote)
+		if err != nil {
+			util.Logger.ErrorBy(err)
+			return
+		}
+		defer remote.Close()
+		util.Logger.Infof("[forward] tcp: [%s] <-> remote: [%s]",
+			color.GreenString(conn.RemoteAddr().String()),
+			color.YellowString(m.Remote))
+		if _, _, err = relay.Relay(conn, remote, relay.Timeout{}); err != nil {
+			util.Logger.ErrorBy(err)
+		}
+	}))
+	if !f.track(svr, true) {
+		return ErrForwarderClosed
+	}
+	defer f.track(svr, false)
+	util.Logger.Infof("[forward] listen %s", m)
+	err := svr.ListenAndServe()
+	if err == tcpserver.ErrServerClosed && f.isClosed() {
+		return ErrForwarderClosed
+	}
+	return err
+}
+
+// serveReverse listens on the remote address of the socks server and forwards the
+// accepted connections to the local address
+func (f *Forwarder) serveReverse(m Mapping) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := f.newClient().Listen(ctx, m.Remote)
+	if err != nil {
+		return err
+	}
+	if !f.track(ln, true) {
+		ln.Close()
+		return ErrForwarderClosed
+	}
+	defer f.track(ln, false)
+	util.Logger.Infof("[forward] listen %s on [%s]", m, ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			ln.Close()
+			if f.isClosed() {
+				return ErrForwarderClosed
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			local, err := net.DialTimeout("tcp", m.Local, time.Second*10)
+			if err != nil {
+				util.Logger.ErrorBy(err)
+				return
+			}
+			defer local.Close()
+			util.Logger.Infof("[forward] reverse: [%s] <-> local: [%s]",
+				color.GreenString(conn.RemoteAddr().String()),
+				color.YellowString(m.Local))
+			if _, _, err = relay.Relay(conn, local, relay.Timeout{}); err != nil {
+				util.Logger.ErrorBy(err)
+			}
+		}()
+	}
+}
+
+// dial connects to the remote address through the socks server, the failures are retried
+func (f *Forwarder) dial(ctx context.Context, remote string) (conn sc.Conn, err error) {
+	interval := minRetryInterval / 2
+	for i := 0; i < dialAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-f.doneChan:
+				return nil, ErrForwarderClosed
+			case <-time.After(interval):
+			}
+			interval *= 2
+		}
+		if f.useMux {
+			conn, err = f.muxClient().Dial(ctx, remote)
+		} else {
+			conn, err = f.newClient().Dial(ctx, remote)
+		}
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+type udpFlow struct {
+	cli  *client.Socks5Client
+	conn sc.Conn
+}
+
+func (flow *udpFlow) close() {
+	if flow.cli != nil {
+		flow.cli.Close()
+	} else {
+		flow.conn.Close()
+	}
+}
+
+func (f *Forwarder) dialUDP(ctx context.Context, remote string) (*udpFlow, error) {
+	if f.useMux {
+		conn, err := f.muxClient().DialUDP(ctx, remote)
+		if err != nil {
+			return nil, err
+		}
+		return &udpFlow{conn: conn}, nil
+	}
+	cli := f.newClient()
+	conn, err := cli.DialUDP(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	return &udpFlow{cli: cli, conn: conn}, nil
+}
+
+func (f *Forwarder) serveUDP(m Mapping) error {
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+	delFlow := func(key string, flow *udpFlow) {
+		mu.Lock()
+		defer mu.Unlock()
+		if flows[key] == flow {
+			delete(flows, key)
+			flow.close()
+		}
+	}
+	svr, err := udpserver.NewUdpServer(m.Local, udpserver.UdpHandlerFunc(func(ctx context.Context, p *udpserver.Packet) {
+		src := p.Src
+		key := src.String()
+		mu.Lock()
+		flow := flows[key]
+		mu.Unlock()
+		if flow == nil {
+			// a new association for each local client
+			var err error
+			if flow, err = f.dialUDP(ctx, m.Remote); err != nil {
+				util.Logger.ErrorBy(err)
+				return
+			}
+			mu.Lock()
+			flows[key] = flow
+			mu.Unlock()
+			util.Logger.Infof("[forward] udp: [%s] <-> remote: [%s]",
+				color.GreenString(key),
+				color.YellowString(m.Remote))
+			go func() {
+				defer delFlow(key, flow)
+				f.forwardUDP(p.Writer, flow.conn, src)
+			}()
+		}
+		if _, err := flow.conn.Write(p.Data); err != nil {
+			// the next packet creates a new association
+			delFlow(key, flow)
+		}
+	}))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for key, flow := range flows {
+			flow.close()
+			delete(flows, key)
+		}
+	}()
+	if !f.track(svr, true) {
+		svr.Close()
+		return ErrForwarderClosed
+	}
+	defer f.track(svr, false)
+	util.Logger.Infof("[forward] listen %s", m)
+	err = svr.Serve()
+	if f.isClosed() {
+		return ErrForwarderClosed
+	}
+	return err
+}
+
+// forwardUDP sends the packets from the remote address to the local client until the flow is idle
+func (f *Forwarder) forwardUDP(w udpserver.Writer, rc sc.Conn, src *net.UDPAddr) {
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
+	for {
+		rc.SetReadDeadline(time.Now().Add(f.UDPTimeout))
+		n, err := rc.Read(*buffer)
+		if err != nil {
+			return
+		}
+		w.WriteToUDP((*buffer)[:n], src)
+	}
+}
+
+func (f *Forwarder) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	ErrInvalidMapping        = errors.New("forward: invalid mapping, want [tcp/|udp/][local_host:]local_port:remote_host:remote_port")
+	ErrInvalidReverseMapping = errors.New("forward: invalid reverse mapping, want [remote_host:]remote_port:local_host:local_port")
+)
+
+// Mapping forwards the connections or the packets of the local address to the remote
+// address through the socks server. The reverse mapping listens on the remote address
+// of the socks server and forwards the connections to the local address.
+type Mapping struct {
+	Network string
+	Local   string
+	Remote  string
+	Reverse bool
+}
+
+func (m Mapping) String() string {
+	if m.Reverse {
+		return "reverse " + m.Network + "/" + m.Remote + " -> " + m.Local
+	}
+	return m.Network + "/" + m.Local + " -> " + m.Remote
+}
+
+// ParseMapping parses the mapping like ssh -L, "5432:db.internal:5432" listens on the
+// loopback address, and the udp mapping has the prefix "udp/"
+func ParseMapping(s string) (Mapping, error) {
+	m := Mapping{Network: "tcp"}
+	if network, rest, found := strings.Cut(s, "/"); found {
+		if network != "tcp" && network != "udp" {
+			return m, ErrInvalidMapping
+		}
+		m.Network, s = network, rest
+	}
+	parts := splitHostPorts(s)
+	switch len(parts) {
+	case 3:
+		m.Local = net.JoinHostPort("127.0.0.1", parts[0])
+	case 4:
+		m.Local = net.JoinHostPort(parts[0], parts[1])
+	default:
+		return m, ErrInvalidMapping
+	}
+	m.Remote = net.JoinHostPort(parts[len(parts)-2], parts[len(parts)-1])
+	for _, addr := range []string{m.Local, m.Remote} {
+		if host, port, err := net.SplitHostPort(addr); err != nil || host == "" || port == "" {
+			return m, ErrInvalidMapping
+		}
+	}
+	return m, nil
+}
+
+// ParseReverseMapping parses the reverse mapping like ssh -R, "8080:localhost:80" listens
+// on all addresses of the socks server, only tcp is supported
+func ParseReverseMapping(s string) (Mapping, error) {
+	m := Mapping{Network: "tcp", Reverse: true}
+	s = strings.TrimPrefix(s, "tcp/")
+	if strings.Contains(s, "/") {
+		return m, ErrInvalidReverseMapping
+	}
+	parts := splitHostPorts(s)
+	switch len(parts) {
+	case 3:
+		m.Remote = net.JoinHostPort("0.0.0.0", parts[0])
+	case 4:
+		m.Remote = net.JoinHostPort(parts[0], parts[1])
+	default:
+		return m, ErrInvalidReverseMapping
+	}
+	m.Local = net.JoinHostPort(parts[len(parts)-2], parts[len(parts)-1])
+	for _, addr := range []string{m.Local, m.Remote} {
+		if host, port, err := net.SplitHostPort(addr); err != nil || host == "" || port == "" {
+			return m, ErrInvalidReverseMapping
+		}
+	}
+	return m, nil
+}
+
+// splitHostPorts splits s by the colons outside the brackets of the IPv6 addresses
+func splitHostPorts(s string) (parts []string) {
+	var depth, start int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, strings.Trim(s[start:i], "[]"))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.Trim(s[start:], "[]"))
+}
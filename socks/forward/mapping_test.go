@@ -0,0 +1,45 @@
+package forward
+
+import "testing"
+
+func TestParseMapping(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want Mapping
+	}{
+		{"5432:db.internal:5432", Mapping{"tcp", "127.0.0.1:5432", "db.internal:5432", false}},
+		{"0.0.0.0:8080:10.0.0.1:80", Mapping{"tcp", "0.0.0.0:8080", "10.0.0.1:80", false}},
+		{"udp/5353:10.0.0.1:53", Mapping{"udp", "127.0.0.1:5353", "10.0.0.1:53", false}},
+		{"tcp/[::1]:2222:[fd00::1]:22", Mapping{"tcp", "[::1]:2222", "[fd00::1]:22", false}},
+	} {
+		got, err := ParseMapping(tt.s)
+		if err != nil || got != tt.want {
+			t.Fatalf("%s: got %v %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"5432", "5432:db.internal", "sctp/1:a:2", "1:a:"} {
+		if _, err := ParseMapping(s); err == nil {
+			t.Fatalf("%s: no error", s)
+		}
+	}
+}
+
+func TestParseReverseMapping(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want Mapping
+	}{
+		{"8080:localhost:80", Mapping{"tcp", "localhost:80", "0.0.0.0:8080", true}},
+		{"127.0.0.1:0:10.0.0.1:22", Mapping{"tcp", "10.0.0.1:22", "127.0.0.1:0", true}},
+	} {
+		got, err := ParseReverseMapping(tt.s)
+		if err != nil || got != tt.want {
+			t.Fatalf("%s: got %v %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"8080", "udp/1:a:2", "1:a:"} {
+		if _, err := ParseReverseMapping(s); err == nil {
+			t.Fatalf("%s: no error", s)
+		}
+	}
+}
@@ -23,12 +23,19 @@ func (s *SocksAuthRequest) Serialize(buf []byte) []byte {
 	return buf[:3+n+n2]
 }
 
-func (s *SocksAuthRequest) Revert(data []byte) {
-	s.Version = data[0]
+func (s *SocksAuthRequest) Revert(data []byte) error {
+	if len(data) < 2 || len(data) < 3+int(data[1]) {
+		return constant.ErrPacketTooShort
+	}
 	ul := int(data[1])
-	s.Username = string(data[2 : 2+ul])
 	pl := int(data[2+ul])
-	s.Password = string(data[len(data)-pl:])
+	if len(data) < 3+ul+pl {
+		return constant.ErrPacketTooShort
+	}
+	s.Version = data[0]
+	s.Username = string(data[2 : 2+ul])
+	s.Password = string(data[3+ul : 3+ul+pl])
+	return nil
 }
 
 type SocksAuthResponse struct {
@@ -46,7 +53,11 @@ func (s SocksAuthResponse) Serialize(buf []byte) []byte {
 	return buf[:2]
 }
 
-func (s *SocksAuthResponse) Revert(data []byte) {
+func (s *SocksAuthResponse) Revert(data []byte) error {
+	if len(data) < 2 {
+		return constant.ErrPacketTooShort
+	}
 	s.Version = data[0]
 	s.Status = data[1]
+	return nil
 }
@@ -0,0 +1,188 @@
+package packet
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+// The codec reads and writes the socks addresses and udp packets in place, the decoded
+// domain names and payloads alias the buffer, so nothing is allocated per packet.
+
+// MaxIPUDPHeaderLen is the size of the socks udp header of an ipv6 address, the payload
+// read at this offset leaves the room for the header of any ip address
+const MaxIPUDPHeaderLen = 3 + 1 + net.IPv6len + 2
+
+// Addr is a socks address, an ip address or a domain name with the port
+type Addr struct {
+	IP     netip.Addr
+	Domain []byte
+	Port   uint16
+}
+
+func AddrFromAddrPort(ap netip.AddrPort) Addr {
+	return Addr{IP: ap.Addr().Unmap(), Port: ap.Port()}
+}
+
+// AddrFromString parses host:port, the host which isn't an ip address is a domain name
+func AddrFromString(s string) (Addr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return Addr{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return Addr{}, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return Addr{IP: ip.Unmap(), Port: uint16(p)}, nil
+	}
+	if len(host) > 255 {
+		return Addr{}, constant.ErrDomainTooLong
+	}
+	return Addr{Domain: []byte(host), Port: uint16(p)}, nil
+}
+
+func (a Addr) IsDomain() bool {
+	return !a.IP.IsValid()
+}
+
+// AddrPort returns the ip address and the port, invalid for the domain name
+func (a Addr) AddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(a.IP, a.Port)
+}
+
+func (a Addr) String() string {
+	if a.IsDomain() {
+		return net.JoinHostPort(string(a.Domain), strconv.Itoa(int(a.Port)))
+	}
+	return a.AddrPort().String()
+}
+
+// EncodedLen is the size of ATYP, ADDR and PORT
+func (a Addr) EncodedLen() int {
+	switch {
+	case a.IsDomain():
+		return 1 + 1 + len(a.Domain) + 2
+	case a.IP.Is4():
+		return 1 + net.IPv4len + 2
+	}
+	return 1 + net.IPv6len + 2
+}
+
+// PutAddr writes ATYP, ADDR and PORT of a to b and returns the size
+func PutAddr(b []byte, a Addr) (int, error) {
+	n := a.EncodedLen()
+	if len(b) < n {
+		return 0, io.ErrShortBuffer
+	}
+	switch {
+	case a.IsDomain():
+		if len(a.Domain) > 255 {
+			return 0, constant.ErrDomainTooLong
+		}
+		b[0] = constant.DomainName
+		b[1] = byte(len(a.Domain))
+		copy(b[2:], a.Domain)
+	case a.IP.Is4():
+		b[0] = constant.IPv4
+		ip := a.IP.As4()
+		copy(b[1:], ip[:])
+	default:
+		b[0] = constant.IPv6
+		ip := a.IP.As16()
+		copy(b[1:], ip[:])
+	}
+	binary.BigEndian.PutUint16(b[n-2:], a.Port)
+	return n, nil
+}
+
+// ReadAddr reads ATYP, ADDR and PORT from b and returns the size, the domain name aliases b
+func ReadAddr(b []byte) (Addr, int, error) {
+	if len(b) < 1 {
+		return Addr{}, 0, constant.ErrPacketTooShort
+	}
+	var a Addr
+	var n int
+	switch b[0] {
+	case constant.IPv4:
+		n = 1 + net.IPv4len + 2
+		if len(b) < n {
+			return Addr{}, 0, constant.ErrPacketTooShort
+		}
+		a.IP = netip.AddrFrom4([4]byte(b[1:5]))
+	case constant.IPv6:
+		n = 1 + net.IPv6len + 2
+		if len(b) < n {
+			return Addr{}, 0, constant.ErrPacketTooShort
+		}
+		a.IP = netip.AddrFrom16([16]byte(b[1:17])).Unmap()
+	case constant.DomainName:
+		if len(b) < 2 {
+			return Addr{}, 0, constant.ErrPacketTooShort
+		}
+		n = 1 + 1 + int(b[1]) + 2
+		if len(b) < n {
+			return Addr{}, 0, constant.ErrPacketTooShort
+		}
+		a.Domain = b[2 : n-2]
+	default:
+		return Addr{}, 0, constant.ErrUnsupportedReqAType
+	}
+	a.Port = binary.BigEndian.Uint16(b[n-2:])
+	return a, n, nil
+}
+
+// UDPHeaderLen is the size of the socks udp header of a
+func UDPHeaderLen(a Addr) int {
+	return 3 + a.EncodedLen()
+}
+
+// PutUDPPacket writes the socks udp packet of the payload to b and returns the size.
+// The payload may already be in place at b[UDPHeaderLen(a):], then it isn't copied.
+func PutUDPPacket(b []byte, a Addr, payload []byte) (int, error) {
+	hl := UDPHeaderLen(a)
+	if len(b) < hl+len(payload) {
+		return 0, io.ErrShortBuffer
+	}
+	b[0], b[1], b[2] = 0, 0, 0
+	if _, err := PutAddr(b[3:], a); err != nil {
+		return 0, err
+	}
+	copy(b[hl:], payload)
+	return hl + len(payload), nil
+}
+
+// ReadUDPPacket reads the socks udp packet, the address and the payload alias b
+func ReadUDPPacket(b []byte) (Addr, []byte, error) {
+	if len(b) < 4 {
+		return Addr{}, nil, constant.ErrPacketTooShort
+	}
+	if b[2] != 0 {
+		return Addr{}, nil, constant.ErrUDPFragment
+	}
+	a, n, err := ReadAddr(b[3:])
+	if err != nil {
+		return Addr{}, nil, err
+	}
+	return a, b[3+n:], nil
+}
+
+// PackUDPPayload encodes the udp packet of the n bytes payload read at b[MaxIPUDPHeaderLen:]
+// in place, and returns the packet. The header is written before the payload, so a must be
+// an ip address.
+func PackUDPPayload(b []byte, n int, a Addr) ([]byte, error) {
+	if a.IsDomain() {
+		return nil, constant.ErrUnsupportedReqAType
+	}
+	start := MaxIPUDPHeaderLen - UDPHeaderLen(a)
+	sz, err := PutUDPPacket(b[start:], a, b[MaxIPUDPHeaderLen:MaxIPUDPHeaderLen+n])
+	if err != nil {
+		return nil, err
+	}
+	return b[start : start+sz], nil
+}
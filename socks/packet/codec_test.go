@@ -0,0 +1,149 @@
+package packet
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+var codecAddrs = []string{
+	"1.2.3.4:53",
+	"[2001:db8::1]:443",
+	"example.com:8080",
+}
+
+func TestUDPPacketRoundTrip(t *testing.T) {
+	payload := []byte("payload")
+	for _, s := range codecAddrs {
+		a, err := AddrFromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 512)
+		n, err := PutUDPPacket(b, a, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, data, err := ReadUDPPacket(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != s || !bytes.Equal(data, payload) {
+			t.Fatalf("%s: got %s %q", s, got, data)
+		}
+		// the old serializer reads the same packet
+		res, err := SerializeDirectFrom[*SocksUDPPacket](b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.DstPort != int(a.Port) || !bytes.Equal(res.UDPData, payload) {
+			t.Fatalf("%s: serializer got %+v", s, res)
+		}
+		res.Release()
+	}
+}
+
+func TestReadUDPPacketInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		b   []byte
+		err error
+	}{
+		{[]byte{0, 0, 0}, constant.ErrPacketTooShort},
+		{[]byte{0, 0, 1, constant.IPv4, 1, 2, 3, 4, 0, 53}, constant.ErrUDPFragment},
+		{[]byte{0, 0, 0, constant.IPv4, 1, 2, 3, 4, 0}, constant.ErrPacketTooShort},
+		{[]byte{0, 0, 0, constant.DomainName, 3, 'a', 'b'}, constant.ErrPacketTooShort},
+		{[]byte{0, 0, 0, 9, 1, 2, 3, 4, 0, 53}, constant.ErrUnsupportedReqAType},
+	} {
+		if _, _, err := ReadUDPPacket(tc.b); err != tc.err {
+			t.Fatalf("%v: got %v, want %v", tc.b, err, tc.err)
+		}
+	}
+}
+
+func TestPackUDPPayload(t *testing.T) {
+	for _, ap := range []netip.AddrPort{
+		netip.MustParseAddrPort("1.2.3.4:53"),
+		netip.MustParseAddrPort("[::ffff:1.2.3.4]:53"),
+		netip.MustParseAddrPort("[2001:db8::1]:443"),
+	} {
+		b := make([]byte, 64)
+		n := copy(b[MaxIPUDPHeaderLen:], "reply")
+		pkt, err := PackUDPPayload(b, n, AddrFromAddrPort(ap))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, data, err := ReadUDPPacket(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.AddrPort() != netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()) || string(data) != "reply" {
+			t.Fatalf("%s: got %s %q", ap, a, data)
+		}
+	}
+}
+
+func TestCodecAllocs(t *testing.T) {
+	b := make([]byte, 512)
+	payload := make([]byte, 128)
+	for _, s := range codecAddrs {
+		a, _ := AddrFromString(s)
+		allocs := testing.AllocsPerRun(100, func() {
+			n, _ := PutUDPPacket(b, a, payload)
+			ReadUDPPacket(b[:n])
+		})
+		if allocs != 0 {
+			t.Fatalf("%s: %v allocs", s, allocs)
+		}
+	}
+}
+
+func benchmarkCodec(b *testing.B, s string) {
+	a, _ := AddrFromString(s)
+	buf := make([]byte, constant.MaxUdpBufferSize)
+	payload := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		n, err := PutUDPPacket(buf, a, payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err = ReadUDPPacket(buf[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCodecIPv4(b *testing.B) {
+	benchmarkCodec(b, codecAddrs[0])
+}
+
+func BenchmarkCodecIPv6(b *testing.B) {
+	benchmarkCodec(b, codecAddrs[1])
+}
+
+func BenchmarkCodecDomain(b *testing.B) {
+	benchmarkCodec(b, codecAddrs[2])
+}
+
+func BenchmarkSerializer(b *testing.B) {
+	buf := make([]byte, constant.MaxUdpBufferSize)
+	payload := make([]byte, 512)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		n, _ := SerializeDirectTo(buf, &SocksUDPPacket{
+			AType:   constant.IPv4,
+			DstAddr: "1.2.3.4",
+			DstPort: 53,
+			UDPData: payload,
+		})
+		res, err := SerializeDirectFrom[*SocksUDPPacket](buf[:n])
+		if err != nil {
+			b.Fatal(err)
+		}
+		res.Release()
+	}
+}
@@ -1,8 +1,6 @@
 package packet
 
 import (
-	"sync"
-
 	"github.com/josexy/gsocks5/bufferpool"
 )
 
@@ -23,9 +21,10 @@ type SerializerFactory interface {
 	Release(Serializer)
 }
 
+// simpleSerializerFactory pools the serializers by name, the record is read-only after
+// it's created, so it's shared without locks
 type simpleSerializerFactory struct {
 	record map[string]*bufferpool.BufferPool[Serializer]
-	mu     sync.RWMutex
 }
 
 func newSerializerFactory() *simpleSerializerFactory {
@@ -43,8 +42,6 @@ func newSerializerFactory() *simpleSerializerFactory {
 }
 
 func (sf *simpleSerializerFactory) New(name string) Serializer {
-	sf.mu.RLock()
-	defer sf.mu.RUnlock()
 	if bp, ok := sf.record[name]; ok {
 		return bp.Get()
 	}
@@ -52,8 +49,6 @@ func (sf *simpleSerializerFactory) New(name string) Serializer {
 }
 
 func (sf *simpleSerializerFactory) Release(obj Serializer) {
-	sf.mu.Lock()
-	defer sf.mu.Unlock()
 	if bp, ok := sf.record[obj.String()]; ok {
 		bp.Put(obj)
 	}
@@ -0,0 +1,129 @@
+package packet
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+// fuzzRoundTrip reverts the arbitrary data, which must not panic. The packet reverted
+// successfully is serialized and reverted again, which must keep the fields normalized by
+// norm and the encoding.
+func fuzzRoundTrip[T Serializer](f *testing.F, norm func(T), seeds ...[]byte) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v1, err := SerializeDirectFrom[T](data)
+		if err != nil {
+			return
+		}
+		b1 := append([]byte(nil), v1.Serialize(make([]byte, 2*len(data)+64))...)
+		v2, err := SerializeDirectFrom[T](b1)
+		if err != nil {
+			t.Fatalf("revert %x: %v", b1, err)
+		}
+		if norm != nil {
+			norm(v1)
+		}
+		if !reflect.DeepEqual(v1, v2) {
+			t.Fatalf("revert %x: got %+v, want %+v", b1, v2, v1)
+		}
+		if b2 := v2.Serialize(make([]byte, len(b1)+64)); !bytes.Equal(b1, b2) {
+			t.Fatalf("serialize %+v: got %x, want %x", v2, b2, b1)
+		}
+	})
+}
+
+func FuzzSocksNegotiateRequest(f *testing.F) {
+	fuzzRoundTrip(f, func(v *SocksNegotiateRequest) {
+		v.Version = constant.Socks5Version05
+	},
+		[]byte{0x05, 0x01, 0x00},
+		[]byte{0x05, 0x02, 0x00, 0x02},
+	)
+}
+
+func FuzzSocksNegotiateResponse(f *testing.F) {
+	fuzzRoundTrip(f, func(v *SocksNegotiateResponse) {
+		v.Version = constant.Socks5Version05
+	},
+		[]byte{0x05, 0x02},
+	)
+}
+
+func FuzzSocksAuthRequest(f *testing.F) {
+	fuzzRoundTrip(f, func(v *SocksAuthRequest) {
+		v.Version = constant.Socks5Version01
+	},
+		[]byte("\x01\x04test\x0812345678"),
+		[]byte("\x01\x00\x00"),
+	)
+}
+
+func FuzzSocksAuthResponse(f *testing.F) {
+	fuzzRoundTrip(f, func(v *SocksAuthResponse) {
+		v.Version = constant.Socks5Version01
+	},
+		[]byte{0x01, 0x00},
+	)
+}
+
+func FuzzSocksRequest(f *testing.F) {
+	fuzzRoundTrip(f, func(v *SocksRequest) {
+		v.Version = constant.Socks5Version05
+	},
+		[]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50},
+		append([]byte{0x05, 0x03, 0x00, 0x04}, append(net.ParseIP("2001:db8::1"), 0x01, 0xbb)...),
+		[]byte("\x05\x01\x00\x03\x0bexample.com\x01\xbb"),
+	)
+}
+
+func FuzzSocksResponse(f *testing.F) {
+	fuzzRoundTrip(f, func(v *SocksResponse) {
+		v.Version = constant.Socks5Version05
+		if v.AType == constant.DomainName {
+			return
+		}
+		// the ip address is encoded by its family
+		v.AType = constant.IPv6
+		if net.ParseIP(v.BindAddr).To4() != nil {
+			v.AType = constant.IPv4
+		}
+	},
+		[]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x04, 0x38},
+		append([]byte{0x05, 0x00, 0x00, 0x04}, append(net.ParseIP("::ffff:127.0.0.1"), 0x04, 0x38)...),
+		[]byte("\x05\x00\x00\x03\x09localhost\x04\x38"),
+	)
+}
+
+func FuzzSocksUDPPacket(f *testing.F) {
+	fuzzRoundTrip[*SocksUDPPacket](f, nil,
+		[]byte("\x00\x00\x00\x01\x08\x08\x08\x08\x00\x35query"),
+		append([]byte{0x00, 0x00, 0x00, 0x04}, append(net.ParseIP("2001:db8::1"), 0x00, 0x35)...),
+		[]byte("\x00\x00\x00\x03\x0adns.google\x00\x35query"),
+	)
+}
+
+func FuzzReadUDPPacket(f *testing.F) {
+	f.Add([]byte("\x00\x00\x00\x01\x08\x08\x08\x08\x00\x35query"))
+	f.Add([]byte("\x00\x00\x00\x03\x0adns.google\x00\x35query"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		a, payload, err := ReadUDPPacket(data)
+		if err != nil {
+			return
+		}
+		b := make([]byte, len(data))
+		n, err := PutUDPPacket(b, a, payload)
+		if err != nil {
+			t.Fatalf("put %s: %v", a, err)
+		}
+		a2, payload2, err := ReadUDPPacket(b[:n])
+		if err != nil || a2.String() != a.String() || !bytes.Equal(payload, payload2) {
+			t.Fatalf("read %x: got %s %q %v, want %s %q", b[:n], a2, payload2, err, a, payload)
+		}
+	})
+}
@@ -19,10 +19,15 @@ func (s SocksNegotiateRequest) Serialize(buf []byte) []byte {
 	return buf[:2+s.NMethods]
 }
 
-func (s *SocksNegotiateRequest) Revert(data []byte) {
+func (s *SocksNegotiateRequest) Revert(data []byte) error {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return constant.ErrPacketTooShort
+	}
 	s.Version = data[0]
 	s.NMethods = int(data[1])
-	s.Methods = data[2:]
+	// the methods are copied, data is a pooled buffer
+	s.Methods = append(s.Methods[:0], data[2:2+s.NMethods]...)
+	return nil
 }
 
 type SocksNegotiateResponse struct {
@@ -40,7 +45,11 @@ func (s SocksNegotiateResponse) Serialize(buf []byte) []byte {
 	return buf[:2]
 }
 
-func (s *SocksNegotiateResponse) Revert(data []byte) {
+func (s *SocksNegotiateResponse) Revert(data []byte) error {
+	if len(data) < 2 {
+		return constant.ErrPacketTooShort
+	}
 	s.Version = data[0]
 	s.Method = data[1]
+	return nil
 }
@@ -2,6 +2,8 @@ package packet
 
 import (
 	"bufio"
+	"io"
+	"net"
 
 	"github.com/josexy/gsocks5/bufferpool"
 	"github.com/josexy/gsocks5/socks/constant"
@@ -22,7 +24,8 @@ type Serializer interface {
 	String() string
 	Release()
 	Serialize(buf []byte) []byte
-	Revert(data []byte)
+	// Revert decodes data, which may be truncated or malformed
+	Revert(data []byte) error
 }
 
 func GetBuffer(isUdpBuffer bool) *[]byte {
@@ -35,6 +38,7 @@ func GetBuffer(isUdpBuffer bool) *[]byte {
 func ReleaseBuffer(buf *[]byte, isUdpBuffer bool) {
 	if isUdpBuffer {
 		udpBufferPool.Put(buf)
+		return
 	}
 	bufferPool.Put(buf)
 }
@@ -44,32 +48,103 @@ func SerializeDirectFrom[T Serializer](buffer []byte) (v T, err error) {
 	if res == nil {
 		return v, constant.ErrSerializeFailure
 	}
-	res.Revert(buffer[:])
+	if err = res.Revert(buffer[:]); err != nil {
+		res.Release()
+		return v, err
+	}
 	return res.(T), nil
 }
 
+// SerializeFrom reads a message from rw. The handshake messages are read exactly, so that
+// the messages pipelined by the peer stay buffered in rw, while a udp packet is read at once.
 func SerializeFrom[T Serializer](rw *bufio.ReadWriter) (v T, err error) {
+	if v.String() != StrSocksUDPPacket {
+		return readMessage[T](rw.Reader)
+	}
 	res := sFactory.New(v.String())
 	if res == nil {
 		return v, constant.ErrSerializeFailure
 	}
-	var buffer *[]byte
-	if v.String() == StrSocksUDPPacket {
-		buffer = udpBufferPool.Get()
-		defer udpBufferPool.Put(buffer)
-	} else {
-		buffer = bufferPool.Get()
-		defer bufferPool.Put(buffer)
-	}
+	buffer := udpBufferPool.Get()
+	defer udpBufferPool.Put(buffer)
 	n, e := rw.Read(*buffer)
 	if e != nil {
 		res.Release()
 		return v, e
 	}
-	res.Revert((*buffer)[:n])
+	if e = res.Revert((*buffer)[:n]); e != nil {
+		res.Release()
+		return v, e
+	}
 	return res.(T), nil
 }
 
+func readMessage[T Serializer](r *bufio.Reader) (v T, err error) {
+	n, err := messageLen(r, v.String())
+	if err != nil {
+		return v, err
+	}
+	data, err := r.Peek(n)
+	if err != nil {
+		return v, err
+	}
+	v, err = SerializeDirectFrom[T](data)
+	r.Discard(n)
+	return v, err
+}
+
+// messageLen peeks the header of the next message to get its length. The message of
+// another version is framed by the header, so that it's rejected without waiting for more.
+func messageLen(r *bufio.Reader, name string) (int, error) {
+	switch name {
+	case StrSocksNegotiateResponse, StrSocksAuthResponse:
+		return 2, nil
+	case StrSocksNegotiateRequest:
+		b, err := r.Peek(2)
+		if err != nil {
+			return 0, err
+		}
+		if b[0] != constant.Socks5Version05 {
+			return 2, nil
+		}
+		return 2 + int(b[1]), nil
+	case StrSocksAuthRequest:
+		b, err := r.Peek(2)
+		if err != nil {
+			return 0, err
+		}
+		if b[0] != constant.Socks5Version01 {
+			return 2, nil
+		}
+		ul := int(b[1])
+		if b, err = r.Peek(3 + ul); err != nil {
+			return 0, err
+		}
+		return 3 + ul + int(b[2+ul]), nil
+	case StrSocksRequest, StrSocksResponse:
+		b, err := r.Peek(4)
+		if err != nil {
+			return 0, err
+		}
+		if b[0] != constant.Socks5Version05 {
+			return 4, nil
+		}
+		switch b[3] {
+		case constant.IPv4:
+			return 4 + net.IPv4len + 2, nil
+		case constant.IPv6:
+			return 4 + net.IPv6len + 2, nil
+		case constant.DomainName:
+			if b, err = r.Peek(5); err != nil {
+				return 0, err
+			}
+			return 5 + int(b[4]) + 2, nil
+		}
+		return 4, nil
+	}
+	return 0, constant.ErrSerializeFailure
+}
+
 func SerializeDirectTo(buffer []byte, v Serializer) (n int, err error) {
 	data := v.Serialize(buffer)
 	return len(data), nil
@@ -88,3 +163,35 @@ func SerializeTo(rw *bufio.ReadWriter, v Serializer) (n int, err error) {
 	_ = rw.Flush()
 	return
 }
+
+// ReadSocksResponse reads exactly one socks response from r, the data after the response
+// isn't consumed
+func ReadSocksResponse(r io.Reader) (*SocksResponse, error) {
+	buffer := bufferPool.Get()
+	defer bufferPool.Put(buffer)
+	buf := *buffer
+	// VER REP RSV ATYP and the first byte of BND.ADDR
+	if _, err := io.ReadFull(r, buf[:5]); err != nil {
+		return nil, err
+	}
+	var n int
+	switch buf[3] {
+	case constant.IPv4:
+		n = 4 + net.IPv4len + 2
+	case constant.IPv6:
+		n = 4 + net.IPv6len + 2
+	case constant.DomainName:
+		n = 5 + int(buf[4]) + 2
+	default:
+		return nil, constant.ErrSerializeFailure
+	}
+	if _, err := io.ReadFull(r, buf[5:n]); err != nil {
+		return nil, err
+	}
+	res := sFactory.New(StrSocksResponse).(*SocksResponse)
+	if err := res.Revert(buf[:n]); err != nil {
+		res.Release()
+		return nil, err
+	}
+	return res, nil
+}
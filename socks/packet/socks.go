@@ -49,21 +49,20 @@ func (s SocksRequest) Serialize(buf []byte) []byte {
 	return buf[:index+vl+2]
 }
 
-func (s *SocksRequest) Revert(data []byte) {
-	n := len(data)
+func (s *SocksRequest) Revert(data []byte) error {
+	if len(data) < 4 {
+		return constant.ErrPacketTooShort
+	}
+	a, _, err := ReadAddr(data[3:])
+	if err != nil {
+		return err
+	}
 	s.Version = data[0]
 	s.Cmd = data[1]
 	s.AType = data[3]
-	switch s.AType {
-	case constant.IPv4:
-		s.DstAddr = net.IP(data[4:8]).String()
-	case constant.IPv6:
-		s.DstAddr = net.IP(data[4:20]).String()
-	case constant.DomainName:
-		hostLen := int(data[4]) // domain length
-		s.DstAddr = string(data[5 : 5+hostLen])
-	}
-	s.DstPort = int(binary.BigEndian.Uint16(data[n-2:]))
+	s.DstAddr = addrHost(a)
+	s.DstPort = int(a.Port)
+	return nil
 }
 
 type SocksResponse struct {
@@ -83,9 +82,21 @@ func (s SocksResponse) Serialize(buf []byte) []byte {
 	buf[1] = s.ReplayCode
 	buf[2] = 0x00
 
+	if s.AType == constant.DomainName {
+		buf[3] = constant.DomainName
+		buf[4] = byte(len(s.BindAddr))
+		vl := copy(buf[5:], s.BindAddr)
+		binary.BigEndian.PutUint16(buf[5+vl:], uint16(s.BindPort))
+		return buf[:7+vl]
+	}
+
 	var vl int
 	var atype constant.Socks5AddressType
 	ip := net.ParseIP(s.BindAddr)
+	if ip == nil {
+		// the failure reply has no bind address
+		ip = net.IPv4zero
+	}
 	if ip.Equal(ip.To4()) {
 		// ipv4
 		vl = 4
@@ -104,18 +115,26 @@ func (s SocksResponse) Serialize(buf []byte) []byte {
 	return buf[:6+vl]
 }
 
-func (s *SocksResponse) Revert(data []byte) {
-	n := len(data)
+func (s *SocksResponse) Revert(data []byte) error {
+	if len(data) < 4 {
+		return constant.ErrPacketTooShort
+	}
+	a, _, err := ReadAddr(data[3:])
+	if err != nil {
+		return err
+	}
 	s.Version = data[0]
 	s.ReplayCode = data[1]
 	s.AType = data[3]
-	switch s.AType {
-	case constant.IPv4:
-		s.BindAddr = net.IP(data[4:8]).String()
-	case constant.IPv6:
-		s.BindAddr = net.IP(data[4:20]).String()
-	case constant.DomainName:
-		s.BindAddr = string(data[4 : n-2])
+	s.BindAddr = addrHost(a)
+	s.BindPort = int(a.Port)
+	return nil
+}
+
+// addrHost returns the host of the address as the string fields of the packets
+func addrHost(a Addr) string {
+	if a.IsDomain() {
+		return string(a.Domain)
 	}
-	s.BindPort = int(binary.BigEndian.Uint16(data[n-2:]))
+	return a.IP.String()
 }
@@ -49,24 +49,24 @@ func (s SocksUDPPacket) Serialize(buf []byte) []byte {
 	return buf[:vl]
 }
 
-func (s *SocksUDPPacket) Revert(data []byte) {
-	n := len(data)
-	s.AType = data[3]
-	var vl int
-	switch s.AType {
-	case constant.IPv4:
-		vl = 4
-		s.DstAddr = net.IP(data[4:8]).String()
-	case constant.IPv6:
-		vl = 16
-		s.DstAddr = net.IP(data[4:20]).String()
-	case constant.DomainName:
-		hostLen := int(data[4]) // domain length
-		vl = hostLen + 1
-		s.DstAddr = string(data[5 : 5+hostLen])
+// ValidUDPPacket checks the header of the socks udp packet before it's reverted, the
+// fragments are not supported
+func ValidUDPPacket(b []byte) bool {
+	_, _, err := ReadUDPPacket(b)
+	return err == nil
+}
+
+func (s *SocksUDPPacket) Revert(data []byte) error {
+	if len(data) < 4 {
+		return constant.ErrPacketTooShort
+	}
+	a, n, err := ReadAddr(data[3:])
+	if err != nil {
+		return err
 	}
-	s.DstPort = int(binary.BigEndian.Uint16(data[4+vl : 6+vl]))
-	size := n - 6 - vl
-	s.UDPData = make([]byte, size)
-	copy(s.UDPData, data[6+vl:])
+	s.AType = data[3]
+	s.DstAddr = addrHost(a)
+	s.DstPort = int(a.Port)
+	s.UDPData = append(s.UDPData[:0], data[3+n:]...)
+	return nil
 }
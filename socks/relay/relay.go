@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/josexy/gsocks5/bufferpool"
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+var bufferPool = bufferpool.NewBufferPool(func() *[]byte {
+	buf := make([]byte, constant.RelayBufferSize)
+	return &buf
+})
+
+type tcpConn interface {
+	TCP() *net.TCPConn
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// unwrap returns the underlying *net.TCPConn of the connection wrappers such as sc.Conn,
+// so that the runtime can use splice(2) on linux
+func unwrap(c net.Conn) net.Conn {
+	if tc, ok := c.(tcpConn); ok {
+		if conn := tc.TCP(); conn != nil {
+			return conn
+		}
+	}
+	return c
+}
+
+// Copy copies from src to dst until EOF is reached on src. The data is spliced in
+// the kernel if both of them are tcp connections, otherwise it's copied with a pooled buffer.
+func Copy(dst, src net.Conn) (int64, error) {
+	return copyN(dst, src, -1)
+}
+
+// copyN copies at most n bytes if n >= 0
+func copyN(dst, src net.Conn, n int64) (int64, error) {
+	var r io.Reader = src
+	if tc, ok := unwrap(dst).(*net.TCPConn); ok {
+		if sc, ok := unwrap(src).(*net.TCPConn); ok {
+			if n < 0 {
+				return tc.ReadFrom(sc)
+			}
+			// splice also supports *io.LimitedReader
+			return tc.ReadFrom(&io.LimitedReader{R: sc, N: n})
+		}
+	}
+	if n >= 0 {
+		r = &io.LimitedReader{R: src, N: n}
+	}
+	buf := bufferPool.Get()
+	defer bufferPool.Put(buf)
+	return io.CopyBuffer(dst, r, *buf)
+}
+
+// Relay copies data between left and right in both directions. When one direction
+// reaches EOF, the write side of its destination is closed so that the peer receives
+// FIN, while the other direction continues. An error in any direction closes both connections.
+// It returns the number of bytes copied from left to right and from right to left.
+func Relay(left, right net.Conn, timeout Timeout) (sent, received int64, err error) {
+	type result struct {
+		n   int64
+		err error
+	}
+	var w *watchdog
+	if timeout.enabled() {
+		w = newWatchdog(timeout, left, right)
+	}
+	ch := make(chan result, 1)
+	go func() {
+		n, err := copyHalf(right, left, w, 0)
+		ch <- result{n, err}
+	}()
+	received, err = copyHalf(left, right, w, 1)
+	r := <-ch
+	sent = r.n
+	if err == nil {
+		err = r.err
+	}
+	return
+}
+
+func copyHalf(dst, src net.Conn, w *watchdog, dir int) (n int64, err error) {
+	if w != nil {
+		n, err = w.copy(dst, src, dir)
+	} else {
+		n, err = Copy(dst, src)
+	}
+	if err != nil {
+		// unblock the other direction
+		dst.Close()
+		src.Close()
+		if errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+		return n, err
+	}
+	CloseWrite(dst)
+	return n, nil
+}
+
+// CloseWrite shuts down the write side of the connection, or closes it if the
+// connection doesn't support half-close
+func CloseWrite(c net.Conn) error {
+	if cw, ok := unwrap(c).(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,182 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const benchDataSize = 64 << 20
+
+// hiddenConn hides the *net.TCPConn like a connection wrapper without TCP()
+type hiddenConn struct {
+	net.Conn
+}
+
+// tcpWrapper exposes the *net.TCPConn like sc.Conn
+type tcpWrapper struct {
+	net.Conn
+}
+
+func (c tcpWrapper) TCP() *net.TCPConn {
+	return c.Conn.(*net.TCPConn)
+}
+
+// tcpPair returns the both ends of a tcp connection
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	ch := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		ch <- conn
+	}()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c1, <-ch
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	var sent, received int64
+	go func() {
+		sent, received, _ = Relay(proxyIn, proxyOut, Timeout{})
+		proxyIn.Close()
+		proxyOut.Close()
+		close(done)
+	}()
+
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+	// the server sees EOF but can still reply
+	req, err := io.ReadAll(server)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("server read: %q %v", req, err)
+	}
+	server.Write([]byte("response"))
+	server.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("client read: %q %v", resp, err)
+	}
+	<-done
+	if sent != 7 || received != 8 {
+		t.Fatalf("sent: %d, received: %d", sent, received)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, _, err := Relay(proxyIn, proxyOut, Timeout{Idle: 100 * time.Millisecond})
+		done <- err
+	}()
+	go io.Copy(io.Discard, server)
+
+	// the traffic in one direction keeps the relay alive
+	for i := 0; i < 6; i++ {
+		client.Write([]byte("ping"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("relay stopped while active: %v", err)
+	default:
+	}
+	if err := <-done; err != ErrIdleTimeout {
+		t.Fatalf("relay error: %v, want %v", err, ErrIdleTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("relay stopped too early: %s", elapsed)
+	}
+}
+
+func TestRelayIdleTimeoutAfterHalfClose(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := Relay(proxyIn, proxyOut, Timeout{Idle: 100 * time.Millisecond})
+		done <- err
+	}()
+	client.(*net.TCPConn).CloseWrite()
+	select {
+	case err := <-done:
+		if err != ErrIdleTimeout {
+			t.Fatalf("relay error: %v, want %v", err, ErrIdleTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("relay didn't stop")
+	}
+}
+
+func TestRelaySessionExpired(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	_, _, err := Relay(proxyIn, proxyOut, Timeout{Deadline: time.Now().Add(100 * time.Millisecond)})
+	if err != ErrSessionExpired {
+		t.Fatalf("relay error: %v, want %v", err, ErrSessionExpired)
+	}
+}
+
+func benchmarkRelay(b *testing.B, copyFn func(dst, src net.Conn) (int64, error), wrap func(net.Conn) net.Conn) {
+	buf := make([]byte, 1<<20)
+	b.SetBytes(benchDataSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client, proxyIn := tcpPair(b)
+		proxyOut, server := tcpPair(b)
+		go func() {
+			copyFn(wrap(proxyOut), wrap(proxyIn))
+			proxyOut.Close()
+		}()
+		go func() {
+			for n := 0; n < benchDataSize; n += len(buf) {
+				client.Write(buf)
+			}
+			client.Close()
+		}()
+		b.StartTimer()
+		io.CopyBuffer(io.Discard, server, buf)
+		b.StopTimer()
+		proxyIn.Close()
+		server.Close()
+	}
+}
+
+func BenchmarkIOCopyWrapped(b *testing.B) {
+	benchmarkRelay(b, func(dst, src net.Conn) (int64, error) { return io.Copy(dst, src) },
+		func(c net.Conn) net.Conn { return hiddenConn{c} })
+}
+
+func BenchmarkCopyPooledBuffer(b *testing.B) {
+	benchmarkRelay(b, Copy, func(c net.Conn) net.Conn { return hiddenConn{c} })
+}
+
+func BenchmarkCopySplice(b *testing.B) {
+	benchmarkRelay(b, Copy, func(c net.Conn) net.Conn { return tcpWrapper{c} })
+}
@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// chunkSize is the maximum bytes copied between two refreshes of the deadlines
+const chunkSize = 1 << 20
+
+var (
+	ErrIdleTimeout    = errors.New("relay: idle timeout")
+	ErrSessionExpired = errors.New("relay: session lifetime exceeded")
+)
+
+// Timeout limits the relay. Idle is the maximum duration without any data in both
+// directions, and Deadline is the absolute time when the relay stops.
+type Timeout struct {
+	Idle     time.Duration
+	Deadline time.Time
+}
+
+func (t Timeout) enabled() bool {
+	return t.Idle > 0 || !t.Deadline.IsZero()
+}
+
+// watchdog refreshes the deadlines of both directions of a relay. The spliced data is
+// invisible until a chunk is done, so a direction that seems idle interrupts the other
+// direction, which then reports its progress or decides that the relay is idle.
+type watchdog struct {
+	Timeout
+	conns   [2]net.Conn
+	last    atomic.Int64
+	suspect atomic.Int32
+	done    [2]atomic.Bool
+}
+
+func newWatchdog(t Timeout, left, right net.Conn) *watchdog {
+	w := &watchdog{Timeout: t, conns: [2]net.Conn{left, right}}
+	w.touch()
+	return w
+}
+
+func (w *watchdog) touch() {
+	w.last.Store(time.Now().UnixNano())
+	w.suspect.Store(0)
+}
+
+func (w *watchdog) deadline(from time.Time) time.Time {
+	var d time.Time
+	if w.Idle > 0 {
+		d = from.Add(w.Idle)
+	}
+	if !w.Deadline.IsZero() && (d.IsZero() || w.Deadline.Before(d)) {
+		d = w.Deadline
+	}
+	return d
+}
+
+func (w *watchdog) expired() error {
+	now := time.Now()
+	if !w.Deadline.IsZero() && !now.Before(w.Deadline) {
+		return ErrSessionExpired
+	}
+	if w.Idle > 0 && now.Sub(time.Unix(0, w.last.Load())) >= w.Idle {
+		return ErrIdleTimeout
+	}
+	return nil
+}
+
+// copy copies from src to dst in chunks, the deadlines are refreshed after every chunk.
+// dir is the index of src in conns.
+func (w *watchdog) copy(dst, src net.Conn, dir int) (written int64, err error) {
+	defer w.done[dir].Store(true)
+	id := int32(dir + 1)
+	from := time.Unix(0, w.last.Load())
+	for {
+		deadline := w.deadline(from)
+		src.SetReadDeadline(deadline)
+		dst.SetWriteDeadline(deadline)
+		n, err := copyN(dst, src, chunkSize)
+		written += n
+		from = time.Unix(0, w.last.Load())
+		if n > 0 {
+			w.touch()
+			from = time.Now()
+		}
+		if err != nil {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				return written, err
+			}
+			if n > 0 {
+				continue
+			}
+			switch err = w.expired(); {
+			case err == ErrSessionExpired:
+				return written, err
+			case err == nil:
+				continue
+			}
+			if w.done[1-dir].Load() {
+				// the other direction has finished
+				return written, err
+			} else if w.suspect.CompareAndSwap(0, id) {
+				// ask the other direction whether there is any data
+				w.conns[1-dir].SetReadDeadline(time.Now())
+				from = time.Now()
+			} else if w.suspect.Load() == id {
+				from = time.Now()
+			} else {
+				// the other direction is idle too
+				return written, err
+			}
+			continue
+		}
+		if n < chunkSize {
+			// EOF
+			return written, nil
+		}
+	}
+}
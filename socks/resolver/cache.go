@@ -0,0 +1,111 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheTTL  = time.Minute
+	defaultCacheSize = 4096
+)
+
+type cacheEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// CacheResolver caches the addresses resolved by the underlying resolver. The ttl of a
+// TTLResolver is clamped to [MinTTL, MaxTTL], and others are cached for MaxTTL.
+type CacheResolver struct {
+	Resolver Resolver
+	MinTTL   time.Duration
+	MaxTTL   time.Duration
+	Size     int
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+func NewCacheResolver(r Resolver, minTTL, maxTTL time.Duration) *CacheResolver {
+	if maxTTL <= 0 {
+		maxTTL = defaultCacheTTL
+	}
+	if minTTL > maxTTL {
+		minTTL = maxTTL
+	}
+	return &CacheResolver{
+		Resolver: r,
+		MinTTL:   minTTL,
+		MaxTTL:   maxTTL,
+		Size:     defaultCacheSize,
+		cache:    make(map[string]cacheEntry),
+	}
+}
+
+func (r *CacheResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := r.LookupIPTTL(ctx, host)
+	return ips, err
+}
+
+func (r *CacheResolver) LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	now := time.Now()
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expire) {
+		return entry.ips, entry.expire.Sub(now), nil
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if tr, ok := r.Resolver.(TTLResolver); ok {
+		ips, ttl, err = tr.LookupIPTTL(ctx, host)
+	} else {
+		ips, err = r.Resolver.LookupIP(ctx, host)
+		ttl = r.MaxTTL
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if ttl < r.MinTTL {
+		ttl = r.MinTTL
+	} else if ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	if ttl > 0 {
+		r.set(host, cacheEntry{ips: ips, expire: now.Add(ttl)})
+	}
+	return ips, ttl, nil
+}
+
+func (r *CacheResolver) set(host string, entry cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= r.Size {
+		now := time.Now()
+		for k, v := range r.cache {
+			if now.After(v.expire) {
+				delete(r.cache, k)
+			}
+		}
+		// evict random entries if the cache is still full
+		for k := range r.cache {
+			if len(r.cache) < r.Size {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[host] = entry
+}
+
+// Flush removes all cached addresses
+func (r *CacheResolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = make(map[string]cacheEntry)
+}
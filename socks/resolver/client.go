@@ -0,0 +1,353 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTimeout   = time.Second * 5
+	maxUDPMessageLen = 1232
+	maxTCPMessageLen = 65535
+)
+
+type server struct {
+	scheme   string // udp, tcp, tls or https
+	addr     string
+	url      string
+	insecure bool
+}
+
+// parseServer parses the dns server address, for example:
+//
+//	8.8.8.8
+//	udp://8.8.8.8:53
+//	tcp://8.8.8.8:53
+//	tls://1.1.1.1:853
+//	https://1.1.1.1/dns-query
+//
+// The query parameter "insecure=true" skips the certificate verification of tls and https servers.
+func parseServer(s string) (*server, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	srv := &server{scheme: u.Scheme, addr: u.Host, insecure: u.Query().Get("insecure") == "true"}
+	var port string
+	switch u.Scheme {
+	case "udp", "tcp":
+		port = "53"
+	case "tls":
+		port = "853"
+	case "https":
+		port = "443"
+		q := u.Query()
+		q.Del("insecure")
+		u.RawQuery = q.Encode()
+		srv.url = u.String()
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidServer, s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidServer, s)
+	}
+	if u.Port() == "" {
+		srv.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	return srv, nil
+}
+
+// Client resolves domain names with the dns servers in order, the next server is
+// tried when the previous one fails.
+type Client struct {
+	servers    []*server
+	timeout    time.Duration
+	httpClient *http.Client
+}
+
+func NewClient(servers []string, timeout time.Duration) (*Client, error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	c := &Client{timeout: timeout}
+	var insecure bool
+	for _, s := range servers {
+		srv, err := parseServer(s)
+		if err != nil {
+			return nil, err
+		}
+		insecure = insecure || (srv.scheme == "https" && srv.insecure)
+		c.servers = append(c.servers, srv)
+	}
+	if len(c.servers) == 0 {
+		return nil, ErrInvalidServer
+	}
+	c.httpClient = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+	return c, nil
+}
+
+func (c *Client) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := c.LookupIPTTL(ctx, host)
+	return ips, err
+}
+
+// LookupIPTTL queries the A and AAAA records of host concurrently and returns the
+// minimum ttl of the answers
+func (c *Client) LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	ch := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := c.lookup(ctx, host, qtype)
+			ch <- result{ips, ttl, err}
+		}(qtype)
+	}
+	var ips []net.IP
+	var ttl uint32
+	var err error
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		if len(r.ips) > 0 && (len(ips) == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+		ips = append(ips, r.ips...)
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = ErrNoAddress
+		}
+		return nil, 0, fmt.Errorf("lookup %s: %w", host, err)
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func (c *Client) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, 0, err
+	}
+	var b [2]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	msg, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, srv := range c.servers {
+		var resp []byte
+		if resp, err = c.exchange(ctx, srv, msg); err != nil {
+			continue
+		}
+		var ips []net.IP
+		var ttl uint32
+		if ips, ttl, err = parseAnswer(resp, id, qtype); err == nil || err == ErrNoAddress {
+			return ips, ttl, nil
+		}
+	}
+	return nil, 0, err
+}
+
+func (c *Client) exchange(ctx context.Context, srv *server, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	switch srv.scheme {
+	case "https":
+		return c.exchangeHTTPS(ctx, srv, msg)
+	case "udp":
+		resp, err := exchangeConn(ctx, srv, "udp", msg)
+		if err == nil && truncated(resp) {
+			// retry with tcp for the truncated response
+			return exchangeConn(ctx, srv, "tcp", msg)
+		}
+		return resp, err
+	default:
+		return exchangeConn(ctx, srv, srv.scheme, msg)
+	}
+}
+
+func exchangeConn(ctx context.Context, srv *server, network string, msg []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(srv.addr)
+		conn, err = (&tls.Dialer{
+			NetDialer: dialer,
+			Config:    &tls.Config{ServerName: host, InsecureSkipVerify: srv.insecure},
+		}).DialContext(ctx, "tcp", srv.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, srv.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		return exchangeUDP(conn.(*net.UDPConn), msg)
+	}
+
+	// stream transports prefix the message with two bytes length
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	if _, err = conn.Write(buf); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeUDP sends the query and waits for its response, the datagrams from other
+// addresses or with other ids are discarded
+func exchangeUDP(conn *net.UDPConn, msg []byte) ([]byte, error) {
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	raddr := conn.RemoteAddr().(*net.UDPAddr).AddrPort()
+	buf := make([]byte, maxUDPMessageLen)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return nil, err
+		}
+		if from.Addr().Unmap() != raddr.Addr().Unmap() || from.Port() != raddr.Port() {
+			continue
+		}
+		if n < 2 || !bytes.Equal(buf[:2], msg[:2]) {
+			continue
+		}
+		return buf[:n], nil
+	}
+}
+
+func (c *Client) exchangeHTTPS(ctx context.Context, srv *server, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: http status %d", ErrServerFailure, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxTCPMessageLen))
+}
+
+func truncated(msg []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	return err == nil && h.Truncated
+}
+
+func parseAnswer(msg []byte, id uint16, qtype dnsmessage.Type) (ips []net.IP, ttl uint32, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, ErrMessageInvalid
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, ErrNoAddress
+	default:
+		return nil, 0, fmt.Errorf("%w: %s", ErrServerFailure, h.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if ah.Type != qtype || ah.Class != dnsmessage.ClassINET {
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		switch qtype {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		}
+		if len(ips) == 1 || ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, ErrNoAddress
+	}
+	return ips, ttl, nil
+}
+
+func dnsName(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
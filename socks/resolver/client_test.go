@@ -0,0 +1,195 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func stubAnswer(t *testing.T, req []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil {
+		t.Error(err)
+		return nil
+	}
+	msg.Header.Response = true
+	q := msg.Questions[0]
+	switch q.Type {
+	case dnsmessage.TypeA:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 30},
+			Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+		})
+	case dnsmessage.TypeAAAA:
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 20},
+			Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}},
+		})
+	}
+	resp, err := msg.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return resp
+}
+
+func serveStubStream(t *testing.T, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var l [2]byte
+			if _, err := io.ReadFull(conn, l[:]); err != nil {
+				return
+			}
+			req := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			resp := stubAnswer(t, req)
+			binary.BigEndian.PutUint16(l[:], uint16(len(resp)))
+			conn.Write(append(l[:], resp...))
+		}()
+	}
+}
+
+func startStubServers(t *testing.T) []string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(stubAnswer(t, buf[:n]), addr)
+		}
+	}()
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcpLn.Close() })
+	go serveStubStream(t, tcpLn)
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(stubAnswer(t, req))
+	}))
+	t.Cleanup(doh.Close)
+
+	tlsLn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tlsLn.Close() })
+	go serveStubStream(t, tlsLn)
+
+	return []string{
+		pc.LocalAddr().String(),
+		"tcp://" + tcpLn.Addr().String(),
+		"tls://" + tlsLn.Addr().String() + "?insecure=true",
+		doh.URL + "/dns-query?insecure=true",
+	}
+}
+
+func TestClientLookupIP(t *testing.T) {
+	for _, server := range startStubServers(t) {
+		c, err := NewClient([]string{server}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips, ttl, err := c.LookupIPTTL(context.Background(), "example.test")
+		if err != nil {
+			t.Fatalf("%s: %v", server, err)
+		}
+		if len(ips) != 2 || ttl != 20*time.Second {
+			t.Fatalf("%s: unexpected answer %v %v", server, ips, ttl)
+		}
+	}
+}
+
+func TestClientFallbackServer(t *testing.T) {
+	servers := startStubServers(t)
+	c, err := NewClient([]string{"tcp://127.0.0.1:1", servers[0]}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.LookupIP(context.Background(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientMismatchedID(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// a response with another id comes first and is discarded
+			resp := stubAnswer(t, buf[:n])
+			spoofed := append([]byte(nil), resp...)
+			spoofed[0] ^= 0xff
+			pc.WriteTo(spoofed, addr)
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	c, err := NewClient([]string{pc.LocalAddr().String()}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips, err := c.LookupIP(context.Background(), "example.test"); err != nil || len(ips) != 2 {
+		t.Fatalf("got %v %v", ips, err)
+	}
+}
+
+type countResolver struct {
+	n int
+}
+
+func (r *countResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	r.n++
+	return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+}
+
+func TestCacheResolver(t *testing.T) {
+	cr := &countResolver{}
+	r := NewCacheResolver(cr, 0, time.Minute)
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupIP(context.Background(), "example.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cr.n != 1 {
+		t.Fatalf("lookup count: %d, want 1", cr.n)
+	}
+	r.Flush()
+	r.LookupIP(context.Background(), "example.test")
+	if cr.n != 2 {
+		t.Fatalf("lookup count: %d, want 2", cr.n)
+	}
+}
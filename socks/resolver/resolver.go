@@ -0,0 +1,57 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrNoAddress      = errors.New("dns: no such host")
+	ErrInvalidServer  = errors.New("dns: invalid server address")
+	ErrServerFailure  = errors.New("dns: server failure")
+	ErrMessageInvalid = errors.New("dns: invalid message")
+)
+
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// TTLResolver is a Resolver which knows how long the addresses can be cached
+type TTLResolver interface {
+	Resolver
+	LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+var Default Resolver = NewSystemResolver()
+
+type systemResolver struct {
+	r *net.Resolver
+}
+
+func NewSystemResolver() Resolver {
+	return &systemResolver{r: net.DefaultResolver}
+}
+
+func (r *systemResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r.r.LookupIP(ctx, "ip", host)
+}
+
+// LookupIP resolves host with the resolver r, an ip literal is returned directly
+func LookupIP(ctx context.Context, r Resolver, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r == nil {
+		r = Default
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, ErrNoAddress
+	}
+	return ips, nil
+}
@@ -0,0 +1,160 @@
+// Package route chooses the outbound of the socks destinations by the rules of the domain
+// names, ip addresses, ports and users. The domain and ip lists, such as the GeoIP lists,
+// can be loaded from the rule set files.
+package route
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the built-in outbounds
+const (
+	Direct = "direct"
+	Reject = "reject"
+)
+
+// Metadata is the destination to route. Host is the lower-case domain name without the
+// trailing dot, and Addr is valid if the destination is an ip address.
+type Metadata struct {
+	User string
+	Host string
+	Addr netip.Addr
+	Port int
+}
+
+// NewMetadata returns the metadata of the target "host:port" requested by the user
+func NewMetadata(user, target string) Metadata {
+	m := Metadata{User: user}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	m.Port, _ = strconv.Atoi(port)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		m.Addr = addr.Unmap()
+	} else {
+		m.Host = normalizeDomain(host)
+	}
+	return m
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// PortRange is the ports in [Min, Max]
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// Rule routes the matched destinations to Outbound. The destination matches if any of the
+// domain matchers, CIDRs or rule sets matches, and then Ports and Users must match too.
+// Empty matchers match any. DomainSuffixes matches the domain itself and its subdomains,
+// and the CIDRs match only the ip destinations, the domain names aren't resolved.
+type Rule struct {
+	Domains        []string
+	DomainSuffixes []string
+	DomainKeywords []string
+	DomainRegexps  []*regexp.Regexp
+	CIDRs          []netip.Prefix
+	RuleSets       []string
+	Ports          []PortRange
+	Users          []string
+	Outbound       string
+}
+
+type rule struct {
+	dest     *destination
+	sets     []*RuleSet
+	ports    []PortRange
+	users    []string
+	outbound string
+}
+
+func (r *rule) match(m *Metadata) bool {
+	if !r.dest.empty() || len(r.sets) > 0 {
+		matched := r.dest.match(m)
+		for i := 0; !matched && i < len(r.sets); i++ {
+			matched = r.sets[i].dest.match(m)
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.ports) > 0 && !matchPort(r.ports, m.Port) {
+		return false
+	}
+	return len(r.users) == 0 || contains(r.users, m.User)
+}
+
+func matchPort(ports []PortRange, port int) bool {
+	for _, p := range ports {
+		if port >= p.Min && port <= p.Max {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Router routes each destination to the outbound of the first matched rule, or to Final
+type Router struct {
+	rules []*rule
+	final string
+}
+
+// NewRouter returns the router of the rules, sets are the rule sets referred by the rules
+func NewRouter(rules []Rule, sets map[string]*RuleSet, final string) (*Router, error) {
+	r := &Router{final: final}
+	for _, x := range rules {
+		dest := newDestination()
+		for _, domain := range x.Domains {
+			dest.addDomain(domain)
+		}
+		for _, suffix := range x.DomainSuffixes {
+			dest.addSuffix(suffix)
+		}
+		for _, keyword := range x.DomainKeywords {
+			dest.addKeyword(keyword)
+		}
+		dest.regexps = append(dest.regexps, x.DomainRegexps...)
+		for _, prefix := range x.CIDRs {
+			dest.addCIDR(prefix)
+		}
+		dest.ranges.build()
+		rl := &rule{dest: dest, ports: x.Ports, users: x.Users, outbound: x.Outbound}
+		for _, name := range x.RuleSets {
+			set, ok := sets[name]
+			if !ok {
+				return nil, fmt.Errorf("route: rule set %s not found", name)
+			}
+			rl.sets = append(rl.sets, set)
+		}
+		r.rules = append(r.rules, rl)
+	}
+	return r, nil
+}
+
+// Route returns the outbound of the destination
+func (r *Router) Route(m Metadata) string {
+	for _, rl := range r.rules {
+		if rl.match(&m) {
+			return rl.outbound
+		}
+	}
+	return r.final
+}
@@ -0,0 +1,70 @@
+package route
+
+import (
+	"net/netip"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const geoip = `
+# a GeoIP list
+1.0.1.0/24
+1.0.2.0/23
+1.0.2.128/25
+2001:250::/30
+cidr:::ffff:203.0.113.0/120
+domain:cn.example
+domain_keyword:baidu
+`
+
+func TestRouter(t *testing.T) {
+	set, err := ParseRuleSet(strings.NewReader(geoip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter([]Rule{
+		{DomainSuffixes: []string{"*.corp.example"}, Outbound: "corp"},
+		{CIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Outbound: Reject},
+		{RuleSets: []string{"cn"}, Outbound: Direct},
+		{DomainRegexps: []*regexp.Regexp{regexp.MustCompile(`^api\d+\.`)}, Ports: []PortRange{{443, 443}}, Outbound: "api"},
+		{Ports: []PortRange{{25, 25}}, Outbound: Reject},
+		{Users: []string{"alice"}, Outbound: "alice"},
+	}, map[string]*RuleSet{"cn": set}, "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		user, target, want string
+	}{
+		{"", "corp.example:80", "corp"},
+		{"", "WWW.Corp.Example.:80", "corp"},
+		{"", "notcorp.example:80", "proxy"},
+		{"", "10.1.2.3:80", Reject},
+		{"", "[::ffff:10.1.2.3]:80", Reject},
+		{"", "1.0.1.255:80", Direct},
+		{"", "1.0.3.255:80", Direct},
+		{"", "1.0.4.0:80", "proxy"},
+		{"", "[2001:251::1]:80", Direct},
+		{"", "[2001:254::1]:80", "proxy"},
+		{"", "203.0.113.9:80", Direct},
+		{"", "cn.example:80", Direct},
+		{"", "www.cn.example:80", "proxy"},
+		{"", "www.baidu.com:80", Direct},
+		{"", "api1.example.com:443", "api"},
+		{"", "api1.example.com:80", "proxy"},
+		{"alice", "smtp.example.com:25", Reject},
+		{"alice", "example.com:80", "alice"},
+	} {
+		if got := router.Route(NewMetadata(tc.user, tc.target)); got != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.user, tc.target, got, tc.want)
+		}
+	}
+
+	if _, err = NewRouter([]Rule{{RuleSets: []string{"unknown"}}}, nil, ""); err == nil {
+		t.Fatal("unknown rule set")
+	}
+	if _, err = ParseRuleSet(strings.NewReader("full:example.com")); err == nil {
+		t.Fatal("unknown entry type")
+	}
+}
@@ -0,0 +1,238 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// destination matches the domain names and the ip addresses, it's built for the large
+// lists, the suffixes are looked up by the labels and the CIDRs by a binary search
+type destination struct {
+	domains  map[string]struct{}
+	suffixes map[string]struct{}
+	keywords []string
+	regexps  []*regexp.Regexp
+	ranges   ipRanges
+}
+
+func newDestination() *destination {
+	return &destination{domains: make(map[string]struct{}), suffixes: make(map[string]struct{})}
+}
+
+func (d *destination) empty() bool {
+	return len(d.domains) == 0 && len(d.suffixes) == 0 && len(d.keywords) == 0 &&
+		len(d.regexps) == 0 && len(d.ranges) == 0
+}
+
+func (d *destination) addDomain(domain string) {
+	d.domains[normalizeDomain(domain)] = struct{}{}
+}
+
+func (d *destination) addSuffix(suffix string) {
+	suffix = strings.TrimPrefix(strings.TrimPrefix(suffix, "*"), ".")
+	d.suffixes[normalizeDomain(suffix)] = struct{}{}
+}
+
+func (d *destination) addKeyword(keyword string) {
+	d.keywords = append(d.keywords, strings.ToLower(keyword))
+}
+
+func (d *destination) addCIDR(prefix netip.Prefix) {
+	d.ranges = append(d.ranges, newIPRange(prefix))
+}
+
+func (d *destination) match(m *Metadata) bool {
+	if m.Addr.IsValid() {
+		return d.ranges.contains(m.Addr)
+	}
+	if m.Host == "" {
+		return false
+	}
+	if _, ok := d.domains[m.Host]; ok {
+		return true
+	}
+	if len(d.suffixes) > 0 {
+		for host := m.Host; ; {
+			if _, ok := d.suffixes[host]; ok {
+				return true
+			}
+			i := strings.IndexByte(host, '.')
+			if i < 0 {
+				break
+			}
+			host = host[i+1:]
+		}
+	}
+	for _, keyword := range d.keywords {
+		if strings.Contains(m.Host, keyword) {
+			return true
+		}
+	}
+	for _, re := range d.regexps {
+		if re.MatchString(m.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+type ipRange struct {
+	from netip.Addr
+	to   netip.Addr
+}
+
+func newIPRange(prefix netip.Prefix) ipRange {
+	prefix = prefix.Masked()
+	from := prefix.Addr()
+	b := from.As16()
+	bits := prefix.Bits()
+	if from.Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	to := netip.AddrFrom16(b)
+	if from.Is4() {
+		to = to.Unmap()
+	}
+	return ipRange{from: from, to: to}
+}
+
+// ipRanges is sorted and merged by build
+type ipRanges []ipRange
+
+func (r *ipRanges) build() {
+	list := *r
+	if len(list) == 0 {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].from.Less(list[j].from) })
+	merged := list[:1]
+	for _, x := range list[1:] {
+		last := &merged[len(merged)-1]
+		// the ipv4 and ipv6 ranges are never merged, Less orders ipv4 first
+		if last.to.BitLen() == x.from.BitLen() && !last.to.Less(x.from) {
+			if last.to.Less(x.to) {
+				last.to = x.to
+			}
+			continue
+		}
+		merged = append(merged, x)
+	}
+	*r = merged
+}
+
+func (r ipRanges) contains(addr netip.Addr) bool {
+	i := sort.Search(len(r), func(i int) bool { return addr.Less(r[i].from) })
+	if i == 0 {
+		return false
+	}
+	x := r[i-1]
+	return x.from.BitLen() == addr.BitLen() && !x.to.Less(addr)
+}
+
+// RuleSet is a list of the domain names and the ip addresses, which matches if any entry
+// matches. It's shared by the rules referring to it by name.
+type RuleSet struct {
+	dest *destination
+}
+
+// LoadRuleSet loads the rule set file, see ParseRuleSet
+func LoadRuleSet(path string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	set, err := ParseRuleSet(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return set, nil
+}
+
+var entryKinds = map[string]bool{
+	"domain":         true,
+	"domain_suffix":  true,
+	"domain_keyword": true,
+	"domain_regex":   true,
+	"cidr":           true,
+}
+
+// ParseRuleSet parses one entry per line, such as a GeoIP list of CIDRs. An entry is
+// "domain:", "domain_suffix:", "domain_keyword:", "domain_regex:" or "cidr:" followed by
+// the value, or a CIDR, an ip address or a domain suffix without the prefix. Empty lines
+// and the lines starting with # are skipped.
+func ParseRuleSet(r io.Reader) (*RuleSet, error) {
+	dest := newDestination()
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || entry[0] == '#' {
+			continue
+		}
+		kind, value, found := strings.Cut(entry, ":")
+		if !found || !entryKinds[kind] {
+			kind, value = "", entry
+		}
+		value = strings.TrimSpace(value)
+		var err error
+		switch kind {
+		case "domain":
+			dest.addDomain(value)
+		case "domain_suffix":
+			dest.addSuffix(value)
+		case "domain_keyword":
+			dest.addKeyword(value)
+		case "domain_regex":
+			var re *regexp.Regexp
+			if re, err = regexp.Compile(value); err == nil {
+				dest.regexps = append(dest.regexps, re)
+			}
+		case "cidr":
+			var prefix netip.Prefix
+			if prefix, err = ParsePrefix(value); err == nil {
+				dest.addCIDR(prefix)
+			}
+		default:
+			var prefix netip.Prefix
+			if prefix, err = ParsePrefix(value); err == nil {
+				dest.addCIDR(prefix)
+			} else if !strings.ContainsAny(value, ":/") {
+				err = nil
+				dest.addSuffix(value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	dest.ranges.build()
+	return &RuleSet{dest: dest}, nil
+}
+
+// ParsePrefix parses a CIDR or an ip address, which is a single host prefix
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+		}
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR: %s", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -5,6 +5,7 @@ import (
 	"strconv"
 
 	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/packet"
 )
 
 type Conn interface {
@@ -50,20 +51,11 @@ func ParseAddress(addr string) Address {
 	return buf
 }
 
+// String returns host:port of the address, or empty if the address is malformed
 func (a Address) String() string {
-	var host, port string
-
-	switch a[0] {
-	case constant.DomainName:
-		host = string(a[2 : 2+int(a[1])])
-		port = strconv.Itoa((int(a[2+int(a[1])]) << 8) | int(a[2+int(a[1])+1]))
-	case constant.IPv4:
-		host = net.IP(a[1 : 1+net.IPv4len]).String()
-		port = strconv.Itoa((int(a[1+net.IPv4len]) << 8) | int(a[1+net.IPv4len+1]))
-	case constant.IPv6:
-		host = net.IP(a[1 : 1+net.IPv6len]).String()
-		port = strconv.Itoa((int(a[1+net.IPv6len]) << 8) | int(a[1+net.IPv6len+1]))
+	addr, _, err := packet.ReadAddr(a)
+	if err != nil {
+		return ""
 	}
-
-	return net.JoinHostPort(host, port)
+	return addr.String()
 }
@@ -0,0 +1,23 @@
+package sc
+
+import (
+	"testing"
+
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+func FuzzAddress(f *testing.F) {
+	for _, seed := range []string{"127.0.0.1:80", "[2001:db8::1]:443", "example.com:8080"} {
+		f.Add([]byte(ParseAddress(seed)))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := Address(data).String()
+		// the domain names such as "a]b" can't be parsed from host:port
+		if s == "" || data[0] == constant.DomainName {
+			return
+		}
+		if got := ParseAddress(s).String(); got != s {
+			t.Fatalf("%x: got %q, want %q", data, got, s)
+		}
+	})
+}
@@ -2,86 +2,118 @@ package sc
 
 import (
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 
-	"github.com/josexy/gsocks5/socks/constant"
 	"github.com/josexy/gsocks5/socks/packet"
 )
 
+// PacketConn is the outbound connection of a nat entry, such as *net.UDPConn or the udp flow
+// through an upstream server. ReadFrom returns the origin of the packet.
+type PacketConn interface {
+	net.Conn
+	ReadFrom(b []byte) (int, net.Addr, error)
+}
+
+// PacketWriter writes the replies to the clients, such as *net.UDPConn or the batch writer
+// of the udp server
+type PacketWriter interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+// NATKey is a flow of a client to a destination, Domain is set instead of Dst when the
+// destination is a domain name
+type NATKey struct {
+	Src    netip.AddrPort
+	Dst    netip.AddrPort
+	Domain string
+}
+
+// NewNATKey returns the key of the flow of src to dst, only the domain name is allocated
+func NewNATKey(src netip.AddrPort, dst packet.Addr) NATKey {
+	if dst.IsDomain() {
+		return NATKey{Src: src, Dst: netip.AddrPortFrom(netip.Addr{}, dst.Port), Domain: string(dst.Domain)}
+	}
+	return NATKey{Src: src, Dst: dst.AddrPort()}
+}
+
 type UdpNATMap struct {
 	sync.RWMutex
-	m       map[string]*net.UDPConn
+	m       map[NATKey]PacketConn
 	timeout time.Duration
 }
 
 func NewUdpNATMap(timeout time.Duration) *UdpNATMap {
 	return &UdpNATMap{
-		m:       make(map[string]*net.UDPConn),
+		m:       make(map[NATKey]PacketConn),
 		timeout: timeout,
 	}
 }
 
-func (m *UdpNATMap) Get(srcAddr string) *net.UDPConn {
+func (m *UdpNATMap) Get(key NATKey) PacketConn {
 	m.RLock()
 	defer m.RUnlock()
-	return m.m[srcAddr]
+	return m.m[key]
 }
 
-func (m *UdpNATMap) Set(srcAddr string, targetConn *net.UDPConn) {
+func (m *UdpNATMap) Set(key NATKey, targetConn PacketConn) {
 	m.Lock()
 	defer m.Unlock()
 
-	m.m[srcAddr] = targetConn
+	m.m[key] = targetConn
 }
 
-func (m *UdpNATMap) Del(srcAddr string) *net.UDPConn {
+func (m *UdpNATMap) Del(key NATKey) PacketConn {
 	m.Lock()
 	defer m.Unlock()
-	if pc, ok := m.m[srcAddr]; ok {
-		delete(m.m, srcAddr)
+	if pc, ok := m.m[key]; ok {
+		delete(m.m, key)
 		return pc
 	}
 	return nil
 }
 
-func (m *UdpNATMap) Add(srcAddr net.Addr, dst, src *net.UDPConn) {
-	m.Set(srcAddr.String(), src)
+func (m *UdpNATMap) Close() {
+	m.Lock()
+	defer m.Unlock()
+	for key, conn := range m.m {
+		conn.Close()
+		delete(m.m, key)
+	}
+}
+
+// Add sets the flow of key and sends the packets from src back to srcAddr until the flow is idle
+func (m *UdpNATMap) Add(key NATKey, srcAddr *net.UDPAddr, dst PacketWriter, src PacketConn) {
+	m.Set(key, src)
 
 	go func() {
 		// srcAddr <- dst <- src
 		m.forward(srcAddr, dst, src)
-		if conn := m.Del(srcAddr.String()); conn != nil {
+		if conn := m.Del(key); conn != nil {
 			conn.Close()
 		}
 	}()
 }
 
-func (m *UdpNATMap) forward(srcAddr net.Addr, dst *net.UDPConn, src *net.UDPConn) error {
-	bufferRead := packet.GetBuffer(true)
-	bufferWrite := packet.GetBuffer(true)
-	defer packet.ReleaseBuffer(bufferRead, true)
-	defer packet.ReleaseBuffer(bufferWrite, true)
+func (m *UdpNATMap) forward(srcAddr *net.UDPAddr, dst PacketWriter, src PacketConn) error {
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
 
 	for {
 		src.SetReadDeadline(time.Now().Add(m.timeout))
-		n, targetAddr, err := src.ReadFromUDP(*bufferRead)
+		n, addr, err := src.ReadFrom((*buffer)[packet.MaxIPUDPHeaderLen:])
 		if err != nil {
 			return err
 		}
-
-		var atype constant.Socks5AddressType
-		if targetAddr.IP.Equal(targetAddr.IP.To4()) {
-			atype = constant.IPv4
-		} else {
-			atype = constant.IPv6
+		targetAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		b, err := packet.PackUDPPayload(*buffer, n, packet.AddrFromAddrPort(targetAddr.AddrPort()))
+		if err != nil {
+			continue
 		}
-		sz, _ := packet.SerializeDirectTo(*bufferWrite, &packet.SocksUDPPacket{
-			AType:   atype,
-			DstAddr: targetAddr.IP.String(),
-			DstPort: targetAddr.Port,
-			UDPData: (*bufferRead)[:n],
-		})
-		dst.WriteTo((*bufferWrite)[:sz], srcAddr)
+		dst.WriteToUDP(b, srcAddr)
 	}
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/admin"
+	"github.com/josexy/gsocks5/socks/auth"
+	"github.com/josexy/gsocks5/socks/user"
+	"github.com/josexy/gsocks5/util"
+)
+
+// newAdmin creates the admin api server, which serves the ban list of the authentication
+// guards and the users of the user store
+func (s *Socks5Server) newAdmin() *admin.Server {
+	cfg := config.Cfg.Admin
+	if cfg.Addr == "" {
+		return nil
+	}
+	a := admin.NewServer(cfg.Addr, cfg.Token, handshakeTimeout())
+	a.CertFile, a.KeyFile = cfg.Cert, cfg.Key
+	s.handleAdmin(a)
+	return a
+}
+
+func (s *Socks5Server) handleAdmin(a *admin.Server) {
+	a.Handle("/bans", http.HandlerFunc(s.serveBans))
+	if s.users != nil {
+		a.Handle("/users", user.Handler(s.users.Store))
+	}
+}
+
+// banList is the response of GET /bans
+type banList struct {
+	IPs   []auth.Ban `json:"ips"`
+	Users []auth.Ban `json:"users"`
+}
+
+// serveBans serves the ban list of the authentication guards
+//
+//	GET    /bans        the banned client ips and usernames
+//	DELETE /bans/{key}  removes the ban of the client ip or the username
+func (s *Socks5Server) serveBans(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "bans" {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		ips, users := s.Bans()
+		list := banList{IPs: []auth.Ban{}, Users: []auth.Ban{}}
+		list.IPs = append(list.IPs, ips...)
+		list.Users = append(list.Users, users...)
+		admin.WriteJSON(w, http.StatusOK, list)
+		return
+	}
+	key, ok := strings.CutPrefix(path, "bans/")
+	if !ok || key == "" {
+		admin.WriteError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if r.Method != http.MethodDelete {
+		admin.WriteError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	s.Unban(key)
+	util.Logger.Infof("[auth] %s unbanned", key)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/josexy/gsocks5/socks/admin"
+	"github.com/josexy/gsocks5/socks/auth"
+)
+
+func TestAdminBans(t *testing.T) {
+	s := &Socks5Server{
+		ipGuard:   auth.NewGuard(1, time.Minute, time.Hour),
+		userGuard: auth.NewGuard(1, time.Minute, time.Hour),
+	}
+	s.authFailed("192.0.2.1", "alice")
+	a := admin.NewServer("", "secret", 0)
+	s.handleAdmin(a)
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	do := func(method, path, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	bans := func() (list banList) {
+		t.Helper()
+		resp := do(http.MethodGet, "/bans", "secret")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("bans: %s", resp.Status)
+		}
+		json.NewDecoder(resp.Body).Decode(&list)
+		return
+	}
+
+	if resp := do(http.MethodGet, "/bans", "bad"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad token: %s", resp.Status)
+	}
+	if list := bans(); len(list.IPs) != 1 || list.IPs[0].Key != "192.0.2.1" ||
+		len(list.Users) != 1 || list.Users[0].Key != "alice" || list.Users[0].Lockouts != 1 {
+		t.Fatalf("bans: %+v", list)
+	}
+
+	for _, key := range []string{"192.0.2.1", "alice"} {
+		if resp := do(http.MethodDelete, "/bans/"+key, "secret"); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("unban %s: %s", key, resp.Status)
+		}
+	}
+	if list := bans(); len(list.IPs) != 0 || len(list.Users) != 0 {
+		t.Fatalf("unbanned: %+v", list)
+	}
+	if s.ipGuard.Banned("192.0.2.1") || s.userGuard.Banned("alice") {
+		t.Fatal("still banned")
+	}
+}
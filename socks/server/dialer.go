@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/connection"
+	"github.com/josexy/gsocks5/socks/resolver"
+	"github.com/josexy/gsocks5/util"
+)
+
+func newDialer() *connection.Dialer {
+	cfg := config.Cfg.DNS
+	r := resolver.Default
+	if len(cfg.Servers) > 0 {
+		if client, err := resolver.NewClient(cfg.Servers, cfg.Timeout); err != nil {
+			util.Logger.ErrorBy(err)
+		} else {
+			r = client
+		}
+	}
+	if !cfg.DisableCache {
+		r = resolver.NewCacheResolver(r, cfg.CacheMinTTL, cfg.CacheMaxTTL)
+	}
+	return &connection.Dialer{
+		Timeout:      config.Cfg.Timeout.Dial,
+		AttemptDelay: cfg.AttemptDelay,
+		Prefer:       cfg.Prefer,
+		Resolver:     r,
+	}
+}
+
+func (s *Socks5Server) bindDialer(bind config.OutboundBind) *connection.Dialer {
+	d := *s.dialer
+	d.BindAddr, d.Interface, d.Mark = bind.BindAddr, bind.Interface, bind.Mark
+	return &d
+}
+
+// matchOutbound returns the binding of the first outbound rule matching the user and the
+// target, or the default outbound binding
+func matchOutbound(user, target string) config.OutboundBind {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	ip := net.ParseIP(host)
+	for _, rule := range config.Cfg.Outbound.Rules {
+		if matchUser(rule.Users, user) && matchDest(rule, host, ip) {
+			return rule.OutboundBind
+		}
+	}
+	return config.Cfg.Outbound.OutboundBind
+}
+
+func matchUser(users []string, user string) bool {
+	if len(users) == 0 {
+		return true
+	}
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDest(rule config.OutboundRule, host string, ip net.IP) bool {
+	if len(rule.Domains) == 0 && len(rule.CIDRs) == 0 {
+		return true
+	}
+	if ip != nil {
+		for _, ipNet := range rule.CIDRs {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range rule.Domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
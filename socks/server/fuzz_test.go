@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/auth"
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+var fuzzConfigOnce sync.Once
+
+// FuzzServeTCP feeds the arbitrary bytes sent by a client to the server, which must not
+// panic or hang. The outbound connections are bound to the loopback address and fail
+// quickly, so the fuzzing doesn't reach the network.
+func FuzzServeTCP(f *testing.F) {
+	// the config is read by the sessions, it's set once for all the runs of -count
+	fuzzConfigOnce.Do(func() {
+		config.Cfg.SocksMethod = []constant.Socks5Method{constant.MethodUsernamePassword}
+		config.Cfg.Auth = []auth.Socks5Auth{auth.NewSocksAuth("test", "12345678")}
+		config.Cfg.AuthGuard.Disable = true
+		config.Cfg.Mux.Enable = true
+		config.Cfg.Timeout.Handshake = 100 * time.Millisecond
+		config.Cfg.Timeout.Dial = 100 * time.Millisecond
+		config.Cfg.Outbound.BindAddr = net.IPv4(127, 0, 0, 1)
+	})
+	srv := NewSocks5Server("")
+	f.Cleanup(func() { srv.Close() })
+
+	// each message of the handshake is a separate input, and written separately
+	auth := "\x01\x04test\x0812345678"
+	for _, seed := range [][4]string{
+		{"\x05\x01\x00", "", "", ""},
+		{"\x05\x01\x02", "\x01\x04test\x03bad", "", ""},
+		{"\x05\x01\x02", auth, "\x05\x01\x00\x01\x7f\x00\x00\x01\x00\x01", "data"},
+		{"\x05\x01\x02", auth, "\x05\x01\x00\x03\x09localhost\x00\x01", "data"},
+		{"\x05\x01\x02", auth, "\x05\x03\x00\x01\x00\x00\x00\x00\x00\x00", ""},
+		{"\x05\x01\x02", auth, "\x05\x02\x00\x01\x00\x00\x00\x00\x00\x00", ""},
+		{"\x05\x01\x02", auth, "\x05\x01\x00\x04" + strings.Repeat("\x00", 15) + "\x01\x00\x01", ""},
+		// a mux stream with a connect request
+		{"\x05\x01\x88", auth, "\x01\x00\x00\x05\x00\x00\x00\x01\x00\x00\x04\x00\x00" +
+			"\x01\x01\x00\x0a\x00\x00\x00\x01\x05\x01\x00\x01\x7f\x00\x00\x01\x00\x01", ""},
+		// a mux datagram stream with a udp request
+		{"\x05\x01\x88", auth, "\x01\x00\x00\x05\x00\x00\x00\x01\x01\x00\x04\x00\x00" +
+			"\x01\x01\x00\x0a\x00\x00\x00\x01\x05\x03\x00\x01\x00\x00\x00\x00\x00\x00",
+			"\x01\x01\x00\x0e\x00\x00\x00\x01\x00\x00\x00\x01\x7f\x00\x00\x01\x00\x01data"},
+	} {
+		f.Add([]byte(seed[0]), []byte(seed[1]), []byte(seed[2]), []byte(seed[3]))
+	}
+	f.Fuzz(func(t *testing.T, negotiate, auth, request, payload []byte) {
+		client, conn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			srv.ServeTCP(context.Background(), conn)
+			conn.Close()
+		}()
+		go io.Copy(io.Discard, client)
+		go func() {
+			for _, msg := range [][]byte{negotiate, auth, request, payload} {
+				if len(msg) > 0 {
+					if _, err := client.Write(msg); err != nil {
+						break
+					}
+				}
+			}
+			client.Close()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ServeTCP hangs on %q %q %q %q", negotiate, auth, request, payload)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/auth"
+	"github.com/josexy/gsocks5/util"
+)
+
+const (
+	defaultMaxAuthFailures = 5
+	defaultBanTime         = time.Minute
+	defaultMaxBanTime      = time.Hour
+)
+
+func newAuthGuard() *auth.Guard {
+	cfg := config.Cfg.AuthGuard
+	if cfg.Disable {
+		return nil
+	}
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = defaultMaxAuthFailures
+	}
+	if cfg.BanTime <= 0 {
+		cfg.BanTime = defaultBanTime
+	}
+	if cfg.MaxBanTime <= 0 {
+		cfg.MaxBanTime = defaultMaxBanTime
+	}
+	return auth.NewGuard(cfg.MaxFailures, cfg.BanTime, cfg.MaxBanTime)
+}
+
+// remoteIP returns the client ip of the connection, which is empty for the unix domain socket
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// authFailed records the authentication failure of the client ip and the username
+func (s *Socks5Server) authFailed(ip, username string) {
+	if d, locked := s.ipGuard.Fail(ip); locked {
+		util.Logger.Warnf("[auth] client %s locked out for %s", color.RedString(ip), d)
+	}
+	if d, locked := s.userGuard.Fail(username); locked {
+		util.Logger.Warnf("[auth] user %s locked out for %s", color.RedString(username), d)
+	}
+}
+
+// Bans returns the banned client ips and usernames
+func (s *Socks5Server) Bans() (ips, users []auth.Ban) {
+	return s.ipGuard.Bans(), s.userGuard.Bans()
+}
+
+// Unban removes the ban of the client ip or the username
+func (s *Socks5Server) Unban(key string) {
+	s.ipGuard.Unban(key)
+	s.userGuard.Unban(key)
+}
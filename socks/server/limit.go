@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/packet"
+	"github.com/josexy/gsocks5/tcpserver"
+)
+
+// userLimiter counts the sessions of each authenticated user
+type userLimiter struct {
+	mu    sync.Mutex
+	max   int
+	count map[string]int
+}
+
+func newUserLimiter(max int) *userLimiter {
+	return &userLimiter{max: max, count: make(map[string]int)}
+}
+
+func (l *userLimiter) acquire(user string) bool {
+	if l.max <= 0 || user == "" {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count[user] >= l.max {
+		return false
+	}
+	l.count[user]++
+	return true
+}
+
+func (l *userLimiter) release(user string) {
+	if l.max <= 0 || user == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count[user]--; l.count[user] <= 0 {
+		delete(l.count, user)
+	}
+}
+
+// serverOptions returns the options of the tcp servers from the limit config, the
+// connection limiter is shared by all listeners
+func (s *Socks5Server) serverOptions() (opts []tcpserver.ServerOption) {
+	cfg := config.Cfg.Limit
+	if cfg.MaxConns > 0 || cfg.MaxConnsPerIP > 0 {
+		if s.connLimiter == nil {
+			s.connLimiter = tcpserver.NewConnLimiter(cfg.MaxConns, cfg.MaxConnsPerIP, cfg.Queue)
+		}
+		opts = append(opts,
+			tcpserver.WithConnLimiter(s.connLimiter),
+			tcpserver.WithRejectedHandler(s.rejectTCP),
+		)
+	}
+	if cfg.AcceptRate > 0 {
+		opts = append(opts, tcpserver.WithRateLimiter(tcpserver.NewRateLimiter(cfg.AcceptRate, cfg.AcceptBurst)))
+	}
+	return
+}
+
+// rejectTCP replies GeneralSocksServerFailure to the request of the connection rejected by
+// the limits. The client which doesn't offer MethodNoAuthRequired gets MethodNotAcceptable.
+func (s *Socks5Server) rejectTCP(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout()))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	res, err := packet.SerializeFrom[*packet.SocksNegotiateRequest](rw)
+	if err != nil {
+		return
+	}
+	var method constant.Socks5Method = constant.MethodNotAcceptable
+	if hasMethod(res.Methods, constant.MethodNoAuthRequired) {
+		method = constant.MethodNoAuthRequired
+	}
+	res.Release()
+	packet.SerializeTo(rw, &packet.SocksNegotiateResponse{Method: method})
+	if method == constant.MethodNoAuthRequired {
+		rejectRequest(rw)
+	}
+}
+
+func rejectRequest(rw *bufio.ReadWriter) {
+	if res, err := packet.SerializeFrom[*packet.SocksRequest](rw); err == nil {
+		res.Release()
+	}
+	packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.GeneralSocksServerFailure})
+}
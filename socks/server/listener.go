@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/proxyproto"
+	"github.com/josexy/gsocks5/socks/auth"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/tcpserver"
+	"github.com/josexy/gsocks5/transport"
+	"github.com/josexy/gsocks5/udpserver"
+	"github.com/josexy/gsocks5/util"
+)
+
+var listenerContextKey = &contextKey{name: "socks-listener"}
+
+type contextKey struct {
+	name string
+}
+
+func (ck *contextKey) String() string {
+	return ck.name
+}
+
+type listener struct {
+	config.ListenerConfig
+	server    *tcpserver.TcpServer
+	udpServer *udpserver.UdpServer
+}
+
+func (s *Socks5Server) newListener(lc config.ListenerConfig) *listener {
+	if lc.Network == "" {
+		lc.Network = "tcp"
+	}
+	if lc.Mode == "" {
+		lc.Mode = config.ModeSocks
+	}
+	l := &listener{ListenerConfig: lc}
+	opts := s.serverOptions()
+	if trusted := l.proxyProtocol(); len(trusted) > 0 {
+		opts = append(opts, tcpserver.WithProxyProtocol(&proxyproto.Policy{
+			Trusted: trusted,
+			Timeout: handshakeTimeout(),
+		}))
+	}
+	if t := l.transport(); t != nil && lc.Mode == config.ModeSocks {
+		opts = append(opts, tcpserver.WithConnWrapper(t.Wrap))
+	}
+	l.server = tcpserver.NewTcpServer(lc.Addr, s, opts...)
+	l.server.Network = lc.Network
+	l.server.BaseContext = context.WithValue(context.Background(), listenerContextKey, l)
+	if lc.Mode != config.ModeSocks {
+		s.newTransparentListener(l)
+		return l
+	}
+
+	if s.udpServer != nil || s.udpPorts != nil {
+		return l
+	}
+	switch lc.Network {
+	case "tcp", "tcp4", "tcp6":
+		// the udp relay shares the address of the tcp listener
+		l.udpServer, _ = udpserver.NewUdpServer(lc.Addr, s)
+	}
+	return l
+}
+
+func listenerFromContext(ctx context.Context) *listener {
+	l, _ := ctx.Value(listenerContextKey).(*listener)
+	return l
+}
+
+func (l *listener) socksMethod() []constant.Socks5Method {
+	if l == nil || len(l.SocksMethod) == 0 {
+		return config.Cfg.SocksMethod
+	}
+	return l.SocksMethod
+}
+
+func (l *listener) auth() []auth.Socks5Auth {
+	if l == nil || len(l.Auth) == 0 {
+		return config.Cfg.Auth
+	}
+	return l.Auth
+}
+
+func (l *listener) proxyProtocol() []*net.IPNet {
+	if l == nil || len(l.ProxyProtocol) == 0 {
+		return config.Cfg.ProxyProtocol
+	}
+	return l.ProxyProtocol
+}
+
+func (l *listener) transport() transport.Transport {
+	if l == nil || l.Transport == nil {
+		return config.Cfg.Transport
+	}
+	return l.Transport
+}
+
+// newUdpRelay creates the shared udp relay or the port allocator from the udp config
+func (s *Socks5Server) newUdpRelay() {
+	cfg := config.Cfg.UDP
+	if cfg.BindAddr == "" && cfg.PortMin == 0 {
+		return
+	}
+	if cfg.PortMin != 0 {
+		host := cfg.BindAddr
+		if h, _, err := net.SplitHostPort(cfg.BindAddr); err == nil {
+			host = h
+		}
+		s.udpPorts = newUdpPortAllocator(host, cfg.PortMin, cfg.PortMax)
+		return
+	}
+	addr := cfg.BindAddr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	var err error
+	if s.udpServer, err = udpserver.NewUdpServer(addr, s); err != nil {
+		util.Logger.ErrorBy(err)
+	}
+}
+
+// udpRelay returns the shared udp relay, the udp relay of the listener, or the first
+// available relay for listeners which can't carry udp traffic, such as unix domain sockets.
+func (s *Socks5Server) udpRelay(l *listener) *udpserver.UdpServer {
+	if s.udpServer != nil {
+		return s.udpServer
+	}
+	if l != nil && l.udpServer != nil && l.Mode == config.ModeSocks {
+		return l.udpServer
+	}
+	for _, l := range s.listeners {
+		if l.udpServer != nil && l.Mode == config.ModeSocks {
+			return l.udpServer
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/mux"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/packet"
+	"github.com/josexy/gsocks5/socks/relay"
+	"github.com/josexy/gsocks5/socks/sc"
+	"github.com/josexy/gsocks5/util"
+)
+
+const (
+	muxUDPTimeout = time.Minute
+	// maxMuxUDPFlows is the max number of the destinations of a datagram stream, the
+	// packets to new destinations over it are dropped
+	maxMuxUDPFlows = 256
+)
+
+// bufferedConn reads the data buffered during the handshake first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func muxConfig() *mux.Config {
+	return &mux.Config{
+		MaxStreams:   config.Cfg.Mux.MaxStreams,
+		StreamWindow: config.Cfg.Mux.StreamWindow,
+	}
+}
+
+// handleMuxAuth runs the username/password sub-negotiation of the mux method, the
+// credentials are checked if the listener prefers the username/password authentication
+func (s *Socks5Server) handleMuxAuth(rw *bufio.ReadWriter, l *listener, ip string) (string, error) {
+	if methods := l.socksMethod(); len(methods) > 0 && methods[0] == constant.MethodUsernamePassword {
+		return s.handleAuth(rw, l.auth(), ip)
+	}
+	res, err := packet.SerializeFrom[*packet.SocksAuthRequest](rw)
+	if err != nil {
+		return "", err
+	}
+	res.Release()
+	packet.SerializeTo(rw, &packet.SocksAuthResponse{})
+	return "", nil
+}
+
+// serveMux serves the streams of the mux connection, each stream carries a socks request
+// and is served as a session of the authenticated user. It returns after the streams.
+func (s *Socks5Server) serveMux(ctx context.Context, sess *session, rw *bufio.ReadWriter) error {
+	sess.conn.SetDeadline(time.Time{})
+	ms := mux.Server(&bufferedConn{Conn: sess.conn, r: rw.Reader}, muxConfig())
+	var wg sync.WaitGroup
+	// the streams end once the session is closed
+	defer wg.Wait()
+	defer ms.Close()
+	util.Logger.Infof("[mux] %s connected", color.GreenString(sess.conn.RemoteAddr().String()))
+	go func() {
+		select {
+		case <-ctx.Done():
+			ms.Close()
+		case <-ms.CloseChan():
+		}
+	}()
+	for {
+		st, err := ms.Accept()
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return relay.ErrSessionExpired
+			}
+			return nil
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveMuxStream(ctx, sess.user, st)
+		}()
+	}
+}
+
+func (s *Socks5Server) serveMuxStream(ctx context.Context, user string, st *mux.Stream) {
+	defer st.Close()
+	sess := &session{conn: st, user: user, start: time.Now()}
+	ctx = context.WithValue(ctx, sessionContextKey, sess)
+	sess.close(s.handleMuxStream(ctx, sess, st))
+}
+
+func (s *Socks5Server) handleMuxStream(ctx context.Context, sess *session, st *mux.Stream) error {
+	st.SetDeadline(time.Now().Add(handshakeTimeout()))
+	rw := bufio.NewReadWriter(bufio.NewReader(st), bufio.NewWriter(st))
+	if !s.userSessions.acquire(sess.user) {
+		rejectRequest(rw)
+		return constant.ErrLimitExceeded
+	}
+	defer s.userSessions.release(sess.user)
+	return s.handleRequest(ctx, rw, st)
+}
+
+// handleMuxUDP relays the udp packets carried by the datagram stream. Each message is
+// a socks udp packet, and the destinations are dialed on demand.
+func (s *Socks5Server) handleMuxUDP(ctx context.Context, rw *bufio.ReadWriter, target string, st *mux.Stream) error {
+	user := UserFromContext(ctx)
+	if !s.userUDP.acquire(user) {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.GeneralSocksServerFailure})
+		return constant.ErrLimitExceeded
+	}
+	defer s.userUDP.release(user)
+
+	util.Logger.Infof("[udp] mux: [%s] <-> remote: [%s]",
+		color.GreenString(st.RemoteAddr().String()),
+		color.YellowString(target))
+	packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.Succeed})
+
+	var mu sync.Mutex
+	flows := make(map[sc.NATKey]sc.PacketConn)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for dest, conn := range flows {
+			conn.Close()
+			delete(flows, dest)
+		}
+	}()
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		st.SetReadDeadline(deadline)
+	}
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
+	for {
+		n, err := st.Read(*buffer)
+		if err != nil {
+			switch {
+			case err == io.EOF || err == mux.ErrSessionClosed:
+				return nil
+			case hasDeadline && errors.Is(err, os.ErrDeadlineExceeded):
+				return relay.ErrSessionExpired
+			}
+			return err
+		}
+		dest, payload, err := packet.ReadUDPPacket((*buffer)[:n])
+		if err != nil {
+			continue
+		}
+		key := sc.NewNATKey(netip.AddrPort{}, dest)
+		mu.Lock()
+		conn, full := flows[key], len(flows) >= maxMuxUDPFlows
+		mu.Unlock()
+		if conn == nil {
+			if full {
+				continue
+			}
+			if conn, err = s.dialUDP(ctx, dest.String()); err != nil {
+				util.Logger.ErrorBy(err)
+				continue
+			}
+			mu.Lock()
+			flows[key] = conn
+			mu.Unlock()
+			go func(key sc.NATKey, conn sc.PacketConn) {
+				forwardMuxUDP(conn, st)
+				mu.Lock()
+				if flows[key] == conn {
+					delete(flows, key)
+				}
+				mu.Unlock()
+				conn.Close()
+			}(key, conn)
+		}
+		conn.Write(payload)
+	}
+}
+
+// forwardMuxUDP sends the packets from the destination back to the stream until the flow is idle
+func forwardMuxUDP(conn sc.PacketConn, st *mux.Stream) {
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
+	for {
+		conn.SetReadDeadline(time.Now().Add(muxUDPTimeout))
+		n, addr, err := conn.ReadFrom((*buffer)[packet.MaxIPUDPHeaderLen:])
+		if err != nil {
+			return
+		}
+		origin, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		b, err := packet.PackUDPPayload(*buffer, n, packet.AddrFromAddrPort(origin.AddrPort()))
+		if err != nil {
+			continue
+		}
+		if _, err = st.Write(b); err != nil {
+			return
+		}
+	}
+}
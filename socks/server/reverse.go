@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/packet"
+	"github.com/josexy/gsocks5/socks/relay"
+	"github.com/josexy/gsocks5/util"
+)
+
+// maxReversePending is the max number of the inbound connections of a reverse listener
+// waiting to be claimed, the new connections over it are closed
+const maxReversePending = 64
+
+type pendingConn struct {
+	user    string
+	conn    net.Conn
+	release func()
+}
+
+// reverseHub keeps the inbound connections of the reverse tunnels until they are
+// claimed by the ReverseAccept requests of the clients
+type reverseHub struct {
+	mu      sync.Mutex
+	pending map[string]pendingConn
+}
+
+func newReverseHub() *reverseHub {
+	return &reverseHub{pending: make(map[string]pendingConn)}
+}
+
+// add keeps the inbound connection for the handshake timeout and returns its token,
+// release is called once the connection is claimed or expired
+func (h *reverseHub) add(user string, conn net.Conn, release func()) string {
+	var b [16]byte
+	rand.Read(b[:])
+	token := hex.EncodeToString(b[:])
+	h.mu.Lock()
+	h.pending[token] = pendingConn{user: user, conn: conn, release: release}
+	h.mu.Unlock()
+	time.AfterFunc(handshakeTimeout(), func() {
+		if conn := h.take(token, user); conn != nil {
+			conn.Close()
+		}
+	})
+	return token
+}
+
+func (h *reverseHub) take(token, user string) net.Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.pending[token]
+	if !ok || p.user != user {
+		return nil
+	}
+	delete(h.pending, token)
+	if p.release != nil {
+		p.release()
+	}
+	return p.conn
+}
+
+// allowReverse reports whether the user can listen on the port of ip, the ephemeral port
+// 0 is only allowed by the rules without port range. A nil ip is the wildcard address.
+func allowReverse(user string, ip net.IP, port int) bool {
+	for _, rule := range config.Cfg.Reverse.Rules {
+		if !matchUser(rule.Users, user) || !allowBindAddr(rule.BindAddrs, ip) {
+			continue
+		}
+		if rule.PortMin == 0 || (port >= rule.PortMin && port <= rule.PortMax) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowBindAddr(addrs []net.IP, ip net.IP) bool {
+	if len(addrs) == 0 {
+		return ip == nil || ip.IsUnspecified()
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) || (ip == nil && addr.IsUnspecified()) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCmdReverseListen listens on the target for the reverse tunnel until the control
+// connection is closed. Every inbound connection is announced with a reply carrying its
+// token, and the client claims it with a new ReverseAccept request.
+func (s *Socks5Server) handleCmdReverseListen(ctx context.Context, rw *bufio.ReadWriter, target string, src net.Conn) error {
+	user := UserFromContext(ctx)
+	host, p, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(p)
+	// the domain names aren't resolved, so that the bound address is the checked one
+	ip := net.ParseIP(host)
+	if (ip == nil && host != "") || !allowReverse(user, ip, port) {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.ConnectionNotAllowedByRuleset})
+		return constant.ErrReverseNotAllowed
+	}
+	ln, err := net.Listen("tcp", target)
+	if err != nil {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.GeneralSocksServerFailure})
+		return err
+	}
+	defer ln.Close()
+	bindAddr := ln.Addr().(*net.TCPAddr)
+	bindIP := s.advertiseIP(bindAddr.IP, src)
+	packet.SerializeTo(rw, &packet.SocksResponse{
+		ReplayCode: constant.Succeed,
+		BindAddr:   bindIP.String(),
+		BindPort:   bindAddr.Port,
+	})
+	util.Logger.Infof("[reverse] %s listen on [%s]",
+		color.GreenString(src.RemoteAddr().String()),
+		color.YellowString(bindAddr.String()))
+
+	// the control connection is closed by the client or expired with the session
+	doneChan := make(chan error, 1)
+	go func() {
+		deadline, hasDeadline := ctx.Deadline()
+		if hasDeadline {
+			src.SetReadDeadline(deadline)
+		}
+		_, err := io.Copy(io.Discard, src)
+		var ne net.Error
+		if hasDeadline && errors.As(err, &ne) && ne.Timeout() {
+			err = relay.ErrSessionExpired
+		}
+		doneChan <- err
+		ln.Close()
+	}()
+	slots := make(chan struct{}, maxReversePending)
+	release := func() { <-slots }
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return <-doneChan
+			}
+			return err
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			// the client doesn't claim the connections in time
+			conn.Close()
+			continue
+		}
+		token := s.reverse.add(user, conn, release)
+		_, err = packet.SerializeTo(rw, &packet.SocksResponse{
+			ReplayCode: constant.Succeed,
+			AType:      constant.DomainName,
+			BindAddr:   token,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleCmdReverseAccept relays the inbound connection of the token in the target
+func (s *Socks5Server) handleCmdReverseAccept(ctx context.Context, rw *bufio.ReadWriter, target string, src net.Conn) error {
+	token, _, _ := net.SplitHostPort(target)
+	conn := s.reverse.take(token, UserFromContext(ctx))
+	if conn == nil {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.ConnectionRefused})
+		return constant.ErrReverseNotFound
+	}
+	peer := conn.RemoteAddr().(*net.TCPAddr)
+	sessionFromContext(ctx).target = peer.String()
+	packet.SerializeTo(rw, &packet.SocksResponse{
+		ReplayCode: constant.Succeed,
+		BindAddr:   peer.IP.String(),
+		BindPort:   peer.Port,
+	})
+	util.Logger.Infof("[reverse] remote: [%s] <-> local: [%s]",
+		color.YellowString(peer.String()),
+		color.GreenString(src.RemoteAddr().String()))
+	return s.forwardData(ctx, conn, pipelined(rw, src))
+}
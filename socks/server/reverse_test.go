@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/josexy/gsocks5/config"
+)
+
+func TestAllowReverse(t *testing.T) {
+	old := config.Cfg.Reverse
+	defer func() { config.Cfg.Reverse = old }()
+	config.Cfg.Reverse.Rules = []config.ReverseRule{
+		{Users: []string{"alice"}, PortMin: 8000, PortMax: 8100},
+		{Users: []string{"bob"}, BindAddrs: []net.IP{net.ParseIP("192.0.2.1")}},
+	}
+	for _, tt := range []struct {
+		user string
+		ip   string
+		port int
+		want bool
+	}{
+		{"alice", "", 8000, true},
+		{"alice", "0.0.0.0", 8100, true},
+		{"alice", "0.0.0.0", 8101, false},
+		{"alice", "127.0.0.1", 8000, false},
+		{"bob", "192.0.2.1", 0, true},
+		{"bob", "127.0.0.1", 80, false},
+		{"bob", "0.0.0.0", 80, false},
+		{"carol", "", 8000, false},
+	} {
+		if got := allowReverse(tt.user, net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("allowReverse(%s, %q, %d) = %v", tt.user, tt.ip, tt.port, got)
+		}
+	}
+}
+
+func TestReverseHubRelease(t *testing.T) {
+	h := newReverseHub()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	released := 0
+	token := h.add("alice", c1, func() { released++ })
+	if h.take(token, "bob") != nil || released != 0 {
+		t.Fatal("taken by another user")
+	}
+	if h.take(token, "alice") != c1 || released != 1 {
+		t.Fatalf("take: released %d", released)
+	}
+	if h.take(token, "alice") != nil || released != 1 {
+		t.Fatalf("taken twice: released %d", released)
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/route"
+	"github.com/josexy/gsocks5/socks/sc"
+	"github.com/josexy/gsocks5/util"
+)
+
+// the failed members of a group are tried after the others for a while
+const groupFailureTTL = time.Second * 30
+
+// outbound dials the destinations of the sessions
+type outbound interface {
+	dial(ctx context.Context, target string) (net.Conn, error)
+	dialUDP(ctx context.Context, target string) (sc.PacketConn, error)
+}
+
+// directOutbound dials the destinations with bind, or with the binding of the outbound
+// rules if bind is nil
+type directOutbound struct {
+	s    *Socks5Server
+	bind *config.OutboundBind
+}
+
+func (d *directOutbound) binding(ctx context.Context, target string) config.OutboundBind {
+	if d.bind != nil {
+		return *d.bind
+	}
+	return matchOutbound(UserFromContext(ctx), target)
+}
+
+func (d *directOutbound) dial(ctx context.Context, target string) (net.Conn, error) {
+	return d.s.dialDirect(ctx, target, d.binding(ctx, target))
+}
+
+func (d *directOutbound) dialUDP(ctx context.Context, target string) (sc.PacketConn, error) {
+	return d.s.bindDialer(d.binding(ctx, target)).DialUDP(ctx, target)
+}
+
+type rejectOutbound struct{}
+
+func (rejectOutbound) dial(context.Context, string) (net.Conn, error) {
+	return nil, constant.ErrRouteRejected
+}
+
+func (rejectOutbound) dialUDP(context.Context, string) (sc.PacketConn, error) {
+	return nil, constant.ErrRouteRejected
+}
+
+// groupOutbound dials its members in order and fails over to the next one, the members
+// failed recently are tried last
+type groupOutbound struct {
+	name    string
+	members []outbound
+	mu      sync.Mutex
+	failed  []time.Time
+}
+
+func (g *groupOutbound) order() []int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	list := make([]int, 0, len(g.members))
+	var failed []int
+	for i := range g.members {
+		if now.Sub(g.failed[i]) < groupFailureTTL {
+			failed = append(failed, i)
+		} else {
+			list = append(list, i)
+		}
+	}
+	return append(list, failed...)
+}
+
+func (g *groupOutbound) try(ctx context.Context, target string, fn func(outbound) error) (err error) {
+	for _, i := range g.order() {
+		if err = fn(g.members[i]); err == nil {
+			g.mu.Lock()
+			g.failed[i] = time.Time{}
+			g.mu.Unlock()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		util.Logger.Warnf("[route] %s: member %d failed to dial %s: %s",
+			color.GreenString(g.name), i, color.YellowString(target), color.RedString(err.Error()))
+		g.mu.Lock()
+		g.failed[i] = time.Now()
+		g.mu.Unlock()
+	}
+	return err
+}
+
+func (g *groupOutbound) dial(ctx context.Context, target string) (conn net.Conn, err error) {
+	err = g.try(ctx, target, func(o outbound) (err error) {
+		conn, err = o.dial(ctx, target)
+		return
+	})
+	return
+}
+
+func (g *groupOutbound) dialUDP(ctx context.Context, target string) (conn sc.PacketConn, err error) {
+	err = g.try(ctx, target, func(o outbound) (err error) {
+		conn, err = o.dialUDP(ctx, target)
+		return
+	})
+	return
+}
+
+// router chooses the named outbound of each destination
+type router struct {
+	*route.Router
+	outbounds map[string]outbound
+	upstreams []*upstream
+}
+
+func (s *Socks5Server) newRouter() *router {
+	cfg := config.Cfg.Route
+	if len(cfg.Rules) == 0 && cfg.Final == "" {
+		return nil
+	}
+	r := &router{outbounds: map[string]outbound{
+		route.Direct: &directOutbound{s: s},
+		route.Reject: rejectOutbound{},
+	}}
+	for _, o := range cfg.Outbounds {
+		switch o.Type {
+		case config.OutboundDirect:
+			bind := o.Bind
+			r.outbounds[o.Name] = &directOutbound{s: s, bind: &bind}
+		case config.OutboundSocks5:
+			u := newUpstream(o.Upstream)
+			u.associate = !o.Upstream.Mux
+			r.upstreams = append(r.upstreams, u)
+			r.outbounds[o.Name] = u
+		case config.OutboundGroup:
+			g := &groupOutbound{name: o.Name, failed: make([]time.Time, len(o.Outbounds))}
+			for _, name := range o.Outbounds {
+				g.members = append(g.members, r.outbounds[name])
+			}
+			r.outbounds[o.Name] = g
+		}
+	}
+	sets := make(map[string]*route.RuleSet)
+	var err error
+	for name, file := range cfg.RuleSets {
+		if sets[name], err = route.LoadRuleSet(file); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		r.Router, err = route.NewRouter(cfg.Rules, sets, cfg.Final)
+	}
+	if err != nil {
+		// fail closed, the destinations rejected by the rules never go out
+		util.Logger.ErrorBy(err)
+		r.Router, _ = route.NewRouter(nil, nil, route.Reject)
+	}
+	return r
+}
+
+func (r *router) close() {
+	for _, u := range r.upstreams {
+		u.close()
+	}
+}
+
+// outbound returns the outbound of the target chosen by the router, which is named, or the
+// upstream server or the direct outbound
+func (s *Socks5Server) outbound(ctx context.Context, target string) (string, outbound) {
+	if s.router != nil {
+		if name := s.router.Route(route.NewMetadata(UserFromContext(ctx), target)); name != "" {
+			return name, s.router.outbounds[name]
+		}
+	}
+	if s.upstream != nil {
+		return "", s.upstream
+	}
+	return "", &directOutbound{s: s}
+}
+
+func routeSuffix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return " via " + color.CyanString(name)
+}
@@ -4,127 +4,290 @@ import (
 	"bufio"
 	"context"
 	"net"
+	"net/netip"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/mux"
+	"github.com/josexy/gsocks5/socks/admin"
+	"github.com/josexy/gsocks5/socks/auth"
+	"github.com/josexy/gsocks5/socks/connection"
 	"github.com/josexy/gsocks5/socks/constant"
 	"github.com/josexy/gsocks5/socks/packet"
 	"github.com/josexy/gsocks5/socks/sc"
 	"github.com/josexy/gsocks5/tcpserver"
+	"github.com/josexy/gsocks5/transport"
 	"github.com/josexy/gsocks5/udpserver"
 	"github.com/josexy/gsocks5/util"
 )
 
 type Socks5Server struct {
-	server         *tcpserver.TcpServer
-	udpServer      *udpserver.UdpServer
-	targetAddrChan chan string
-	natM           *sc.UdpNATMap
+	listeners    []*listener
+	dialer       *connection.Dialer
+	connLimiter  *tcpserver.ConnLimiter
+	userSessions *userLimiter
+	userUDP      *userLimiter
+	ipGuard      *auth.Guard
+	userGuard    *auth.Guard
+	reverse      *reverseHub
+	upstream     *upstream
+	users        *userStore
+	admin        *admin.Server
+	router       *router
+	udpServer    *udpserver.UdpServer
+	udpPorts     *udpPortAllocator
+	udpMu        sync.Mutex
+	udpPending   map[netip.Addr][]*udpAssociate
+	udpClients   map[netip.AddrPort]*udpAssociate
+	natM         *sc.UdpNATMap
 }
 
-func NewSocks5Server(addr string) (svr *Socks5Server) {
+// NewSocks5Server creates a socks server listening on the tcp address addr and on every
+// additional listener. addr may be empty if only the additional listeners are wanted.
+func NewSocks5Server(addr string, listeners ...config.ListenerConfig) (svr *Socks5Server) {
 	svr = &Socks5Server{
-		targetAddrChan: make(chan string, 128),
-		natM:           sc.NewUdpNATMap(time.Second * 20),
+		udpPending:   make(map[netip.Addr][]*udpAssociate),
+		udpClients:   make(map[netip.AddrPort]*udpAssociate),
+		natM:         sc.NewUdpNATMap(time.Second * 20),
+		dialer:       newDialer(),
+		userSessions: newUserLimiter(config.Cfg.Limit.MaxSessionsPerUser),
+		userUDP:      newUserLimiter(config.Cfg.Limit.MaxUDPPerUser),
+		ipGuard:      newAuthGuard(),
+		userGuard:    newAuthGuard(),
+		reverse:      newReverseHub(),
+		upstream:     newUpstream(config.Cfg.Upstream),
+		users:        newUserStore(),
+	}
+	svr.router = svr.newRouter()
+	svr.admin = svr.newAdmin()
+	svr.newUdpRelay()
+	if addr != "" {
+		svr.listeners = append(svr.listeners, svr.newListener(config.ListenerConfig{
+			Network: "tcp",
+			Addr:    addr,
+		}))
+	}
+	for _, lc := range listeners {
+		svr.listeners = append(svr.listeners, svr.newListener(lc))
 	}
-	svr.server = tcpserver.NewTcpServer(addr, svr)
-	svr.udpServer, _ = udpserver.NewUdpServer(addr, svr)
 	return
 }
 
+// Listen listens on the addresses of the listeners before Start, so that their ephemeral
+// ports are known by Addr
+func (s *Socks5Server) Listen() error {
+	for _, l := range s.listeners {
+		if err := l.server.Listen(); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Addr returns the address of the first listener, nil if it isn't listening
+func (s *Socks5Server) Addr() net.Addr {
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].server.LocalAddr()
+}
+
 func (s *Socks5Server) Start() error {
-	go s.udpServer.Serve()
-	return s.server.ListenAndServe()
+	if len(s.listeners) == 0 {
+		return constant.ErrNoListener
+	}
+	errCh := make(chan error, len(s.listeners))
+	if s.udpServer != nil {
+		go s.udpServer.Serve()
+	}
+	if s.admin != nil {
+		s.admin.Serve()
+	}
+	for _, l := range s.listeners {
+		if l.udpServer != nil {
+			go l.udpServer.Serve()
+		}
+		go func(l *listener) {
+			errCh <- l.server.ListenAndServe()
+		}(l)
+	}
+	// any listener stopped causes all of them to be closed
+	err := <-errCh
+	s.Close()
+	return err
 }
 
-func (s *Socks5Server) Close() error {
-	s.udpServer.Close()
-	return s.server.Close()
+func (s *Socks5Server) Close() (err error) {
+	if s.upstream != nil {
+		s.upstream.close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	if s.users != nil {
+		s.users.close()
+	}
+	if s.router != nil {
+		s.router.close()
+	}
+	if s.udpServer != nil {
+		s.udpServer.Close()
+	}
+	for _, l := range s.listeners {
+		if l.udpServer != nil {
+			l.udpServer.Close()
+		}
+		if e := l.server.Close(); e != nil && e != tcpserver.ErrServerClosed {
+			err = e
+		}
+	}
+	return
 }
 
 func (s *Socks5Server) ServeTCP(ctx context.Context, conn net.Conn) {
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	if err := s.handleNegotiate(rw); err != nil {
-		util.Logger.ErrorBy(err)
+	if l := listenerFromContext(ctx); l != nil && l.WebSocketPath != "" && !transport.IsWebSocket(conn) {
+		// the sessions are tunneled inside the WebSocket connections upgraded on the path
+		transport.ServeWebSocket(conn, l.WebSocketPath, handshakeTimeout(), func(ws net.Conn) {
+			s.ServeTCP(ctx, ws)
+		})
 		return
 	}
-	if err := s.handleRequest(rw, conn); err != nil {
-		util.Logger.ErrorBy(err)
-		return
+	sess := &session{conn: conn, start: time.Now()}
+	ctx = context.WithValue(ctx, sessionContextKey, sess)
+	if lifetime := config.Cfg.Timeout.Session; lifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lifetime)
+		defer cancel()
+	}
+	sess.close(s.serveTCP(ctx, sess))
+}
+
+func (s *Socks5Server) serveTCP(ctx context.Context, sess *session) (err error) {
+	conn := sess.conn
+	if s.ipGuard.Banned(remoteIP(conn)) {
+		return constant.ErrClientBanned
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout()))
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if sess.user, err = s.handleNegotiate(ctx, rw); err != nil {
+		return err
+	}
+	if sess.mux {
+		return s.serveMux(ctx, sess, rw)
 	}
+	if !s.userSessions.acquire(sess.user) {
+		rejectRequest(rw)
+		return constant.ErrLimitExceeded
+	}
+	defer s.userSessions.release(sess.user)
+	return s.handleRequest(ctx, rw, conn)
 }
 
-func (s *Socks5Server) ServeUDP(ctx context.Context, conn *net.UDPConn) {
-	if err := s.serveUDP(conn); err != nil {
+func (s *Socks5Server) ServeUDP(ctx context.Context, p *udpserver.Packet) {
+	if err := s.serveUDP(p, s.natM, s.association); err != nil {
 		util.Logger.ErrorBy(err)
 	}
 }
 
+// chooseMethod returns the first method of the server offered by the client, or
+// MethodNotAcceptable (RFC 1928). The mux is chosen if it's enabled and offered.
 func (s *Socks5Server) chooseMethod(clientMethod, serverMethod []constant.Socks5Method) constant.Socks5Method {
-	var method constant.Socks5Method
+	if config.Cfg.Mux.Enable && hasMethod(clientMethod, constant.MethodMux) {
+		return constant.MethodMux
+	}
 	if len(serverMethod) == 0 {
-		method = constant.MethodNoAuthRequired
-	} else {
-		method = serverMethod[0]
+		serverMethod = []constant.Socks5Method{constant.MethodNoAuthRequired}
 	}
-	for _, m := range clientMethod {
-		if m == method {
-			return method
+	for _, m := range serverMethod {
+		if hasMethod(clientMethod, m) {
+			return m
 		}
 	}
-	if len(clientMethod) == 0 {
-		return constant.MethodNoAuthRequired
+	return constant.MethodNotAcceptable
+}
+
+func hasMethod(methods []constant.Socks5Method, method constant.Socks5Method) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
 	}
-	return clientMethod[0]
+	return false
 }
 
-func (s *Socks5Server) handleNegotiate(rw *bufio.ReadWriter) error {
+// handleNegotiate returns the authenticated username, which is empty if no authentication required
+func (s *Socks5Server) handleNegotiate(ctx context.Context, rw *bufio.ReadWriter) (string, error) {
 	res, err := packet.SerializeFrom[*packet.SocksNegotiateRequest](rw)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer res.Release()
 	if res.Version != constant.Socks5Version05 {
-		return constant.ErrVersion5Invalid
+		return "", constant.ErrVersion5Invalid
 	}
 	if res.NMethods < 0 {
-		return constant.ErrUnsupportedMethod
+		return "", constant.ErrUnsupportedMethod
 	}
-	method := s.chooseMethod(res.Methods, config.Cfg.SocksMethod)
+	l := listenerFromContext(ctx)
+	method := s.chooseMethod(res.Methods, l.socksMethod())
 	packet.SerializeTo(rw, &packet.SocksNegotiateResponse{
 		Method: method,
 	})
-	if method == constant.MethodUsernamePassword {
-		return s.handleAuth(rw)
+	sess := sessionFromContext(ctx)
+	switch method {
+	case constant.MethodUsernamePassword:
+		return s.handleAuth(rw, l.auth(), remoteIP(sess.conn))
+	case constant.MethodMux:
+		sess.mux = true
+		return s.handleMuxAuth(rw, l, remoteIP(sess.conn))
+	case constant.MethodNotAcceptable:
+		return "", constant.ErrUnsupportedMethod
 	}
-	return nil
+	return "", nil
 }
 
-func (s *Socks5Server) handleAuth(rw *bufio.ReadWriter) error {
+func (s *Socks5Server) handleAuth(rw *bufio.ReadWriter, auths []auth.Socks5Auth, ip string) (string, error) {
 	res, err := packet.SerializeFrom[*packet.SocksAuthRequest](rw)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer res.Release()
 	if res.Version != constant.Socks5Version01 {
-		return constant.ErrVersion1Invalid
+		return "", constant.ErrVersion1Invalid
 	}
 
-	for _, auth := range config.Cfg.Auth {
-		if auth.Auth(res.Username, res.Password) {
-			packet.SerializeTo(rw, &packet.SocksAuthResponse{})
-			return nil
-		}
+	if s.userGuard.Banned(res.Username) {
+		packet.SerializeTo(rw, &packet.SocksAuthResponse{
+			Status: constant.GeneralSocksServerFailure,
+		})
+		return "", constant.ErrClientBanned
+	}
+	err = s.authenticate(res.Username, res.Password, auths, ip)
+	switch err {
+	case nil:
+		s.ipGuard.Success(ip)
+		s.userGuard.Success(res.Username)
+		packet.SerializeTo(rw, &packet.SocksAuthResponse{})
+		return res.Username, nil
+	case constant.ErrAuthFailure:
+		s.authFailed(ip, res.Username)
 	}
 	packet.SerializeTo(rw, &packet.SocksAuthResponse{
 		Status: constant.GeneralSocksServerFailure,
 	})
-	return constant.ErrAuthFailure
+	return "", err
 }
 
-func (s *Socks5Server) handleRequest(rw *bufio.ReadWriter, src net.Conn) error {
+func (s *Socks5Server) handleRequest(ctx context.Context, rw *bufio.ReadWriter, src net.Conn) error {
 	res, err := packet.SerializeFrom[*packet.SocksRequest](rw)
+	if err == constant.ErrUnsupportedReqAType {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.AddressTypeNotSupported})
+		return err
+	}
 	if err != nil {
 		return err
 	}
@@ -135,20 +298,32 @@ func (s *Socks5Server) handleRequest(rw *bufio.ReadWriter, src net.Conn) error {
 	if res.Version != constant.Socks5Version05 {
 		return constant.ErrVersion5Invalid
 	}
-	switch res.AType {
-	case constant.IPv4, constant.IPv6, constant.DomainName:
-	default:
-		return constant.ErrUnsupportedReqAType
-	}
-
 	target := net.JoinHostPort(res.DstAddr, strconv.Itoa(res.DstPort))
+	sessionFromContext(ctx).target = target
+	if err = s.checkUser(ctx, res.Cmd); err != nil {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.ConnectionNotAllowedByRuleset})
+		return err
+	}
+	// the handshake is done, the relay has its own timeouts
+	src.SetDeadline(time.Time{})
 	switch res.Cmd {
 	case constant.Connect:
-		if err = s.handleCmdConnect(rw, target, src); err != nil {
+		if err = s.handleCmdConnect(ctx, rw, target, src); err != nil {
 			return err
 		}
 	case constant.UDP:
-		if err = s.handleCmdUdpAssociate(rw, target, src); err != nil {
+		if st, ok := src.(*mux.Stream); ok && st.Datagram() {
+			return s.handleMuxUDP(ctx, rw, target, st)
+		}
+		if err = s.handleCmdUdpAssociate(ctx, rw, target, src); err != nil {
+			return err
+		}
+	case constant.ReverseListen:
+		if err = s.handleCmdReverseListen(ctx, rw, target, src); err != nil {
+			return err
+		}
+	case constant.ReverseAccept:
+		if err = s.handleCmdReverseAccept(ctx, rw, target, src); err != nil {
 			return err
 		}
 	//case constant.Bind:
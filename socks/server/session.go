@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/relay"
+	"github.com/josexy/gsocks5/util"
+)
+
+const defaultHandshakeTimeout = time.Second * 10
+
+var sessionContextKey = &contextKey{name: "socks-session"}
+
+type session struct {
+	conn   net.Conn
+	user   string
+	target string
+	mux    bool
+	start  time.Time
+	reason error
+}
+
+func handshakeTimeout() time.Duration {
+	if config.Cfg.Timeout.Handshake <= 0 {
+		return defaultHandshakeTimeout
+	}
+	return config.Cfg.Timeout.Handshake
+}
+
+func sessionFromContext(ctx context.Context) *session {
+	sess, _ := ctx.Value(sessionContextKey).(*session)
+	return sess
+}
+
+// UserFromContext returns the authenticated username of the session
+func UserFromContext(ctx context.Context) string {
+	if sess := sessionFromContext(ctx); sess != nil {
+		return sess.user
+	}
+	return ""
+}
+
+// close records the reason why the session is closed
+func (sess *session) close(err error) {
+	if err != nil && sess.target == "" {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			err = constant.ErrHandshakeTimeout
+		}
+	}
+	sess.reason = err
+	switch err {
+	case nil:
+	case relay.ErrIdleTimeout, relay.ErrSessionExpired, constant.ErrHandshakeTimeout, constant.ErrClientBanned,
+		constant.ErrRouteRejected:
+		util.Logger.Warnf("[session] %s closed after %s, reason: %s",
+			color.GreenString(sess.conn.RemoteAddr().String()),
+			time.Since(sess.start).Round(time.Millisecond),
+			color.RedString(err.Error()))
+	default:
+		util.Logger.ErrorBy(err)
+	}
+}
@@ -3,22 +3,24 @@ package server
 import (
 	"bufio"
 	"context"
-	"io"
+	"errors"
 	"net"
 	"strconv"
-	"sync"
-	"time"
+	"syscall"
 
 	"github.com/fatih/color"
-	"github.com/josexy/gsocks5/socks/connection"
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/proxyproto"
 	"github.com/josexy/gsocks5/socks/constant"
 	"github.com/josexy/gsocks5/socks/packet"
+	"github.com/josexy/gsocks5/socks/relay"
 	"github.com/josexy/gsocks5/util"
 )
 
-func (s *Socks5Server) handleCmdConnect(rw *bufio.ReadWriter, target string, src net.Conn) error {
-	dest, bindAddr, bindPort, err := s.dialTCP(target)
+func (s *Socks5Server) handleCmdConnect(ctx context.Context, rw *bufio.ReadWriter, target string, src net.Conn) error {
+	dest, bindAddr, bindPort, err := s.dialTCP(ctx, target)
 	if err != nil {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: dialReplyCode(err)})
 		return err
 	}
 	packet.SerializeTo(rw, &packet.SocksResponse{
@@ -26,43 +28,71 @@ func (s *Socks5Server) handleCmdConnect(rw *bufio.ReadWriter, target string, src
 		BindAddr:   bindAddr,
 		BindPort:   bindPort,
 	})
-	s.forwardData(dest, src)
-	return nil
+	return s.forwardData(ctx, dest, pipelined(rw, src))
 }
 
-func (s *Socks5Server) dialTCP(target string) (conn net.Conn, bindAddr string, bindPort int, err error) {
-	conn, err = connection.Dial(context.Background(),
-		"tcp",
-		target,
-		time.Second*10,
-	)
-	if err != nil {
+// pipelined returns src which reads the data buffered by rw first, the client may send
+// the data with the request without waiting for the reply
+func pipelined(rw *bufio.ReadWriter, src net.Conn) net.Conn {
+	if rw.Reader.Buffered() == 0 {
+		return src
+	}
+	return &bufferedConn{Conn: src, r: rw.Reader}
+}
+
+func dialReplyCode(err error) constant.Socks5ReplyCode {
+	var ne net.Error
+	switch {
+	case err == constant.ErrRouteRejected:
+		return constant.ConnectionNotAllowedByRuleset
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return constant.ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return constant.NetworkUnreachable
+	case errors.As(err, &ne) && ne.Timeout():
+		return constant.TTLExpired
+	default:
+		return constant.HostUnreachable
+	}
+}
+
+func (s *Socks5Server) dialTCP(ctx context.Context, target string) (conn net.Conn, bindAddr string, bindPort int, err error) {
+	name, out := s.outbound(ctx, target)
+	if conn, err = out.dial(ctx, target); err != nil {
 		return
 	}
 	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
 		bindAddr = addr.IP.String()
 		bindPort = addr.Port
 	}
-	util.Logger.Infof("[tcp] local: [%s] <-> remote: [%s]/[%s]",
+	util.Logger.Infof("[tcp] local: [%s] <-> remote: [%s]/[%s]%s",
 		color.GreenString(net.JoinHostPort(bindAddr, strconv.Itoa(bindPort))),
 		color.YellowString(target),
-		color.RedString(conn.RemoteAddr().String()))
+		color.RedString(conn.RemoteAddr().String()),
+		routeSuffix(name))
 	return
 }
 
-func (s *Socks5Server) forwardData(dest, src net.Conn) {
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	s.forward(dest, src, &wg)
-	wg.Wait()
+func (s *Socks5Server) dialDirect(ctx context.Context, target string, bind config.OutboundBind) (net.Conn, error) {
+	conn, err := s.bindDialer(bind).DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	if bind.ProxyProtocol != 0 {
+		// the upstream sees the socks client as the source address
+		if err = proxyproto.WriteHeader(conn, bind.ProxyProtocol, sessionFromContext(ctx).conn.RemoteAddr(), conn.RemoteAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
-func (s *Socks5Server) forward(dest, src net.Conn, wg *sync.WaitGroup) {
-	fn := func(dest, src net.Conn) {
-		defer wg.Done()
-		_, _ = io.Copy(dest, src)
-		_ = dest.Close()
-	}
-	go fn(dest, src)
-	go fn(src, dest)
+func (s *Socks5Server) forwardData(ctx context.Context, dest, src net.Conn) error {
+	defer dest.Close()
+	dest = s.meterConn(ctx, dest)
+	timeout := relay.Timeout{Idle: config.Cfg.Timeout.Idle}
+	timeout.Deadline, _ = ctx.Deadline()
+	_, _, err := relay.Relay(src, dest, timeout)
+	return err
 }
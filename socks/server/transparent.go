@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/packet"
+	"github.com/josexy/gsocks5/socks/sc"
+	"github.com/josexy/gsocks5/tcpserver"
+	"github.com/josexy/gsocks5/transparent"
+	"github.com/josexy/gsocks5/udpserver"
+	"github.com/josexy/gsocks5/util"
+)
+
+const tproxyUDPTimeout = time.Second * 20
+
+// newTransparentListener serves the traffic diverted by the iptables REDIRECT or TPROXY
+// target, which is relayed like the CONNECT and UDP ASSOCIATE requests
+func (s *Socks5Server) newTransparentListener(l *listener) {
+	l.server.Handler = tcpserver.TcpHandlerFunc(s.serveTransparentTCP)
+	if l.Mode != config.ModeTProxy {
+		return
+	}
+	l.server.ListenConfig.Control = transparent.Control
+	network := "udp"
+	switch l.Network {
+	case "tcp4":
+		network = "udp4"
+	case "tcp6":
+		network = "udp6"
+	}
+	conn, err := transparent.ListenUDP(network, l.Addr)
+	if err != nil {
+		util.Logger.ErrorBy(err)
+		return
+	}
+	natM := sc.NewUdpNATMap(tproxyUDPTimeout)
+	l.udpServer = udpserver.NewUdpServerConn(conn, udpserver.UdpHandlerFunc(func(ctx context.Context, p *udpserver.Packet) {
+		if err := s.serveTProxyUDP(ctx, p, natM); err != nil && !errors.Is(err, net.ErrClosed) {
+			util.Logger.ErrorBy(err)
+		}
+	}))
+	l.udpServer.ReadFrom = transparent.ReadFromUDP
+	l.udpServer.BaseContext = l.server.BaseContext
+}
+
+func (s *Socks5Server) serveTransparentTCP(ctx context.Context, conn net.Conn) {
+	sess := &session{conn: conn, start: time.Now()}
+	ctx = context.WithValue(ctx, sessionContextKey, sess)
+	if lifetime := config.Cfg.Timeout.Session; lifetime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lifetime)
+		defer cancel()
+	}
+	sess.close(s.serveTransparent(ctx, sess))
+}
+
+func (s *Socks5Server) serveTransparent(ctx context.Context, sess *session) error {
+	if s.ipGuard.Banned(remoteIP(sess.conn)) {
+		return constant.ErrClientBanned
+	}
+	l := listenerFromContext(ctx)
+	// the TPROXY target keeps the original destination as the local address
+	dst, _ := sess.conn.LocalAddr().(*net.TCPAddr)
+	if dst == nil {
+		return transparent.ErrNoOriginalDst
+	}
+	var self bool
+	if l.Mode == config.ModeRedirect {
+		addr, err := transparent.OriginalDst(sess.conn)
+		if err != nil {
+			return err
+		}
+		// the connections which aren't redirected keep the local address
+		self = addr.IP.Equal(dst.IP) && addr.Port == dst.Port
+		dst = addr
+	} else {
+		self = l.isSelf(dst.IP, dst.Port)
+	}
+	if self {
+		// connected to the listener directly, which would loop
+		return transparent.ErrNoOriginalDst
+	}
+	sess.target = dst.String()
+	dest, _, _, err := s.dialTCP(ctx, sess.target)
+	if err != nil {
+		return err
+	}
+	return s.forwardData(ctx, dest, sess.conn)
+}
+
+// isSelf reports whether the TPROXY destination is the listener, that is the listener
+// port on an ip of this host
+func (l *listener) isSelf(ip net.IP, port int) bool {
+	_, p, err := net.SplitHostPort(l.Addr)
+	if err != nil || p != strconv.Itoa(port) {
+		return false
+	}
+	return isLocalIP(ip)
+}
+
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTProxyUDP relays one packet diverted by the TPROXY target. Each flow of the client
+// and the original destination has its own outbound socket, and the replies are sent
+// from a socket bound to the original destination.
+func (s *Socks5Server) serveTProxyUDP(ctx context.Context, p *udpserver.Packet, natM *sc.UdpNATMap) error {
+	src, dst := p.Src, p.Dst
+	if listenerFromContext(ctx).isSelf(dst.IP, dst.Port) {
+		return transparent.ErrNoOriginalDst
+	}
+	key := sc.NATKey{Src: src.AddrPort(), Dst: dst.AddrPort()}
+	targetConn := natM.Get(key)
+	if targetConn == nil {
+		target := dst.String()
+		var err error
+		if targetConn, err = s.dialUDP(ctx, target); err != nil {
+			return err
+		}
+		replyConn, err := transparent.ListenReplyUDP(dst)
+		if err != nil {
+			targetConn.Close()
+			return err
+		}
+		util.Logger.Infof("[udp] tproxy: [%s] <-> remote: [%s]",
+			color.GreenString(src.String()),
+			color.YellowString(target))
+		natM.Set(key, targetConn)
+		go func() {
+			defer replyConn.Close()
+			forwardTProxyUDP(replyConn, targetConn, src)
+			if conn := natM.Del(key); conn != nil {
+				conn.Close()
+			}
+		}()
+	}
+	targetConn.Write(p.Data)
+	return nil
+}
+
+// forwardTProxyUDP sends the replies of the destination to the client until the flow is idle
+func forwardTProxyUDP(replyConn *net.UDPConn, targetConn sc.PacketConn, client *net.UDPAddr) {
+	buffer := packet.GetBuffer(true)
+	defer packet.ReleaseBuffer(buffer, true)
+	for {
+		targetConn.SetReadDeadline(time.Now().Add(tproxyUDPTimeout))
+		n, err := targetConn.Read(*buffer)
+		if err != nil {
+			return
+		}
+		replyConn.WriteToUDP((*buffer)[:n], client)
+	}
+}
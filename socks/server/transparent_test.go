@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/josexy/gsocks5/config"
+)
+
+func TestListenerIsSelf(t *testing.T) {
+	for _, addr := range []string{":7893", "0.0.0.0:7893", "127.0.0.1:7893"} {
+		l := &listener{ListenerConfig: config.ListenerConfig{Addr: addr, Mode: config.ModeTProxy}}
+		for _, tt := range []struct {
+			ip   string
+			port int
+			self bool
+		}{
+			{"127.0.0.1", 7893, true},
+			{"::1", 7893, true},
+			{"127.0.0.1", 80, false},
+			// a remote host on the same port isn't a loop
+			{"203.0.113.1", 7893, false},
+		} {
+			if self := l.isSelf(net.ParseIP(tt.ip), tt.port); self != tt.self {
+				t.Errorf("%s: isSelf(%s, %d) = %v", addr, tt.ip, tt.port, self)
+			}
+		}
+	}
+}
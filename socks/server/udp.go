@@ -2,68 +2,265 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"io"
 	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/fatih/color"
-	"github.com/josexy/gsocks5/socks/connection"
+	"github.com/josexy/gsocks5/config"
 	"github.com/josexy/gsocks5/socks/constant"
 	"github.com/josexy/gsocks5/socks/packet"
+	"github.com/josexy/gsocks5/socks/relay"
+	"github.com/josexy/gsocks5/socks/sc"
+	"github.com/josexy/gsocks5/udpserver"
 	"github.com/josexy/gsocks5/util"
 )
 
-func (s *Socks5Server) serveUDP(conn *net.UDPConn) error {
-	buffer := packet.GetBuffer(true)
-	defer packet.ReleaseBuffer(buffer, true)
+// udpAssociate is the association of the control connection, done is closed when it ends.
+// ip is the client address of the control connection, invalid if it isn't an ip connection,
+// and dst is the DST.ADDR/DST.PORT of the request, whose zero parts match any source.
+type udpAssociate struct {
+	ctx  context.Context
+	done <-chan struct{}
+	ip   netip.Addr
+	dst  netip.AddrPort
+	// src is the client address which claimed the association on the shared relay
+	src netip.AddrPort
 
+	// flows are the keys of the outbound flows in natM, they are closed when the
+	// association ends
+	mu      sync.Mutex
+	natM    *sc.UdpNATMap
+	flows   map[sc.NATKey]struct{}
+	pruneAt int
+	ended   bool
+}
+
+func newUdpAssociate(ctx context.Context, done <-chan struct{}, target string, src net.Conn) *udpAssociate {
+	a := &udpAssociate{ctx: ctx, done: done}
+	if addr, ok := src.RemoteAddr().(*net.TCPAddr); ok {
+		a.ip = addr.AddrPort().Addr().Unmap()
+	}
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		ip, _ := netip.ParseAddr(host)
+		if ip.IsUnspecified() {
+			ip = netip.Addr{}
+		}
+		n, _ := strconv.ParseUint(port, 10, 16)
+		a.dst = netip.AddrPortFrom(ip.Unmap(), uint16(n))
+	}
+	return a
+}
+
+func (a *udpAssociate) alive() bool {
+	select {
+	case <-a.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// addFlow adds the outbound flow of key to natM, it returns false if the association has ended
+func (a *udpAssociate) addFlow(natM *sc.UdpNATMap, key sc.NATKey, src *net.UDPAddr, w sc.PacketWriter, conn sc.PacketConn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ended {
+		return false
+	}
+	if a.flows == nil {
+		a.flows = make(map[sc.NATKey]struct{})
+	}
+	// forget the idle flows which have been removed from natM
+	if len(a.flows) >= a.pruneAt {
+		for k := range a.flows {
+			if natM.Get(k) == nil {
+				delete(a.flows, k)
+			}
+		}
+		a.pruneAt = 2*len(a.flows) + 64
+	}
+	a.natM = natM
+	a.flows[key] = struct{}{}
+	natM.Add(key, src, w, conn)
+	return true
+}
+
+// closeFlows closes the outbound flows of the association when it ends
+func (a *udpAssociate) closeFlows() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ended = true
+	for key := range a.flows {
+		if conn := a.natM.Del(key); conn != nil {
+			conn.Close()
+		}
+	}
+	a.flows = nil
+}
+
+// accepts reports whether the datagrams of the client address src belong to the association
+func (a *udpAssociate) accepts(src netip.AddrPort) bool {
+	ip := src.Addr().Unmap()
+	if a.ip.IsValid() && a.ip != ip {
+		return false
+	}
+	if a.dst.Addr().IsValid() && a.dst.Addr() != ip {
+		return false
+	}
+	return a.dst.Port() == 0 || a.dst.Port() == src.Port()
+}
+
+// serveUDP relays one datagram of the client to its destination, each destination of the
+// client has its own outbound flow. association returns the association of the client.
+func (s *Socks5Server) serveUDP(p *udpserver.Packet, natM *sc.UdpNATMap, association func(*net.UDPAddr) (*udpAssociate, bool)) error {
 	// Socks Client -> [Socks Server] -> UDP Server
 	// 读取Socks Client发送的封包数据，并转发给UDP Server
-	n, srcAddr, err := conn.ReadFrom(*buffer)
-	if err != nil {
-		return err
-	}
-	res, err := packet.SerializeDirectFrom[*packet.SocksUDPPacket]((*buffer)[:n])
+	dest, payload, err := packet.ReadUDPPacket(p.Data)
 	if err != nil {
-		return err
+		return nil
 	}
-	defer res.Release()
-
-	targetConn := s.natM.Get(srcAddr.String())
+	key := sc.NewNATKey(p.Src.AddrPort(), dest)
+	targetConn := natM.Get(key)
 	if targetConn == nil {
-		var target string
-		var ok bool
-		if target, ok = <-s.targetAddrChan; !ok {
+		a, ok := association(p.Src)
+		if !ok {
 			return nil
 		}
 		// 连接到目标UDP Server
-		targetConn, err = connection.DialUDP(target)
+		targetConn, err = s.dialUDP(a.ctx, dest.String())
 		if err != nil {
 			return err
 		}
 		// Socks Client <- [Socks Server] <- UDP Server
-		s.natM.Add(srcAddr, conn, targetConn)
+		if !a.addFlow(natM, key, p.Src, p.Writer, targetConn) {
+			targetConn.Close()
+			return nil
+		}
 	}
 
 	// 向目标UDP Server发送UDP原始数据报文
-	targetConn.Write(res.UDPData)
+	targetConn.Write(payload)
 	return nil
 }
 
-func (s *Socks5Server) handleCmdUdpAssociate(rw *bufio.ReadWriter, target string, src net.Conn) error {
-	bindAddr := s.udpServer.LocalAddr()
+// association returns the association of the client on the shared relay. A new client
+// claims the first pending association of its address, the datagrams of unknown clients
+// are dropped.
+func (s *Socks5Server) association(src *net.UDPAddr) (*udpAssociate, bool) {
+	key := src.AddrPort()
+	s.udpMu.Lock()
+	defer s.udpMu.Unlock()
+	if a, ok := s.udpClients[key]; ok && a.alive() {
+		return a, true
+	}
+	// the associations of the control connections without ip address match any client
+	for _, ip := range [...]netip.Addr{key.Addr().Unmap(), {}} {
+		pending := s.udpPending[ip]
+		for i, a := range pending {
+			if !a.alive() || !a.accepts(key) {
+				continue
+			}
+			s.udpPending[ip] = append(pending[:i:i], pending[i+1:]...)
+			if len(s.udpPending[ip]) == 0 {
+				delete(s.udpPending, ip)
+			}
+			a.src = key
+			s.udpClients[key] = a
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// addAssociation adds the pending association of the control connection to the shared
+// relay, the returned function removes it when the control connection is closed
+func (s *Socks5Server) addAssociation(a *udpAssociate) func() {
+	s.udpMu.Lock()
+	s.udpPending[a.ip] = append(s.udpPending[a.ip], a)
+	s.udpMu.Unlock()
+	return func() {
+		s.udpMu.Lock()
+		defer s.udpMu.Unlock()
+		if a.src.IsValid() && s.udpClients[a.src] == a {
+			delete(s.udpClients, a.src)
+		}
+		pending := s.udpPending[a.ip]
+		for i, p := range pending {
+			if p == a {
+				pending = append(pending[:i:i], pending[i+1:]...)
+				break
+			}
+		}
+		if len(pending) == 0 {
+			delete(s.udpPending, a.ip)
+		} else {
+			s.udpPending[a.ip] = pending
+		}
+	}
+}
+
+func (s *Socks5Server) handleCmdUdpAssociate(ctx context.Context, rw *bufio.ReadWriter, target string, src net.Conn) error {
+	user := UserFromContext(ctx)
+	if !s.userUDP.acquire(user) {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.GeneralSocksServerFailure})
+		return constant.ErrLimitExceeded
+	}
+	defer s.userUDP.release(user)
+
+	done := make(chan struct{})
+	defer close(done)
+	assoc := newUdpAssociate(ctx, done, target, src)
+	defer assoc.closeFlows()
+	var udpServer *udpserver.UdpServer
+	if s.udpPorts != nil {
+		natM := sc.NewUdpNATMap(time.Second * 20)
+		defer natM.Close()
+		var err error
+		udpServer, err = s.udpPorts.Allocate(udpserver.UdpHandlerFunc(func(_ context.Context, p *udpserver.Packet) {
+			err := s.serveUDP(p, natM, func(src *net.UDPAddr) (*udpAssociate, bool) {
+				return assoc, assoc.accepts(src.AddrPort())
+			})
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				util.Logger.ErrorBy(err)
+			}
+		}))
+		if err != nil {
+			packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.GeneralSocksServerFailure})
+			return err
+		}
+		defer s.udpPorts.Release(udpServer)
+		go udpServer.Serve()
+	} else if udpServer = s.udpRelay(listenerFromContext(ctx)); udpServer == nil {
+		packet.SerializeTo(rw, &packet.SocksResponse{ReplayCode: constant.CommandNotSupported})
+		return constant.ErrUnsupportedReqCmd
+	}
+	bindAddr := udpServer.LocalAddr()
+	bindIP := s.advertiseIP(bindAddr.IP, src)
 
 	util.Logger.Infof("[udp] local: [%s] <-> remote: [%s]",
-		color.GreenString(bindAddr.String()),
+		color.GreenString(net.JoinHostPort(bindIP.String(), strconv.Itoa(bindAddr.Port))),
 		color.YellowString(target))
 
+	// the association is added before the reply, so that the first datagram isn't dropped
+	if s.udpPorts == nil {
+		defer s.addAssociation(assoc)()
+	}
 	packet.SerializeTo(rw, &packet.SocksResponse{
 		ReplayCode: constant.Succeed,
-		BindAddr:   bindAddr.IP.String(),
+		BindAddr:   bindIP.String(),
 		BindPort:   bindAddr.Port,
 	})
 
-	s.targetAddrChan <- target
-
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		src.SetReadDeadline(deadline)
+	}
 	tcpDoneChan := make(chan error)
 	go func() {
 		// 等待TCP连接关闭
@@ -71,8 +268,11 @@ func (s *Socks5Server) handleCmdUdpAssociate(rw *bufio.ReadWriter, target string
 		for {
 			_, err := src.Read(buf)
 			if err != nil {
+				var ne net.Error
 				if err == io.EOF {
 					err = nil
+				} else if hasDeadline && errors.As(err, &ne) && ne.Timeout() {
+					err = relay.ErrSessionExpired
 				}
 				tcpDoneChan <- err
 				return
@@ -82,3 +282,17 @@ func (s *Socks5Server) handleCmdUdpAssociate(rw *bufio.ReadWriter, target string
 
 	return <-tcpDoneChan
 }
+
+// advertiseIP returns the BND.ADDR for the udp relay bound on ip. The wildcard address
+// is replaced with the local address of the control connection which the client can reach.
+func (s *Socks5Server) advertiseIP(ip net.IP, src net.Conn) net.IP {
+	if config.Cfg.UDP.AdvertiseAddr != nil {
+		return config.Cfg.UDP.AdvertiseAddr
+	}
+	if ip.IsUnspecified() {
+		if addr, ok := src.LocalAddr().(*net.TCPAddr); ok {
+			return addr.IP
+		}
+	}
+	return ip
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/udpserver"
+)
+
+// udpPortAllocator allocates a dedicated udp relay port for each association
+type udpPortAllocator struct {
+	mu    sync.Mutex
+	ip    string
+	min   int
+	max   int
+	next  int
+	inUse map[int]struct{}
+}
+
+func newUdpPortAllocator(ip string, min, max int) *udpPortAllocator {
+	return &udpPortAllocator{
+		ip:    ip,
+		min:   min,
+		max:   max,
+		next:  min,
+		inUse: make(map[int]struct{}),
+	}
+}
+
+func (a *udpPortAllocator) Allocate(handler udpserver.UdpHandler) (*udpserver.UdpServer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i <= a.max-a.min; i++ {
+		port := a.next
+		if a.next++; a.next > a.max {
+			a.next = a.min
+		}
+		if _, ok := a.inUse[port]; ok {
+			continue
+		}
+		svr, err := udpserver.NewUdpServer(net.JoinHostPort(a.ip, strconv.Itoa(port)), handler)
+		if err != nil {
+			// the port may be occupied by other processes
+			continue
+		}
+		a.inUse[port] = struct{}{}
+		return svr, nil
+	}
+	return nil, constant.ErrNoAvailablePort
+}
+
+func (a *udpPortAllocator) Release(svr *udpserver.UdpServer) {
+	port := svr.LocalAddr().Port
+	svr.Close()
+	a.mu.Lock()
+	delete(a.inUse, port)
+	a.mu.Unlock()
+}
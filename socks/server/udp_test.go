@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/josexy/gsocks5/socks/sc"
+)
+
+func TestUdpAssociateCloseFlows(t *testing.T) {
+	natM := sc.NewUdpNATMap(time.Minute)
+	defer natM.Close()
+	writer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	dial := func() *net.UDPConn {
+		conn, err := net.DialUDP("udp", nil, writer.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	a := &udpAssociate{ctx: context.Background(), done: make(chan struct{})}
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	key := sc.NATKey{Src: src.AddrPort(), Dst: netip.MustParseAddrPort("192.0.2.1:53")}
+	conn := dial()
+	if !a.addFlow(natM, key, src, writer, conn) || natM.Get(key) == nil {
+		t.Fatal("flow isn't added")
+	}
+	a.closeFlows()
+	if natM.Get(key) != nil {
+		t.Fatal("flow isn't removed")
+	}
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Fatal("flow isn't closed")
+	}
+	// the flows of the ended association are refused
+	conn = dial()
+	defer conn.Close()
+	if a.addFlow(natM, key, src, writer, conn) || natM.Get(key) != nil {
+		t.Fatal("flow added after the association ended")
+	}
+}
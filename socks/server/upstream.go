@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/client"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/sc"
+)
+
+// upstream relays the requests of the local front end to the remote gsocks5 server, or the
+// requests routed to a socks5 outbound
+type upstream struct {
+	config.UpstreamConfig
+	mux *client.MuxClient
+	// associate sends the udp flows by UDP ASSOCIATE instead of the mux, which the standard
+	// socks5 servers don't support
+	associate bool
+}
+
+func newUpstream(cfg config.UpstreamConfig) *upstream {
+	if cfg.Addr == "" {
+		return nil
+	}
+	u := &upstream{UpstreamConfig: cfg, mux: client.NewMuxClient(cfg.Addr)}
+	if cfg.Username != "" {
+		u.mux.SetSocksAuth(cfg.Username, cfg.Password)
+	}
+	u.mux.SetTransport(cfg.Transport)
+	u.mux.SetWebSocket(cfg.WebSocketPath)
+	return u
+}
+
+func (u *upstream) client() *client.Socks5Client {
+	cli := client.NewSocks5Client(u.Addr)
+	if u.Username != "" {
+		cli.SetSocksAuth(u.Username, u.Password)
+	}
+	cli.SetTransport(u.Transport)
+	cli.SetWebSocket(u.WebSocketPath)
+	return cli
+}
+
+func (u *upstream) dial(ctx context.Context, target string) (net.Conn, error) {
+	if u.Mux {
+		return u.mux.Dial(ctx, target)
+	}
+	return u.client().Dial(ctx, target)
+}
+
+// dialUDP opens the udp flow over the mux, so that the packets go through the transport too,
+// or by UDP ASSOCIATE
+func (u *upstream) dialUDP(ctx context.Context, target string) (sc.PacketConn, error) {
+	var conn net.Conn
+	var err error
+	if u.associate {
+		conn, err = u.client().DialUDP(ctx, target)
+	} else {
+		conn, err = u.mux.DialUDP(ctx, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(sc.PacketConn)
+	if !ok {
+		conn.Close()
+		return nil, constant.ErrUnsupportedReqCmd
+	}
+	return pc, nil
+}
+
+func (u *upstream) close() {
+	u.mux.Close()
+}
+
+// dialUDP dials the udp destination by the outbound of the router, the upstream server or
+// directly
+func (s *Socks5Server) dialUDP(ctx context.Context, target string) (conn sc.PacketConn, err error) {
+	_, out := s.outbound(ctx, target)
+	if conn, err = out.dialUDP(ctx, target); err != nil {
+		return nil, err
+	}
+	return s.meterPacketConn(ctx, conn), nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/auth"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/sc"
+	"github.com/josexy/gsocks5/socks/user"
+	"github.com/josexy/gsocks5/util"
+)
+
+const (
+	defaultUsageSaveInterval = time.Minute
+	usersReloadInterval      = time.Second * 5
+)
+
+// userStore reloads the users file and saves the usage in the background
+type userStore struct {
+	*user.Store
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newUserStore() *userStore {
+	cfg := config.Cfg.Users
+	if cfg.File == "" {
+		return nil
+	}
+	store, err := user.Open(cfg.File, cfg.UsageFile)
+	if err != nil {
+		util.Logger.ErrorBy(err)
+		return nil
+	}
+	store.CutOnQuota = cfg.CutOnQuota
+	us := &userStore{Store: store, done: make(chan struct{})}
+	go us.run(cfg)
+	return us
+}
+
+func (us *userStore) run(cfg config.UsersConfig) {
+	interval := cfg.SaveInterval
+	if interval <= 0 {
+		interval = defaultUsageSaveInterval
+	}
+	tick := usersReloadInterval
+	if interval < tick {
+		tick = interval
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	saved := time.Now()
+	for {
+		select {
+		case <-us.done:
+			return
+		case now := <-ticker.C:
+			if reloaded, err := us.Reload(); err != nil {
+				util.Logger.ErrorBy(err)
+			} else if reloaded {
+				util.Logger.Infof("[users] %s reloaded", color.GreenString(cfg.File))
+			}
+			if now.Sub(saved) >= interval {
+				saved = now
+				if err := us.SaveUsage(); err != nil {
+					util.Logger.ErrorBy(err)
+				}
+			}
+		}
+	}
+}
+
+// close stops the background tasks and saves the usage
+func (us *userStore) close() {
+	us.closeOnce.Do(func() {
+		close(us.done)
+		if err := us.SaveUsage(); err != nil {
+			util.Logger.ErrorBy(err)
+		}
+	})
+}
+
+// authenticate checks the credentials with the user store and then with auths
+func (s *Socks5Server) authenticate(username, password string, auths []auth.Socks5Auth, ip string) error {
+	if s.users != nil {
+		addr, _ := netip.ParseAddr(ip)
+		if err := s.users.Authenticate(username, password, addr); err != constant.ErrUserNotFound {
+			return err
+		}
+	}
+	for _, auth := range auths {
+		if auth.Auth(username, password) {
+			return nil
+		}
+	}
+	return constant.ErrAuthFailure
+}
+
+// checkUser returns why the user of the session can't request the command
+func (s *Socks5Server) checkUser(ctx context.Context, cmd constant.Socks5Cmd) error {
+	if s.users == nil {
+		return nil
+	}
+	return s.users.Check(UserFromContext(ctx), cmd)
+}
+
+// meterConn counts the traffic of the outbound connection for the user of the session
+func (s *Socks5Server) meterConn(ctx context.Context, conn net.Conn) net.Conn {
+	if s.users == nil {
+		return conn
+	}
+	return s.users.Conn(UserFromContext(ctx), conn)
+}
+
+func (s *Socks5Server) meterPacketConn(ctx context.Context, conn sc.PacketConn) sc.PacketConn {
+	if s.users == nil {
+		return conn
+	}
+	return s.users.PacketConn(UserFromContext(ctx), conn)
+}
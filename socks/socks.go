@@ -1,6 +1,7 @@
 package socks
 
 import (
+	"github.com/josexy/gsocks5/config"
 	"github.com/josexy/gsocks5/socks/client"
 	"github.com/josexy/gsocks5/socks/server"
 )
@@ -9,6 +10,6 @@ func NewSocks5Client(addr string) *client.Socks5Client {
 	return client.NewSocks5Client(addr)
 }
 
-func NewSocks5Server(addr string) *server.Socks5Server {
-	return server.NewSocks5Server(addr)
+func NewSocks5Server(addr string, listeners ...config.ListenerConfig) *server.Socks5Server {
+	return server.NewSocks5Server(addr, listeners...)
 }
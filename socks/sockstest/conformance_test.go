@@ -0,0 +1,479 @@
+package sockstest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/client"
+	"github.com/josexy/gsocks5/socks/constant"
+	"golang.org/x/net/proxy"
+)
+
+// the conformance tests check the interoperability with golang.org/x/net/proxy and the
+// exact bytes on the wire of RFC 1928 and RFC 1929
+
+// h decodes the hex bytes separated by spaces, and the quoted strings such as 'test'
+func h(s string) []byte {
+	var b []byte
+	for _, field := range strings.Fields(s) {
+		if strings.HasPrefix(field, "'") {
+			b = append(b, strings.Trim(field, "'")...)
+			continue
+		}
+		v, err := hex.DecodeString(field)
+		if err != nil {
+			panic(err)
+		}
+		b = append(b, v...)
+	}
+	return b
+}
+
+// addrBytes encodes the ip and the port of the address as DST.ADDR and DST.PORT
+func addrBytes(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP.To4(), a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP.To4(), a.Port
+	}
+	return binary.BigEndian.AppendUint16(append([]byte(nil), ip...), uint16(port))
+}
+
+// recordTCP starts an echo server which reports the remote address of each connection,
+// which is BND.ADDR and BND.PORT of the server reply
+func recordTCP(t *testing.T) (net.Addr, <-chan net.Addr) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	remotes := make(chan net.Addr, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			remotes <- conn.RemoteAddr()
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr(), remotes
+}
+
+// wire is a message of the transcript, sent by the client or the server. data is called
+// when the message is sent or read, eof expects the connection closed by the server.
+type wire struct {
+	client bool
+	data   func() []byte
+	eof    bool
+}
+
+func c(s string) wire { return wire{client: true, data: func() []byte { return h(s) }} }
+
+func s(s string) wire { return wire{data: func() []byte { return h(s) }} }
+
+var eof = wire{eof: true}
+
+// replay plays the client of the transcript against the server, and the messages of the
+// server must be read exactly
+func replay(t *testing.T, addr string, transcript []wire) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i, w := range transcript {
+		switch {
+		case w.eof:
+			if n, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Fatalf("#%d: read %d bytes, want EOF", i, n)
+			}
+		case w.client:
+			if _, err = conn.Write(w.data()); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		default:
+			want := w.data()
+			got := make([]byte, len(want))
+			if _, err = io.ReadFull(conn, got); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("#%d: got % x, want % x", i, got, want)
+			}
+		}
+	}
+}
+
+func TestTranscripts(t *testing.T) {
+	target, remotes := recordTCP(t)
+	dst := hex.EncodeToString(addrBytes(target))
+	port := dst[8:]
+	// the reply of CONNECT carries the local address of the outbound connection
+	reply := wire{data: func() []byte {
+		return append(h("05 00 00 01"), addrBytes(<-remotes)...)
+	}}
+
+	for _, tc := range []struct {
+		name       string
+		opts       []Option
+		transcript []wire
+	}{
+		{"connect ipv4", nil, []wire{
+			c("05 01 00"), s("05 00"),
+			c("05 01 00 01 " + dst), reply,
+			c("'ping'"), s("'ping'"),
+		}},
+		{"connect domain", nil, []wire{
+			c("05 01 00"), s("05 00"),
+			c("05 01 00 03 09 'localhost' " + port), reply,
+			c("'ping'"), s("'ping'"),
+		}},
+		{"username", []Option{WithAuth("test", "12345678")}, []wire{
+			c("05 02 00 02"), s("05 02"),
+			c("01 04 'test' 08 '12345678'"), s("01 00"),
+			c("05 01 00 01 " + dst), reply,
+			c("'ping'"), s("'ping'"),
+		}},
+		{"username failure", []Option{WithAuth("test", "12345678")}, []wire{
+			c("05 01 02"), s("05 02"),
+			c("01 04 'test' 03 'bad'"), s("01 01"),
+			eof,
+		}},
+		{"no acceptable methods", []Option{WithAuth("test", "12345678")}, []wire{
+			c("05 01 00"), s("05 ff"),
+			eof,
+		}},
+		{"command not supported", nil, []wire{
+			c("05 01 00"), s("05 00"),
+			c("05 02 00 01 " + dst), s("05 07 00 01 00 00 00 00 00 00"),
+			eof,
+		}},
+		{"address type not supported", nil, []wire{
+			c("05 01 00"), s("05 00"),
+			c("05 01 00 05 " + dst), s("05 08 00 01 00 00 00 00 00 00"),
+			eof,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := NewServer(t, tc.opts...)
+			replay(t, srv.Addr, tc.transcript)
+		})
+	}
+}
+
+func TestTranscriptPipelined(t *testing.T) {
+	target, remotes := recordTCP(t)
+	dst := hex.EncodeToString(addrBytes(target))
+	srv := NewServer(t, WithAuth("test", "12345678"))
+	// the client sends the negotiation, the authentication, the request and the data
+	// at once without waiting for the replies
+	replay(t, srv.Addr, []wire{
+		c("05 01 02 01 04 'test' 08 '12345678' 05 01 00 01 " + dst + " 'ping'"),
+		s("05 02 01 00"),
+		{data: func() []byte { return append(h("05 00 00 01"), addrBytes(<-remotes)...) }},
+		s("'ping'"),
+	})
+}
+
+func TestTranscriptRejected(t *testing.T) {
+	srv := NewServer(t, func(cfg *config.AppConfig) { cfg.Limit.MaxConns = 1 })
+	// the first connection takes the only slot
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(h("05 01 00"))
+	if _, err = io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	replay(t, srv.Addr, []wire{
+		c("05 01 00"), s("05 00"),
+		c("05 01 00 01 7f 00 00 01 00 01"), s("05 01 00 01 00 00 00 00 00 00"),
+		eof,
+	})
+	// the method which isn't offered is never chosen
+	replay(t, srv.Addr, []wire{
+		c("05 01 02"), s("05 ff"),
+		eof,
+	})
+}
+
+func TestTranscriptUDPAssociate(t *testing.T) {
+	srv := NewServer(t)
+	target := NewEchoUDP(t)
+
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	conn.Write(h("05 01 00"))
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil || !bytes.Equal(buf[:2], h("05 00")) {
+		t.Fatalf("negotiate: % x %v", buf[:2], err)
+	}
+	conn.Write(h("05 03 00 01 00 00 00 00 00 00"))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	// BND.ADDR is the loopback address of the relay
+	if !bytes.Equal(buf[:8], h("05 00 00 01 7f 00 00 01")) {
+		t.Fatalf("reply: % x", buf)
+	}
+	relay := &net.UDPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:]))}
+	pc, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the reply carries the address of the target in the same header
+	datagram := append(append(h("00 00 00 01"), addrBytes(target)...), "ping"...)
+	pc.Write(datagram)
+	got := make([]byte, 64)
+	n, err := pc.Read(got)
+	if err != nil || !bytes.Equal(got[:n], datagram) {
+		t.Fatalf("got % x %v, want % x", got[:n], err, datagram)
+	}
+	// the fragments are dropped
+	pc.Write(append(h("00 00 01 01"), datagram[4:]...))
+	pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err = pc.Read(got); err == nil {
+		t.Fatalf("fragment replied: % x", got[:n])
+	}
+}
+
+func TestTranscriptUDPAssociateStray(t *testing.T) {
+	srv := NewServer(t)
+	target := NewEchoUDP(t)
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	conn.Write(h("05 01 00"))
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil || !bytes.Equal(buf[:2], h("05 00")) {
+		t.Fatalf("negotiate: % x %v", buf[:2], err)
+	}
+	// DST.ADDR and DST.PORT are the address the client sends the datagrams from
+	conn.Write(append(h("05 03 00 01"), addrBytes(pc.LocalAddr())...))
+	if _, err = io.ReadFull(conn, buf); err != nil || buf[1] != 0 {
+		t.Fatalf("reply: % x %v", buf, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:]))}
+	datagram := append(append(h("00 00 00 01"), addrBytes(target)...), "ping"...)
+
+	// the datagrams of the other clients neither take the association nor are relayed
+	for i := 0; i < 64; i++ {
+		stray, err := net.DialUDP("udp", nil, relay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stray.Close()
+		stray.Write(datagram)
+		stray.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if n, err := stray.Read(buf); err == nil {
+			t.Fatalf("stray datagram relayed: % x", buf[:n])
+		}
+	}
+
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	pc.WriteTo(datagram, relay)
+	got := make([]byte, 64)
+	n, err := pc.Read(got)
+	if err != nil || !bytes.Equal(got[:n], datagram) {
+		t.Fatalf("got % x %v, want % x", got[:n], err, datagram)
+	}
+}
+
+func TestXNetProxy(t *testing.T) {
+	target := NewEchoTCP(t)
+	_, port, _ := net.SplitHostPort(target.String())
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		auth *proxy.Auth
+	}{
+		{"no auth", nil, nil},
+		{"username", []Option{WithAuth("test", "12345678")}, &proxy.Auth{User: "test", Password: "12345678"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := NewServer(t, tc.opts...)
+			d, err := proxy.SOCKS5("tcp", srv.Addr, tc.auth, proxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, addr := range []string{target.String(), "localhost:" + port} {
+				conn, err := d.(proxy.ContextDialer).DialContext(context.Background(), "tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				echo(t, conn, "hello "+addr)
+				conn.Close()
+			}
+		})
+	}
+
+	srv := NewServer(t, WithAuth("test", "12345678"))
+	for _, auth := range []*proxy.Auth{nil, {User: "test", Password: "bad"}} {
+		d, _ := proxy.SOCKS5("tcp", srv.Addr, auth, proxy.Direct)
+		if conn, err := d.Dial("tcp", target.String()); err == nil {
+			conn.Close()
+			t.Fatalf("auth %v: connected", auth)
+		}
+	}
+}
+
+// scriptedServer serves one connection of the client. It reads the messages of the client
+// exactly and replies, like the server test helpers of x/net which are internal, and then
+// echoes the data.
+func scriptedServer(t *testing.T, transcript []wire) (string, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, w := range transcript {
+			if !w.client {
+				conn.Write(w.data())
+				continue
+			}
+			want := w.data()
+			got := make([]byte, len(want))
+			if _, err = io.ReadFull(conn, got); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, want) {
+				errs <- &mismatchError{got, want}
+				return
+			}
+		}
+		errs <- nil
+		io.Copy(conn, conn)
+	}()
+	return ln.Addr().String(), errs
+}
+
+type mismatchError struct {
+	got, want []byte
+}
+
+func (e *mismatchError) Error() string {
+	return "got " + hex.EncodeToString(e.got) + ", want " + hex.EncodeToString(e.want)
+}
+
+func TestClientTranscripts(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		username   string
+		fastOpen   bool
+		target     string
+		transcript []wire
+		err        error
+	}{
+		{"connect ipv4", "", false, "10.0.0.1:8080", []wire{
+			c("05 02 00 02"), s("05 00"),
+			c("05 01 00 01 0a 00 00 01 1f 90"), s("05 00 00 01 0a 00 00 02 30 39"),
+		}, nil},
+		{"connect ipv6", "", false, "[2001:db8::1]:443", []wire{
+			c("05 02 00 02"), s("05 00"),
+			c("05 01 00 04 20 01 0d b8 00 00 00 00 00 00 00 00 00 00 00 01 01 bb"),
+			s("05 00 00 04 20 01 0d b8 00 00 00 00 00 00 00 00 00 00 00 02 30 39"),
+		}, nil},
+		{"username domain", "test", false, "example.com:443", []wire{
+			c("05 02 00 02"), s("05 02"),
+			c("01 04 'test' 08 '12345678'"), s("01 00"),
+			c("05 01 00 03 0b 'example.com' 01 bb"), s("05 00 00 03 09 'localhost' 30 39"),
+		}, nil},
+		{"username failure", "test", false, "10.0.0.1:8080", []wire{
+			c("05 02 00 02"), s("05 02"),
+			c("01 04 'test' 08 '12345678'"), s("01 01"),
+		}, constant.ErrAuthFailure},
+		{"no acceptable methods", "", false, "10.0.0.1:8080", []wire{
+			c("05 02 00 02"), s("05 ff"),
+		}, constant.ErrUnsupportedMethod},
+		{"connection refused", "", false, "10.0.0.1:8080", []wire{
+			c("05 02 00 02"), s("05 00"),
+			c("05 01 00 01 0a 00 00 01 1f 90"), s("05 05 00 01 00 00 00 00 00 00"),
+		}, constant.ErrRequestFailure},
+		// the data sent by the target right after the reply is read by the connection
+		{"fast open", "", true, "10.0.0.1:8080", []wire{
+			c("05 01 00 05 01 00 01 0a 00 00 01 1f 90"),
+			s("05 00 05 00 00 01 0a 00 00 02 30 39 'ping'"),
+		}, nil},
+		{"fast open username", "test", true, "example.com:443", []wire{
+			c("05 01 02 01 04 'test' 08 '12345678' 05 01 00 03 0b 'example.com' 01 bb"),
+			s("05 02 01 00 05 00 00 01 0a 00 00 02 30 39"),
+		}, nil},
+		{"fast open username failure", "test", true, "example.com:443", []wire{
+			c("05 01 02 01 04 'test' 08 '12345678' 05 01 00 03 0b 'example.com' 01 bb"),
+			s("05 02 01 01"),
+		}, constant.ErrAuthFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, errs := scriptedServer(t, tc.transcript)
+			cli := client.NewSocks5Client(addr)
+			if tc.username != "" {
+				cli.SetSocksAuth(tc.username, "12345678")
+			}
+			cli.SetFastOpen(tc.fastOpen)
+			defer cli.Close()
+			conn, err := cli.Dial(context.Background(), tc.target)
+			if err != tc.err {
+				t.Fatalf("dial: got %v, want %v", err, tc.err)
+			}
+			if tc.err != nil {
+				return
+			}
+			if err = <-errs; err != nil {
+				t.Fatal(err)
+			}
+			if conn.RemoteAddr().String() != tc.target {
+				t.Fatalf("remote address: %s", conn.RemoteAddr())
+			}
+			echo(t, conn, "ping")
+		})
+	}
+}
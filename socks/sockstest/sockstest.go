@@ -0,0 +1,179 @@
+// Package sockstest runs a socks server, echo targets and clients in process for the tests
+// of the server, the client and the projects embedding them.
+//
+// The server reads the global config.Cfg, which is replaced by the config of the server
+// while it runs, so the tests using the harness must not run in parallel.
+package sockstest
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/auth"
+	"github.com/josexy/gsocks5/socks/client"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/server"
+)
+
+// Option modifies the config of the server, such as the rules, the limits and the dns
+type Option func(*config.AppConfig)
+
+// WithAuth requires the username/password authentication with the credentials
+func WithAuth(username, password string) Option {
+	return func(cfg *config.AppConfig) {
+		cfg.SocksMethod = []constant.Socks5Method{constant.MethodUsernamePassword}
+		cfg.Auth = append(cfg.Auth, auth.NewSocksAuth(username, password))
+	}
+}
+
+// WithUsers requires the username/password authentication with the users of the store
+// in file, which is written before the server starts
+func WithUsers(file string) Option {
+	return func(cfg *config.AppConfig) {
+		cfg.SocksMethod = []constant.Socks5Method{constant.MethodUsernamePassword}
+		cfg.Users.File = file
+		cfg.Users.UsageFile = file + ".usage"
+	}
+}
+
+// WithRoute routes the destinations by the rules and the outbounds of rc
+func WithRoute(rc config.RouteConfig) Option {
+	return func(cfg *config.AppConfig) {
+		cfg.Route = rc
+	}
+}
+
+// Server is a socks server listening on an ephemeral port of the loopback address
+type Server struct {
+	*server.Socks5Server
+	// Addr is the tcp address of the server
+	Addr string
+	// Auth is the first credentials of the server used by Client, empty if no
+	// authentication required
+	Auth auth.Socks5Auth
+
+	closeOnce sync.Once
+	done      chan error
+}
+
+// NewServer starts a server with the config modified by opts, the server is closed and the
+// config is restored when the test ends
+func NewServer(tb testing.TB, opts ...Option) *Server {
+	tb.Helper()
+	cfg := new(config.AppConfig)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	old := config.Cfg
+	config.Cfg = cfg
+
+	srv := &Server{
+		Socks5Server: server.NewSocks5Server("127.0.0.1:0"),
+		done:         make(chan error, 1),
+	}
+	if err := srv.Listen(); err != nil {
+		config.Cfg = old
+		tb.Fatal(err)
+	}
+	srv.Addr = srv.Socks5Server.Addr().String()
+	if len(cfg.SocksMethod) > 0 && cfg.SocksMethod[0] == constant.MethodUsernamePassword && len(cfg.Auth) > 0 {
+		srv.Auth = cfg.Auth[0]
+	}
+	go func() { srv.done <- srv.Start() }()
+	tb.Cleanup(func() {
+		srv.Close()
+		config.Cfg = old
+	})
+	return srv
+}
+
+// Close closes the server and waits for it to stop
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.Socks5Server.Close()
+		<-s.done
+	})
+	return err
+}
+
+// Client returns a client of the server with the credentials of the server, the client
+// is closed when the test ends
+func (s *Server) Client(tb testing.TB) *client.Socks5Client {
+	return s.ClientWithAuth(tb, s.Auth.Username, s.Auth.Password)
+}
+
+// ClientWithAuth returns a client of the server with the credentials, the client doesn't
+// authenticate if username is empty
+func (s *Server) ClientWithAuth(tb testing.TB, username, password string) *client.Socks5Client {
+	cli := client.NewSocks5Client(s.Addr)
+	if username != "" {
+		cli.SetSocksAuth(username, password)
+	}
+	tb.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+// NewEchoTCP starts a tcp server which echoes the data of each connection, it's closed
+// when the test ends
+func NewEchoTCP(tb testing.TB) net.Addr {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns[conn] = struct{}{}
+			mu.Unlock()
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+			}()
+		}
+	}()
+	tb.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+	return ln.Addr()
+}
+
+// NewEchoUDP starts a udp server which echoes each datagram to its source, it's closed
+// when the test ends
+func NewEchoUDP(tb testing.TB) net.Addr {
+	tb.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, constant.MaxUdpBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	tb.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr()
+}
@@ -0,0 +1,264 @@
+package sockstest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josexy/gsocks5/config"
+	"github.com/josexy/gsocks5/socks/client"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/route"
+	"github.com/josexy/gsocks5/socks/user"
+)
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("echo: got %q %v, want %q", buf, err, msg)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	srv := NewServer(t)
+	target := NewEchoTCP(t)
+
+	conn, err := srv.Client(t).Dial(context.Background(), target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	echo(t, conn, string(bytes.Repeat([]byte("x"), 64*1024)))
+}
+
+func TestUDPAssociate(t *testing.T) {
+	srv := NewServer(t)
+	target := NewEchoUDP(t)
+
+	conn, err := srv.Client(t).DialUDP(context.Background(), target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		echo(t, conn, fmt.Sprintf("datagram %d", i))
+	}
+
+	pc, err := srv.Client(t).ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = pc.WriteTo([]byte("ping"), target); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" || from.String() != target.String() {
+		t.Fatalf("got %q from %v %v", buf[:n], from, err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	srv := NewServer(t, WithAuth("test", "12345678"))
+	target := NewEchoTCP(t)
+
+	conn, err := srv.Client(t).Dial(context.Background(), target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+
+	_, err = srv.ClientWithAuth(t, "test", "bad").Dial(context.Background(), target.String())
+	if err != constant.ErrAuthFailure {
+		t.Fatalf("bad password: %v", err)
+	}
+	if _, err = srv.ClientWithAuth(t, "", "").Dial(context.Background(), target.String()); err == nil {
+		t.Fatal("no authentication: connected")
+	}
+}
+
+func TestFastOpen(t *testing.T) {
+	srv := NewServer(t, WithAuth("test", "12345678"))
+	target := NewEchoTCP(t)
+
+	cli := srv.Client(t)
+	cli.SetFastOpen(true)
+	conn, err := cli.Dial(context.Background(), target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+
+	cli = srv.ClientWithAuth(t, "test", "bad")
+	cli.SetFastOpen(true)
+	if _, err = cli.Dial(context.Background(), target.String()); err != constant.ErrAuthFailure {
+		t.Fatalf("bad password: %v", err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.yaml")
+	store, err := user.Open(file, file+".usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := user.HashPassword("12345678")
+	store.Put(user.User{Name: "test", Password: hash, Commands: []string{user.CmdConnect}, MonthlyQuota: 1000})
+	srv := NewServer(t, WithUsers(file))
+	target := NewEchoTCP(t)
+
+	if _, err = srv.ClientWithAuth(t, "test", "12345678").DialUDP(context.Background(), target.String()); err != constant.ErrRequestFailure {
+		t.Fatalf("udp not allowed: %v", err)
+	}
+	conn, err := srv.ClientWithAuth(t, "test", "12345678").Dial(context.Background(), target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, string(bytes.Repeat([]byte("x"), 600)))
+	// the quota is exceeded by the traffic of both directions
+	if _, err = srv.ClientWithAuth(t, "test", "12345678").Dial(context.Background(), target.String()); err != constant.ErrAuthFailure {
+		t.Fatalf("quota exceeded: %v", err)
+	}
+}
+
+// forward forwards the connections accepted by ln to addr
+func forward(ln net.Listener, addr string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			dest, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer dest.Close()
+			go io.Copy(dest, conn)
+			io.Copy(conn, dest)
+		}()
+	}
+}
+
+func TestRoute(t *testing.T) {
+	target, rejected, down := NewEchoTCP(t), NewEchoTCP(t), NewEchoTCP(t)
+	port := func(addr net.Addr) int { return addr.(*net.TCPAddr).Port }
+	// the harness servers share the config, so the server chains to itself as bob
+	self, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer self.Close()
+	srv := NewServer(t, WithAuth("alice", "12345678"), WithAuth("bob", "12345678"), WithRoute(config.RouteConfig{
+		Outbounds: []config.RouteOutbound{
+			{Name: "dead", Type: config.OutboundSocks5, Upstream: config.UpstreamConfig{Addr: NewEchoTCP(t).String()}},
+			{Name: "self", Type: config.OutboundSocks5, Upstream: config.UpstreamConfig{
+				Addr: self.Addr().String(), Username: "bob", Password: "12345678"}},
+			{Name: "auto", Type: config.OutboundGroup, Outbounds: []string{"dead", "self"}},
+			{Name: "down", Type: config.OutboundGroup, Outbounds: []string{"dead"}},
+		},
+		Rules: []route.Rule{
+			{Ports: []route.PortRange{{Min: port(rejected), Max: port(rejected)}}, Outbound: route.Reject},
+			{Ports: []route.PortRange{{Min: port(down), Max: port(down)}}, Outbound: "down"},
+			{Users: []string{"bob"}, Outbound: route.Direct},
+		},
+		Final: "auto",
+	}))
+	go forward(self, srv.Addr)
+	cli := func() *client.Socks5Client { return srv.Client(t) }
+
+	if _, err = cli().Dial(context.Background(), rejected.String()); err != constant.ErrRequestFailure {
+		t.Fatalf("rejected: %v", err)
+	}
+	// the destinations never go direct when the outbounds fail
+	if _, err = cli().Dial(context.Background(), down.String()); err == nil {
+		t.Fatal("connected without the outbound")
+	}
+	// the dead member fails over to the next one
+	conn, err := cli().Dial(context.Background(), target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	// the udp flows are carried by UDP ASSOCIATE of the socks5 outbound
+	if conn, err = cli().DialUDP(context.Background(), NewEchoUDP(t).String()); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "datagram")
+}
+
+func TestConcurrentClients(t *testing.T) {
+	srv := NewServer(t)
+	tcpTarget, udpTarget := NewEchoTCP(t), NewEchoUDP(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			network, target := "tcp", tcpTarget
+			if i%2 == 1 {
+				network, target = "udp", udpTarget
+			}
+			cli := srv.Client(t)
+			var conn net.Conn
+			var err error
+			if network == "tcp" {
+				conn, err = cli.Dial(context.Background(), target.String())
+			} else {
+				conn, err = cli.DialUDP(context.Background(), target.String())
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			msg := fmt.Sprintf("%s client %d", network, i)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte(msg))
+			buf := make([]byte, len(msg))
+			if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+				errs <- fmt.Errorf("%s: got %q %v", msg, buf, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv := NewServer(t)
+	target := NewEchoTCP(t)
+
+	conn, err := srv.Client(t).Dial(context.Background(), target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	if err = srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the sessions are closed with the server
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read after the server closed")
+	}
+	if _, err = srv.Client(t).Dial(context.Background(), target.String()); err == nil {
+		t.Fatal("connected after the server closed")
+	}
+}
@@ -0,0 +1,141 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/josexy/gsocks5/socks/admin"
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+// Info is a user of the admin API with the usage of this month, the password is never
+// returned
+type Info struct {
+	User
+	Usage Usage `json:"usage"`
+}
+
+// Handler serves the users of the store on the admin API. The password of PUT is the plain text password, an empty password
+// keeps the password of the existing user.
+//
+//	GET    /users               the users
+//	GET    /users/{name}        the user
+//	PUT    /users/{name}        adds or replaces the user
+//	DELETE /users/{name}        removes the user
+//	POST   /users/{name}/reset  resets the usage of this month
+func Handler(s *Store) http.Handler {
+	return &adminHandler{store: s}
+}
+
+type adminHandler struct {
+	store *Store
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "users" {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		infos := []Info{}
+		for _, u := range h.store.List() {
+			infos = append(infos, h.info(u))
+		}
+		admin.WriteJSON(w, http.StatusOK, infos)
+		return
+	}
+	name, ok := strings.CutPrefix(path, "users/")
+	if !ok || name == "" {
+		admin.WriteError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if name, ok = strings.CutSuffix(name, "/reset"); ok {
+		if r.Method != http.MethodPost {
+			admin.WriteError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		h.reset(w, name)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		u, ok := h.store.Get(name)
+		if !ok {
+			admin.WriteError(w, http.StatusNotFound, constant.ErrUserNotFound)
+			return
+		}
+		admin.WriteJSON(w, http.StatusOK, h.info(u))
+	case http.MethodPut:
+		h.put(w, r, name)
+	case http.MethodDelete:
+		if err := h.store.Delete(name); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (h *adminHandler) info(u User) Info {
+	u.Password = ""
+	return Info{User: u, Usage: h.store.Usage(u.Name)}
+}
+
+func (h *adminHandler) put(w http.ResponseWriter, r *http.Request, name string) {
+	var u User
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&u); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	u.Name = name
+	old, exists := h.store.Get(name)
+	switch {
+	case u.Password != "":
+		hash, err := HashPassword(u.Password)
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		u.Password = hash
+	case exists:
+		u.Password = old.Password
+	default:
+		admin.WriteError(w, http.StatusBadRequest, errors.New("empty password"))
+		return
+	}
+	if err := u.Validate(); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.store.Put(u); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+	admin.WriteJSON(w, status, h.info(u))
+}
+
+func (h *adminHandler) reset(w http.ResponseWriter, name string) {
+	if err := h.store.ResetUsage(name); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	u, _ := h.store.Get(name)
+	admin.WriteJSON(w, http.StatusOK, h.info(u))
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	if err == constant.ErrUserNotFound {
+		admin.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+	admin.WriteError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,74 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/josexy/gsocks5/socks/admin"
+)
+
+func TestHandler(t *testing.T) {
+	s := newTestStore(t)
+	a := admin.NewServer("", "secret", 0)
+	a.Handle("/users", Handler(s))
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	do := func(method, path, token, body string) (*http.Response, Info) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info Info
+		json.NewDecoder(resp.Body).Decode(&info)
+		return resp, info
+	}
+
+	if resp, _ := do(http.MethodGet, "/users", "bad", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad token: %s", resp.Status)
+	}
+	if resp, _ := do(http.MethodPut, "/users/alice", "secret", `{"commands":["connect"]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("no password: %s", resp.Status)
+	}
+	if resp, _ := do(http.MethodPut, "/users/alice", "secret", `{"password":"a","commands":["bind"]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid command: %s", resp.Status)
+	}
+	resp, info := do(http.MethodPut, "/users/alice", "secret", `{"password":"a","cidrs":["127.0.0.0/8"],"monthly_quota":1024}`)
+	if resp.StatusCode != http.StatusCreated || info.Name != "alice" || info.Password != "" || info.MonthlyQuota != 1024 {
+		t.Fatalf("create: %s %+v", resp.Status, info)
+	}
+	// the password is kept
+	if resp, _ = do(http.MethodPut, "/users/alice", "secret", `{"disabled":true}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("update: %s", resp.Status)
+	}
+	if u, _ := s.Get("alice"); !u.Disabled || !verifyPassword(u.Password, "a") || len(u.CIDRs) != 0 {
+		t.Fatalf("updated: %+v", u)
+	}
+	if err := s.Authenticate("alice", "a", netip.Addr{}); err == nil {
+		t.Fatal("disabled user authenticated")
+	}
+
+	s.accounts["alice"].add(10, 20)
+	if _, info = do(http.MethodGet, "/users/alice", "secret", ""); info.Usage.Total() != 30 {
+		t.Fatalf("usage: %+v", info.Usage)
+	}
+	if _, info = do(http.MethodPost, "/users/alice/reset", "secret", ""); info.Usage.Total() != 0 {
+		t.Fatalf("reset: %+v", info.Usage)
+	}
+	if resp, _ = do(http.MethodDelete, "/users/alice", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: %s", resp.Status)
+	}
+	if resp, _ = do(http.MethodGet, "/users/alice", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("deleted: %s", resp.Status)
+	}
+}
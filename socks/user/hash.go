@@ -0,0 +1,102 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 100000
+	hashSaltLen    = 16
+	// maxHashIterations bounds the work of verifying a hash of the users file
+	maxHashIterations = 10 * hashIterations
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// HashPassword hashes the password with PBKDF2-HMAC-SHA256 and a random salt, the hash is
+// "pbkdf2-sha256$<iterations>$<salt>$<key>" with the salt and the key in unpadded base64
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, hashIterations, sha256.Size)
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func parseHash(hash string) (iter int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return 0, nil, nil, errInvalidHash
+	}
+	if iter, err = strconv.Atoi(parts[1]); err != nil || iter <= 0 || iter > maxHashIterations {
+		return 0, nil, nil, errInvalidHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, errInvalidHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return 0, nil, nil, errInvalidHash
+	}
+	return
+}
+
+var (
+	dummyOnce sync.Once
+	dummy     string
+)
+
+// dummyHash is verified for the unknown users, so that they take as long as the known ones
+func dummyHash() string {
+	dummyOnce.Do(func() {
+		dummy, _ = HashPassword("")
+	})
+	return dummy
+}
+
+// verifyPassword compares the password with the hash in constant time
+func verifyPassword(hash, password string) bool {
+	iter, salt, key, err := parseHash(hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iter, len(key)), key) == 1
+}
+
+// pbkdf2 derives the key of RFC 8018 with HMAC-SHA256
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen+sha256.Size)
+	u := make([]byte, sha256.Size)
+	t := make([]byte, sha256.Size)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
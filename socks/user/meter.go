@@ -0,0 +1,344 @@
+package user
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/relay"
+	"github.com/josexy/gsocks5/socks/sc"
+)
+
+// minSlice is the min bytes of a slice, the data is limited in slices of about 100ms, so
+// that a wait never takes long
+const minSlice = 512
+
+// bucket is a token bucket of bytes, the burst is the bytes of one second
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// take takes n bytes and returns how long to wait until they are available
+func (b *bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// slice returns the bytes transferred between two waits
+func (b *bucket) slice() int {
+	if n := int(b.rate / 10); n > minSlice {
+		return n
+	}
+	return minSlice
+}
+
+// allow takes n bytes if any byte is available, the datagrams larger than the rate
+// still pass one by one
+func (b *bucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// rebucket returns b if its rate is unchanged, nil means no limit
+func rebucket(b *bucket, rate int64) *bucket {
+	switch {
+	case rate <= 0:
+		return nil
+	case b != nil && b.rate == float64(rate):
+		return b
+	}
+	return newBucket(rate)
+}
+
+// account counts the usage of a user, the quota and the buckets follow the current
+// definition of the user. The live connections of cut are closed once the quota is
+// exceeded.
+type account struct {
+	mu    sync.Mutex
+	usage Usage
+	quota int64
+	up    *bucket
+	down  *bucket
+	dirty bool
+	cut   map[io.Closer]struct{}
+}
+
+func (a *account) configure(u *User) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.quota = u.MonthlyQuota
+	a.up = rebucket(a.up, u.UploadRate)
+	a.down = rebucket(a.down, u.DownloadRate)
+	a.cutExceeded()
+}
+
+// track closes c once the quota is exceeded, untrack stops it
+func (a *account) track(c io.Closer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cut == nil {
+		a.cut = make(map[io.Closer]struct{})
+	}
+	a.cut[c] = struct{}{}
+}
+
+func (a *account) untrack(c io.Closer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.cut, c)
+}
+
+// cutExceeded closes the tracked connections if the quota is exceeded, a.mu is held
+func (a *account) cutExceeded() {
+	if len(a.cut) == 0 || a.quota <= 0 || a.current().Total() < a.quota {
+		return
+	}
+	for c := range a.cut {
+		c.Close()
+		delete(a.cut, c)
+	}
+}
+
+// current returns the usage of this month, a new month starts from zero
+func (a *account) current() *Usage {
+	if m := month(time.Now()); a.usage.Month != m {
+		a.usage = Usage{Month: m}
+		a.dirty = true
+	}
+	return &a.usage
+}
+
+func (a *account) add(up, down int64) {
+	if up == 0 && down == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.current()
+	u.Upload += up
+	u.Download += down
+	a.dirty = true
+	a.cutExceeded()
+}
+
+func (a *account) exceeded() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.quota > 0 && a.current().Total() >= a.quota
+}
+
+func (a *account) snapshot() Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return *a.current()
+}
+
+func (a *account) buckets() (up, down *bucket) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.up, a.down
+}
+
+// conn meters the outbound connection of a user, the data written to it is the upload
+// and the data read from it is the download. It hides the tcp connection, so the relay
+// copies the data instead of splicing it. The time waiting for the rates extends the
+// deadlines, so that a slow user doesn't look idle.
+type conn struct {
+	net.Conn
+	acct *account
+	cut  bool
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.cut && c.acct.exceeded() {
+		return 0, constant.ErrQuotaExceeded
+	}
+	_, down := c.acct.buckets()
+	if down != nil && len(b) > down.slice() {
+		b = b[:down.slice()]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.acct.add(0, int64(n))
+		if down != nil {
+			c.wait(down.take(n), false)
+		}
+	}
+	if err != nil && c.cut && c.acct.exceeded() {
+		// closed by the account
+		err = constant.ErrQuotaExceeded
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if c.cut && c.acct.exceeded() {
+			return n, constant.ErrQuotaExceeded
+		}
+		p := b
+		if up, _ := c.acct.buckets(); up != nil {
+			if len(p) > up.slice() {
+				p = p[:up.slice()]
+			}
+			c.wait(up.take(len(p)), true)
+		}
+		m, err := c.Conn.Write(p)
+		c.acct.add(int64(m), 0)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// wait sleeps for d and extends the read or the write deadline by d
+func (c *conn) wait(d time.Duration, write bool) {
+	if d <= 0 {
+		return
+	}
+	time.Sleep(d)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if write && !c.writeDeadline.IsZero() {
+		c.writeDeadline = c.writeDeadline.Add(d)
+		c.Conn.SetWriteDeadline(c.writeDeadline)
+	} else if !write && !c.readDeadline.IsZero() {
+		c.readDeadline = c.readDeadline.Add(d)
+		c.Conn.SetReadDeadline(c.readDeadline)
+	}
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *conn) Close() error {
+	if c.cut {
+		c.acct.untrack(c.Conn)
+	}
+	return c.Conn.Close()
+}
+
+func (c *conn) CloseWrite() error {
+	return relay.CloseWrite(c.Conn)
+}
+
+// packetConn meters the outbound udp flow of a user, the datagrams over the rates are
+// dropped instead of delaying the other flows of the relay
+type packetConn struct {
+	sc.PacketConn
+	acct *account
+	cut  bool
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	if c.cut && c.acct.exceeded() {
+		return 0, constant.ErrQuotaExceeded
+	}
+	if up, _ := c.acct.buckets(); up != nil && !up.allow(len(b)) {
+		return len(b), nil
+	}
+	n, err := c.PacketConn.Write(b)
+	c.acct.add(int64(n), 0)
+	return n, err
+}
+
+func (c *packetConn) Read(b []byte) (n int, err error) {
+	for {
+		if c.cut && c.acct.exceeded() {
+			return 0, constant.ErrQuotaExceeded
+		}
+		if n, err = c.PacketConn.Read(b); err != nil || c.received(n) {
+			return n, c.readErr(err)
+		}
+	}
+}
+
+func (c *packetConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		if c.cut && c.acct.exceeded() {
+			return 0, nil, constant.ErrQuotaExceeded
+		}
+		if n, addr, err = c.PacketConn.ReadFrom(b); err != nil || c.received(n) {
+			return n, addr, c.readErr(err)
+		}
+	}
+}
+
+// readErr returns ErrQuotaExceeded if the flow has been closed by the account
+func (c *packetConn) readErr(err error) error {
+	if err != nil && c.cut && c.acct.exceeded() {
+		return constant.ErrQuotaExceeded
+	}
+	return err
+}
+
+func (c *packetConn) Close() error {
+	if c.cut {
+		c.acct.untrack(c.PacketConn)
+	}
+	return c.PacketConn.Close()
+}
+
+// received counts the datagram of n bytes, it returns false if the datagram is dropped
+func (c *packetConn) received(n int) bool {
+	if _, down := c.acct.buckets(); down != nil && !down.allow(n) {
+		return false
+	}
+	c.acct.add(0, int64(n))
+	return true
+}
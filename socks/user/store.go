@@ -0,0 +1,415 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/socks/sc"
+	"gopkg.in/yaml.v3"
+)
+
+type usersFile struct {
+	Users []User `yaml:"users"`
+}
+
+// Store is the users of a yaml file and their usage. The users are changed by Put and
+// Delete which save the file, or by editing the file which is loaded again by Reload.
+type Store struct {
+	// CutOnQuota closes the live sessions of the users over their quotas, otherwise
+	// only the new sessions are rejected
+	CutOnQuota bool
+
+	path      string
+	usagePath string
+	mu        sync.RWMutex
+	modTime   time.Time
+	users     map[string]*User
+	accounts  map[string]*account
+	// the passwords verified are cached by their HMACs keyed by cacheKey, so that the
+	// reconnections skip the key derivation
+	verified map[string][sha256.Size]byte
+	cacheKey []byte
+	// verifying limits the concurrent key derivations
+	verifying chan struct{}
+}
+
+// Open loads the users of path and their usage of usagePath, the files are created when
+// they are saved
+func Open(path, usagePath string) (*Store, error) {
+	s := &Store{
+		path:      path,
+		usagePath: usagePath,
+		users:     make(map[string]*User),
+		accounts:  make(map[string]*account),
+		verified:  make(map[string][sha256.Size]byte),
+		cacheKey:  make([]byte, sha256.Size),
+		verifying: make(chan struct{}, runtime.GOMAXPROCS(0)/2+1),
+	}
+	if _, err := rand.Read(s.cacheKey); err != nil {
+		return nil, err
+	}
+	if err := s.loadUsage(); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	var f usersFile
+	var modTime time.Time
+	fi, err := os.Stat(s.path)
+	switch {
+	case err == nil:
+		modTime = fi.ModTime()
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return err
+		}
+		if err = yaml.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("user: %s: %w", s.path, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	users := make(map[string]*User, len(f.Users))
+	for i := range f.Users {
+		u := &f.Users[i]
+		if err = u.Validate(); err != nil {
+			return err
+		}
+		if _, ok := users[u.Name]; ok {
+			return fmt.Errorf("user %s: duplicated", u.Name)
+		}
+		users[u.Name] = u
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+	s.verified = make(map[string][sha256.Size]byte)
+	s.modTime = modTime
+	for _, u := range users {
+		s.account(u.Name).configure(u)
+	}
+	return nil
+}
+
+// Reload loads the users again if the file is modified
+func (s *Store) Reload() (bool, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	var modTime time.Time
+	if fi != nil {
+		modTime = fi.ModTime()
+	}
+	s.mu.RLock()
+	modified := !modTime.Equal(s.modTime)
+	s.mu.RUnlock()
+	if !modified {
+		return false, nil
+	}
+	return true, s.load()
+}
+
+// account returns the account of the user, s.mu must be locked
+func (s *Store) account(name string) *account {
+	a, ok := s.accounts[name]
+	if !ok {
+		a = new(account)
+		s.accounts[name] = a
+	}
+	return a
+}
+
+func (s *Store) lookup(name string) (*User, *account) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[name]
+	if !ok {
+		return nil, nil
+	}
+	return u, s.accounts[name]
+}
+
+// Get returns a copy of the user
+func (s *Store) Get(name string) (User, bool) {
+	u, _ := s.lookup(name)
+	if u == nil {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// List returns the copies of the users sorted by name
+func (s *Store) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// Put adds or replaces the user and saves the file
+func (s *Store) Put(u User) error {
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make(map[string]*User, len(s.users)+1)
+	for name, v := range s.users {
+		users[name] = v
+	}
+	users[u.Name] = &u
+	if err := s.save(users); err != nil {
+		return err
+	}
+	s.users = users
+	delete(s.verified, u.Name)
+	s.account(u.Name).configure(&u)
+	return nil
+}
+
+// Delete removes the user and saves the file, the usage is kept
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return constant.ErrUserNotFound
+	}
+	users := make(map[string]*User, len(s.users))
+	for n, v := range s.users {
+		if n != name {
+			users[n] = v
+		}
+	}
+	if err := s.save(users); err != nil {
+		return err
+	}
+	s.users = users
+	delete(s.verified, name)
+	return nil
+}
+
+// save writes the users to the file, s.mu must be locked
+func (s *Store) save(users map[string]*User) error {
+	var f usersFile
+	for _, u := range users {
+		f.Users = append(f.Users, *u)
+	}
+	sort.Slice(f.Users, func(i, j int) bool { return f.Users[i].Name < f.Users[j].Name })
+	data, err := yaml.Marshal(&f)
+	if err != nil {
+		return err
+	}
+	if err = writeFile(s.path, data); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+// writeFile replaces the file atomically
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(0o600)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Usage returns the usage of the user in this month
+func (s *Store) Usage(name string) Usage {
+	s.mu.RLock()
+	a, ok := s.accounts[name]
+	s.mu.RUnlock()
+	if !ok {
+		return Usage{Month: month(time.Now())}
+	}
+	return a.snapshot()
+}
+
+// ResetUsage resets the usage of the user in this month
+func (s *Store) ResetUsage(name string) error {
+	_, a := s.lookup(name)
+	if a == nil {
+		return constant.ErrUserNotFound
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.usage = Usage{Month: month(time.Now())}
+	a.dirty = true
+	return nil
+}
+
+func (s *Store) loadUsage() error {
+	data, err := os.ReadFile(s.usagePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	usage := make(map[string]Usage)
+	if err = yaml.Unmarshal(data, &usage); err != nil {
+		return fmt.Errorf("user: %s: %w", s.usagePath, err)
+	}
+	for name, u := range usage {
+		s.accounts[name] = &account{usage: u}
+	}
+	return nil
+}
+
+// SaveUsage writes the usage of the users to the file if it's changed
+func (s *Store) SaveUsage() error {
+	s.mu.RLock()
+	usage := make(map[string]Usage, len(s.accounts))
+	var dirty []*account
+	for name, a := range s.accounts {
+		a.mu.Lock()
+		usage[name] = a.usage
+		if a.dirty {
+			dirty = append(dirty, a)
+			a.dirty = false
+		}
+		a.mu.Unlock()
+	}
+	s.mu.RUnlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(usage)
+	if err == nil {
+		err = writeFile(s.usagePath, data)
+	}
+	if err != nil {
+		// saved again next time
+		for _, a := range dirty {
+			a.mu.Lock()
+			a.dirty = true
+			a.mu.Unlock()
+		}
+	}
+	return err
+}
+
+// Authenticate checks the password of the user connecting from ip, and whether the user
+// may start a session. It returns ErrUserNotFound if the user isn't in the store, and
+// ErrAuthFailure if the password is wrong. The unknown users take as long as the wrong
+// passwords.
+func (s *Store) Authenticate(name, password string, ip netip.Addr) error {
+	s.mu.RLock()
+	u, ok := s.users[name]
+	verified, cached := s.verified[name]
+	s.mu.RUnlock()
+	sum := s.passwordSum(password)
+	if !ok || !cached || !hmac.Equal(verified[:], sum[:]) {
+		hash := dummyHash()
+		if ok {
+			hash = u.Password
+		}
+		valid := s.verify(hash, password)
+		if !ok {
+			return constant.ErrUserNotFound
+		}
+		if !valid {
+			return constant.ErrAuthFailure
+		}
+		s.mu.Lock()
+		if s.users[name] == u {
+			s.verified[name] = sum
+		}
+		s.mu.Unlock()
+	}
+	if !u.AllowSource(ip) {
+		return constant.ErrSourceNotAllowed
+	}
+	return s.Check(name, 0)
+}
+
+func (s *Store) passwordSum(password string) (sum [sha256.Size]byte) {
+	mac := hmac.New(sha256.New, s.cacheKey)
+	mac.Write([]byte(password))
+	mac.Sum(sum[:0])
+	return
+}
+
+// verify limits the key derivations to about half of the cpus, so that the authentication
+// floods don't starve the relays
+func (s *Store) verify(hash, password string) bool {
+	s.verifying <- struct{}{}
+	defer func() { <-s.verifying }()
+	return verifyPassword(hash, password)
+}
+
+// Check returns why the user can't request the command, zero cmd checks the user only.
+// The users not in the store are allowed.
+func (s *Store) Check(name string, cmd constant.Socks5Cmd) error {
+	u, a := s.lookup(name)
+	if u == nil {
+		return nil
+	}
+	if err := u.check(time.Now()); err != nil {
+		return err
+	}
+	if cmd != 0 && !u.AllowCommand(cmd) {
+		return constant.ErrCommandNotAllowed
+	}
+	if a.exceeded() {
+		return constant.ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Conn meters the outbound connection of the user, the connection of the users not in the
+// store is returned as is
+func (s *Store) Conn(name string, c net.Conn) net.Conn {
+	if _, a := s.lookup(name); a != nil {
+		if s.CutOnQuota {
+			a.track(c)
+		}
+		return &conn{Conn: c, acct: a, cut: s.CutOnQuota}
+	}
+	return c
+}
+
+// PacketConn meters the outbound udp flow of the user like Conn
+func (s *Store) PacketConn(name string, c sc.PacketConn) sc.PacketConn {
+	if _, a := s.lookup(name); a != nil {
+		if s.CutOnQuota {
+			a.track(c)
+		}
+		return &packetConn{PacketConn: c, acct: a, cut: s.CutOnQuota}
+	}
+	return c
+}
@@ -0,0 +1,129 @@
+// Package user is the store of the socks users, their permissions, bandwidth caps and
+// monthly traffic quotas. The users are saved in a yaml file, which is reloaded when it's
+// modified, and the usage of each user is saved in another file.
+package user
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+// the names of the commands in User.Commands
+const (
+	CmdConnect = "connect"
+	CmdUDP     = "udp"
+	CmdReverse = "reverse"
+)
+
+// User is an account of the socks server. Password is the hash of HashPassword. Empty
+// Commands and CIDRs allow any command and any source address, zero ExpiresAt never
+// expires, and zero rates and quota mean no limit. The rates are in bytes per second
+// shared by all sessions of the user, and the quota counts both directions in bytes.
+type User struct {
+	Name         string         `yaml:"name" json:"name"`
+	Password     string         `yaml:"password" json:"password,omitempty"`
+	Disabled     bool           `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	ExpiresAt    time.Time      `yaml:"expires_at,omitempty" json:"expires_at,omitempty"`
+	Commands     []string       `yaml:"commands,omitempty" json:"commands,omitempty"`
+	CIDRs        []netip.Prefix `yaml:"cidrs,omitempty" json:"cidrs,omitempty"`
+	UploadRate   int64          `yaml:"upload_rate,omitempty" json:"upload_rate,omitempty"`
+	DownloadRate int64          `yaml:"download_rate,omitempty" json:"download_rate,omitempty"`
+	MonthlyQuota int64          `yaml:"monthly_quota,omitempty" json:"monthly_quota,omitempty"`
+}
+
+// Usage is the traffic of a user in Month, such as "2006-01"
+type Usage struct {
+	Month    string `yaml:"month" json:"month"`
+	Upload   int64  `yaml:"upload" json:"upload"`
+	Download int64  `yaml:"download" json:"download"`
+}
+
+// Total returns the traffic counted by the quota
+func (u Usage) Total() int64 {
+	return u.Upload + u.Download
+}
+
+func month(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// CommandName returns the name of the command in User.Commands
+func CommandName(cmd constant.Socks5Cmd) string {
+	switch cmd {
+	case constant.Connect:
+		return CmdConnect
+	case constant.UDP:
+		return CmdUDP
+	case constant.ReverseListen, constant.ReverseAccept:
+		return CmdReverse
+	}
+	return fmt.Sprintf("0x%02x", cmd)
+}
+
+// Validate checks the name, the password hash and the commands of the user
+func (u *User) Validate() error {
+	if u.Name == "" {
+		return fmt.Errorf("user: empty name")
+	}
+	if _, _, _, err := parseHash(u.Password); err != nil {
+		return fmt.Errorf("user %s: %w", u.Name, err)
+	}
+	for _, cmd := range u.Commands {
+		switch cmd {
+		case CmdConnect, CmdUDP, CmdReverse:
+		default:
+			return fmt.Errorf("user %s: invalid command: %s", u.Name, cmd)
+		}
+	}
+	if u.UploadRate < 0 || u.DownloadRate < 0 || u.MonthlyQuota < 0 {
+		return fmt.Errorf("user %s: negative limit", u.Name)
+	}
+	return nil
+}
+
+// Expired reports whether the user is expired at now
+func (u *User) Expired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt)
+}
+
+// AllowSource reports whether the user may connect from ip
+func (u *User) AllowSource(ip netip.Addr) bool {
+	if len(u.CIDRs) == 0 {
+		return true
+	}
+	ip = ip.Unmap()
+	for _, p := range u.CIDRs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowCommand reports whether the user may request the command
+func (u *User) AllowCommand(cmd constant.Socks5Cmd) bool {
+	if len(u.Commands) == 0 {
+		return true
+	}
+	name := CommandName(cmd)
+	for _, c := range u.Commands {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns why the user can't start a session at now
+func (u *User) check(now time.Time) error {
+	switch {
+	case u.Disabled:
+		return constant.ErrUserDisabled
+	case u.Expired(now):
+		return constant.ErrUserExpired
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package user
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josexy/gsocks5/socks/constant"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914 section 11
+	want, _ := hex.DecodeString("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783")
+	if got := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64); !bytes.Equal(got, want) {
+		t.Fatalf("got %x", got)
+	}
+
+	hash, err := HashPassword("12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyPassword(hash, "12345678") || verifyPassword(hash, "1234567") || verifyPassword("plain", "plain") {
+		t.Fatal("verify")
+	}
+	// the iterations are bounded
+	if _, _, _, err = parseHash(strings.Replace(hash, "$100000$", "$2000000000$", 1)); err != errInvalidHash {
+		t.Fatalf("too many iterations: %v", err)
+	}
+}
+
+func newTestStore(t *testing.T, users ...User) *Store {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "users.yaml"), filepath.Join(dir, "users.yaml.usage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range users {
+		if u.Password, err = HashPassword(u.Password); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Put(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestAuthenticate(t *testing.T) {
+	local := netip.MustParseAddr("127.0.0.1")
+	s := newTestStore(t,
+		User{Name: "alice", Password: "a", Commands: []string{CmdConnect}, CIDRs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+		User{Name: "bob", Password: "b", Disabled: true},
+		User{Name: "carol", Password: "c", ExpiresAt: time.Now().Add(-time.Hour)},
+		User{Name: "dave", Password: "d", MonthlyQuota: 10},
+	)
+	for _, tc := range []struct {
+		name, password string
+		ip             netip.Addr
+		err            error
+	}{
+		{"alice", "a", local, nil},
+		{"alice", "a", netip.MustParseAddr("::ffff:127.0.0.1"), nil},
+		{"alice", "a", netip.MustParseAddr("10.0.0.1"), constant.ErrSourceNotAllowed},
+		{"alice", "a", netip.Addr{}, constant.ErrSourceNotAllowed},
+		{"alice", "b", local, constant.ErrAuthFailure},
+		{"bob", "b", local, constant.ErrUserDisabled},
+		{"carol", "c", local, constant.ErrUserExpired},
+		{"dave", "d", local, nil},
+		{"erin", "e", local, constant.ErrUserNotFound},
+	} {
+		if err := s.Authenticate(tc.name, tc.password, tc.ip); err != tc.err {
+			t.Errorf("%s %s %s: got %v, want %v", tc.name, tc.password, tc.ip, err, tc.err)
+		}
+	}
+	// a wrong password is rejected after the right one is cached
+	if err := s.Authenticate("alice", "x", local); err != constant.ErrAuthFailure {
+		t.Fatalf("cached: %v", err)
+	}
+	// the cache keeps the keyed sums of the passwords
+	if sum, ok := s.verified["alice"]; !ok || sum == sha256.Sum256([]byte("a")) {
+		t.Fatal("cached password sum")
+	}
+
+	if err := s.Check("alice", constant.UDP); err != constant.ErrCommandNotAllowed {
+		t.Fatalf("udp: %v", err)
+	}
+	if err := s.Check("erin", constant.UDP); err != nil {
+		t.Fatalf("not in the store: %v", err)
+	}
+	s.accounts["dave"].add(4, 6)
+	if err := s.Check("dave", constant.Connect); err != constant.ErrQuotaExceeded {
+		t.Fatalf("quota: %v", err)
+	}
+	// the usage of the last month doesn't count
+	s.accounts["dave"].usage.Month = "2000-01"
+	if err := s.Check("dave", constant.Connect); err != nil {
+		t.Fatalf("new month: %v", err)
+	}
+}
+
+func TestStoreFiles(t *testing.T) {
+	s := newTestStore(t, User{Name: "alice", Password: "a"}, User{Name: "bob", Password: "b"})
+	s.accounts["alice"].add(100, 200)
+	if err := s.SaveUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := Open(s.path, s.usagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users := s2.List(); len(users) != 1 || users[0].Name != "alice" {
+		t.Fatalf("users: %+v", users)
+	}
+	if u := s2.Usage("alice"); u.Upload != 100 || u.Download != 200 {
+		t.Fatalf("usage: %+v", u)
+	}
+
+	// the file edited by another process is reloaded
+	u, _ := s.Get("alice")
+	u.Disabled = true
+	if err = s2.Put(u); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Second)
+	os.Chtimes(s.path, future, future)
+	if reloaded, err := s.Reload(); !reloaded || err != nil {
+		t.Fatalf("reload: %v %v", reloaded, err)
+	}
+	if err = s.Authenticate("alice", "a", netip.Addr{}); err != constant.ErrUserDisabled {
+		t.Fatalf("reloaded: %v", err)
+	}
+	if reloaded, _ := s.Reload(); reloaded {
+		t.Fatal("reloaded twice")
+	}
+}
+
+func TestConn(t *testing.T) {
+	s := newTestStore(t, User{Name: "alice", Password: "a", MonthlyQuota: 1024, UploadRate: 64 * 1024})
+	s.CutOnQuota = true
+	left, right := net.Pipe()
+	defer right.Close()
+	conn := s.Conn("alice", left)
+	if s.Conn("bob", left) != left {
+		t.Fatal("metered the user not in the store")
+	}
+	go io.Copy(right, right)
+	// an idle session of the user
+	idle, idlePeer := net.Pipe()
+	defer idlePeer.Close()
+	idleErr := make(chan error, 1)
+	go func() {
+		_, err := s.Conn("alice", idle).Read(make([]byte, 1))
+		idleErr <- err
+	}()
+
+	buf := make([]byte, 600)
+	conn.Write(buf)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if u := s.Usage("alice"); u.Upload != 600 || u.Download != 600 {
+		t.Fatalf("usage: %+v", u)
+	}
+	if _, err := conn.Write(buf); err != constant.ErrQuotaExceeded {
+		t.Fatalf("over the quota: %v", err)
+	}
+	// the blocked read of the live session is cut too
+	select {
+	case err := <-idleErr:
+		if err != constant.ErrQuotaExceeded {
+			t.Fatalf("idle session: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle session isn't cut")
+	}
+
+	// the burst is the bytes of one second
+	u, _ := s.Get("alice")
+	u.MonthlyQuota = 0
+	s.Put(u)
+	left, right = net.Pipe()
+	defer right.Close()
+	conn = s.Conn("alice", left)
+	go io.Copy(io.Discard, right)
+	start := time.Now()
+	// the wait extends the deadline
+	conn.SetWriteDeadline(start.Add(200 * time.Millisecond))
+	if _, err := conn.Write(make([]byte, 96*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("upload rate: %s", d)
+	}
+}
@@ -0,0 +1,190 @@
+package tcpserver
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxRejecting is the max number of the concurrent reject handlers, the rejected
+// connections over it are closed immediately
+const maxRejecting = 64
+
+// ConnLimiter limits the concurrent connections in total and per client ip, it can be
+// shared by multiple servers. Zero means no limit. When Queue is true, the server stops
+// accepting new connections while the total limit is reached, otherwise the new
+// connections are rejected.
+type ConnLimiter struct {
+	MaxConns      int
+	MaxConnsPerIP int
+	Queue         bool
+
+	sem   chan struct{}
+	mu    sync.Mutex
+	perIP map[string]int
+
+	rejecting chan struct{}
+	rejected  atomic.Int64
+	logged    atomic.Int64
+}
+
+func NewConnLimiter(maxConns, maxConnsPerIP int, queue bool) *ConnLimiter {
+	l := &ConnLimiter{
+		MaxConns:      maxConns,
+		MaxConnsPerIP: maxConnsPerIP,
+		Queue:         queue,
+		perIP:         make(map[string]int),
+		rejecting:     make(chan struct{}, maxRejecting),
+	}
+	if maxConns > 0 {
+		l.sem = make(chan struct{}, maxConns)
+	}
+	return l
+}
+
+// wait blocks until the total limit isn't reached in the queue mode, it returns false if done is closed
+func (l *ConnLimiter) wait(done <-chan struct{}) bool {
+	if l.sem == nil || !l.Queue {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// acquire reserves a connection of the remote address, the total slot has been
+// reserved by wait in the queue mode
+func (l *ConnLimiter) acquire(addr net.Addr) bool {
+	if l.sem != nil && !l.Queue {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if l.MaxConnsPerIP > 0 {
+		ip := addrIP(addr)
+		l.mu.Lock()
+		if l.perIP[ip] >= l.MaxConnsPerIP {
+			l.mu.Unlock()
+			l.releaseTotal()
+			return false
+		}
+		l.perIP[ip]++
+		l.mu.Unlock()
+	}
+	return true
+}
+
+func (l *ConnLimiter) release(addr net.Addr) {
+	if l.MaxConnsPerIP > 0 {
+		ip := addrIP(addr)
+		l.mu.Lock()
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+		l.mu.Unlock()
+	}
+	l.releaseTotal()
+}
+
+func (l *ConnLimiter) releaseTotal() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// startReject takes a slot of the reject handlers, it returns false if all slots are in use
+func (l *ConnLimiter) startReject() bool {
+	select {
+	case l.rejecting <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *ConnLimiter) endReject() {
+	<-l.rejecting
+}
+
+// countRejected counts a rejected connection, it returns the number of the rejected
+// connections since the last call which returned non-zero, at most once per second
+func (l *ConnLimiter) countRejected() int64 {
+	l.rejected.Add(1)
+	now := time.Now().UnixNano()
+	last := l.logged.Load()
+	if now-last < int64(time.Second) || !l.logged.CompareAndSwap(last, now) {
+		return 0
+	}
+	return l.rejected.Swap(0)
+}
+
+func addrIP(addr net.Addr) string {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// RateLimiter is a token bucket which limits the accept rate of the server
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait before the token is available
+func (r *RateLimiter) reserve() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// wait blocks until a token is available, it returns false if done is closed
+func (r *RateLimiter) wait(done <-chan struct{}) bool {
+	d := r.reserve()
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,68 @@
+package tcpserver
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := NewConnLimiter(3, 2, false)
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1}
+	if !l.acquire(a) || !l.acquire(a) {
+		t.Fatal("acquire under the limits failed")
+	}
+	if l.acquire(a) {
+		t.Fatal("per-ip limit exceeded")
+	}
+	if !l.acquire(b) {
+		t.Fatal("acquire of another ip failed")
+	}
+	if l.acquire(b) {
+		t.Fatal("total limit exceeded")
+	}
+	l.release(a)
+	if !l.acquire(b) {
+		t.Fatal("acquire after release failed")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := NewRateLimiter(10, 2)
+	if r.reserve() != 0 || r.reserve() != 0 {
+		t.Fatal("burst isn't available")
+	}
+	if d := r.reserve(); d < 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("unexpected wait: %s", d)
+	}
+}
+
+func TestConnLimiterReject(t *testing.T) {
+	l := NewConnLimiter(1, 0, false)
+	for i := 0; i < maxRejecting; i++ {
+		if !l.startReject() {
+			t.Fatalf("reject slot %d isn't available", i)
+		}
+	}
+	if l.startReject() {
+		t.Fatal("reject slots exceeded")
+	}
+	l.endReject()
+	if !l.startReject() {
+		t.Fatal("reject slot isn't released")
+	}
+
+	if n := l.countRejected(); n != 1 {
+		t.Fatalf("rejected: %d", n)
+	}
+	for i := 0; i < 10; i++ {
+		if n := l.countRejected(); n != 0 {
+			t.Fatalf("rejected logged within a second: %d", n)
+		}
+	}
+	l.logged.Store(0)
+	if n := l.countRejected(); n != 11 {
+		t.Fatalf("rejected: %d", n)
+	}
+}
@@ -2,12 +2,19 @@ package tcpserver
 
 import (
 	"net"
+
+	"github.com/josexy/gsocks5/proxyproto"
 )
 
 type serverOptions struct {
 	AcceptErrorHandler  func(error)
 	InComingHandler     func(net.Addr)
 	ClientClosedHandler func(net.Addr)
+	RejectedHandler     func(net.Conn)
+	ConnLimiter         *ConnLimiter
+	RateLimiter         *RateLimiter
+	ProxyProtocol       *proxyproto.Policy
+	ConnWrapper         func(net.Conn) net.Conn
 }
 
 type ServerOption interface {
@@ -37,3 +44,39 @@ func WithClientClosedHandler(fn func(addr net.Addr)) ServerOption {
 		so.ClientClosedHandler = fn
 	})
 }
+
+// WithRejectedHandler sets the handler of the connections rejected by the ConnLimiter,
+// the connection is closed after the handler returns
+func WithRejectedHandler(fn func(conn net.Conn)) ServerOption {
+	return serverOptionFunc(func(so *serverOptions) {
+		so.RejectedHandler = fn
+	})
+}
+
+func WithConnLimiter(limiter *ConnLimiter) ServerOption {
+	return serverOptionFunc(func(so *serverOptions) {
+		so.ConnLimiter = limiter
+	})
+}
+
+func WithRateLimiter(limiter *RateLimiter) ServerOption {
+	return serverOptionFunc(func(so *serverOptions) {
+		so.RateLimiter = limiter
+	})
+}
+
+// WithProxyProtocol makes the server read the PROXY header of the connections from the
+// trusted networks, the handler sees the client address carried by the header
+func WithProxyProtocol(policy *proxyproto.Policy) ServerOption {
+	return serverOptionFunc(func(so *serverOptions) {
+		so.ProxyProtocol = policy
+	})
+}
+
+// WithConnWrapper wraps the accepted connections before they are served, such as the
+// encrypted transports. The wrapper must not block, the handshake is done by the handler.
+func WithConnWrapper(fn func(conn net.Conn) net.Conn) ServerOption {
+	return serverOptionFunc(func(so *serverOptions) {
+		so.ConnWrapper = fn
+	})
+}
@@ -37,6 +37,10 @@ func (conn *TcpConn) serve(ctx context.Context) {
 		}
 		util.Logger.Warnf("client closed: %s", conn.remoteAddr)
 		conn.close()
+		conn.server.trackConn(conn, false)
+		if conn.server.Opts.ConnLimiter != nil {
+			conn.server.Opts.ConnLimiter.release(conn.rwc.RemoteAddr())
+		}
 	}()
 
 	conn.remoteAddr = conn.rwc.RemoteAddr().String()
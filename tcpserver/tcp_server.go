@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 
@@ -37,10 +38,12 @@ func (f TcpHandlerFunc) ServeTCP(ctx context.Context, conn net.Conn) {
 }
 
 type TcpServer struct {
-	Addr        string
-	Handler     TcpHandler
-	BaseContext context.Context
-	Opts        serverOptions
+	Network      string
+	Addr         string
+	Handler      TcpHandler
+	BaseContext  context.Context
+	ListenConfig net.ListenConfig
+	Opts         serverOptions
 
 	listener   *onceCloseListener
 	mu         sync.Mutex
@@ -55,6 +58,7 @@ func NewTcpServer(addr string, handler TcpHandler, opt ...ServerOption) *TcpServ
 		o.applyTo(&opts)
 	}
 	server := &TcpServer{
+		Network:     "tcp",
 		Addr:        addr,
 		Handler:     handler,
 		BaseContext: context.Background(),
@@ -79,7 +83,10 @@ func (srv *TcpServer) Close() error {
 	atomic.StoreInt32(&srv.isClosed, 1)
 	close(srv.doneChan)
 
-	err := srv.listener.Close()
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
 	srv.closeConns()
 	return err
 }
@@ -92,18 +99,59 @@ func (srv *TcpServer) closeConns() {
 }
 
 func (srv *TcpServer) ListenAndServe() error {
+	if srv.getListener() == nil {
+		if err := srv.Listen(); err != nil {
+			return err
+		}
+	}
+	return srv.serve()
+}
+
+// Listen listens on the address before serving, so that the ephemeral port of the address
+// is known by LocalAddr
+func (srv *TcpServer) Listen() error {
 	if srv.IsClosed() {
 		return ErrServerClosed
 	}
 	if srv.Addr == "" {
 		util.Logger.Fatal("tcp server need address")
 	}
-	ln, err := net.Listen("tcp", srv.Addr)
+	network := srv.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		// remove the stale socket file left by the previous process, other files are kept
+		if fi, err := os.Lstat(srv.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(srv.Addr)
+		}
+	}
+	ln, err := srv.ListenConfig.Listen(context.Background(), network, srv.Addr)
 	if err != nil {
 		return err
 	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.IsClosed() {
+		_ = ln.Close()
+		return ErrServerClosed
+	}
 	srv.listener = newOnceCloseListener(ln)
-	return srv.serve()
+	return nil
+}
+
+// LocalAddr returns the listening address, nil if the server isn't listening
+func (srv *TcpServer) LocalAddr() net.Addr {
+	if ln := srv.getListener(); ln != nil {
+		return ln.Addr()
+	}
+	return nil
+}
+
+func (srv *TcpServer) getListener() *onceCloseListener {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.listener
 }
 
 func (srv *TcpServer) serve() error {
@@ -113,8 +161,17 @@ func (srv *TcpServer) serve() error {
 	}
 	ctx := context.WithValue(srv.BaseContext, ServerContextKey, srv)
 	for {
+		if srv.Opts.RateLimiter != nil && !srv.Opts.RateLimiter.wait(srv.getDoneChan()) {
+			return ErrServerClosed
+		}
+		if srv.Opts.ConnLimiter != nil && !srv.Opts.ConnLimiter.wait(srv.getDoneChan()) {
+			return ErrServerClosed
+		}
 		rwc, err := srv.listener.Accept()
 		if err != nil {
+			if srv.Opts.ConnLimiter != nil && srv.Opts.ConnLimiter.Queue {
+				srv.Opts.ConnLimiter.releaseTotal()
+			}
 			select {
 			case <-srv.getDoneChan():
 				// server closed
@@ -127,17 +184,79 @@ func (srv *TcpServer) serve() error {
 			}
 			continue
 		}
-		if srv.Opts.InComingHandler != nil {
-			srv.Opts.InComingHandler(rwc.RemoteAddr())
+		if srv.Opts.ProxyProtocol != nil {
+			// the PROXY header is read in its own goroutine to not block the accept loop
+			go srv.serveProxyConn(ctx, rwc)
+			continue
+		}
+		srv.newConn(ctx, rwc)
+	}
+}
+
+func (srv *TcpServer) newConn(ctx context.Context, rwc net.Conn) {
+	if srv.Opts.ConnWrapper != nil {
+		rwc = srv.Opts.ConnWrapper(rwc)
+	}
+	if l := srv.Opts.ConnLimiter; l != nil && !l.acquire(rwc.RemoteAddr()) {
+		if n := l.countRejected(); n > 0 {
+			util.Logger.Warnf("%d clients rejected by connection limit", n)
+		}
+		if !l.startReject() {
+			rwc.Close()
+			return
 		}
-		conn := &TcpConn{
-			rwc:    rwc,
-			server: srv,
+		go func() {
+			defer l.endReject()
+			srv.reject(rwc)
+		}()
+		return
+	}
+	if srv.Opts.InComingHandler != nil {
+		srv.Opts.InComingHandler(rwc.RemoteAddr())
+	}
+	conn := &TcpConn{
+		rwc:    rwc,
+		server: srv,
+	}
+	srv.trackConn(conn, true)
+	go conn.serve(ctx)
+}
+
+// serveProxyConn replaces the addresses of the connection with the PROXY header
+func (srv *TcpServer) serveProxyConn(ctx context.Context, rwc net.Conn) {
+	conn, err := srv.Opts.ProxyProtocol.Wrap(rwc)
+	if err != nil {
+		util.Logger.Warnf("invalid PROXY header from %s: %v", rwc.RemoteAddr(), err)
+		rwc.Close()
+		if srv.Opts.ConnLimiter != nil && srv.Opts.ConnLimiter.Queue {
+			srv.Opts.ConnLimiter.releaseTotal()
 		}
-		srv.mu.Lock()
+		return
+	}
+	srv.newConn(ctx, conn)
+}
+
+func (srv *TcpServer) trackConn(conn *TcpConn, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
 		srv.activeConn[conn] = struct{}{}
-		srv.mu.Unlock()
-		go conn.serve(ctx)
+	} else {
+		delete(srv.activeConn, conn)
+	}
+}
+
+// ActiveConns returns the number of the active connections
+func (srv *TcpServer) ActiveConns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.activeConn)
+}
+
+func (srv *TcpServer) reject(rwc net.Conn) {
+	defer rwc.Close()
+	if srv.Opts.RejectedHandler != nil {
+		srv.Opts.RejectedHandler(rwc)
 	}
 }
 
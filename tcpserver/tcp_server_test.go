@@ -0,0 +1,42 @@
+package tcpserver
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// a regular file at the path is never removed
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewTcpServer(file, nil)
+	srv.Network = "unix"
+	if err := srv.Listen(); err == nil {
+		srv.Close()
+		t.Fatal("listened on a regular file")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "data" {
+		t.Fatalf("file removed: %v", err)
+	}
+
+	// the socket file left by the previous process is replaced
+	sock := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+	srv = NewTcpServer(sock, nil)
+	srv.Network = "unix"
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+}
@@ -0,0 +1,10 @@
+// Package transparent implements the transparent proxy listeners of the iptables REDIRECT
+// and TPROXY targets, which recover the original destination of the captured traffic.
+package transparent
+
+import "errors"
+
+var (
+	ErrUnsupported   = errors.New("transparent: only supported on linux")
+	ErrNoOriginalDst = errors.New("transparent: no original destination")
+)
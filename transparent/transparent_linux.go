@@ -0,0 +1,180 @@
+package transparent
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6t_SO_ORIGINAL_DST of linux/netfilter_ipv6/ip6_tables.h
+const ip6tSOOriginalDst = 80
+
+type tcpConn interface {
+	TCP() *net.TCPConn
+}
+
+// OriginalDst returns the original destination of the connection redirected by the
+// iptables REDIRECT target (SO_ORIGINAL_DST)
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	if c, ok := conn.(tcpConn); ok {
+		conn = c.TCP()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrNoOriginalDst
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var serr error
+	if err = rc.Control(func(fd uintptr) {
+		if local, _ := tc.LocalAddr().(*net.TCPAddr); local != nil && local.IP.To4() == nil {
+			var info *unix.IPv6MTUInfo
+			if info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.IPPROTO_IPV6, ip6tSOOriginalDst); serr == nil {
+				addr = &net.TCPAddr{IP: net.IP(append([]byte(nil), info.Addr.Addr[:]...)), Port: ntohs(&info.Addr.Port)}
+			}
+			return
+		}
+		// sockaddr_in fits in the 20 bytes of ipv6_mreq
+		var mreq *unix.IPv6Mreq
+		if mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.IPPROTO_IP, unix.SO_ORIGINAL_DST); serr == nil {
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+				Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return addr, nil
+}
+
+// ntohs converts the port of the raw socket address in the network byte order
+func ntohs(port *uint16) int {
+	return int(binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(port))[:]))
+}
+
+// Control sets IP_TRANSPARENT on the socket, which accepts the connections and the
+// packets to the non-local addresses diverted by the iptables TPROXY target
+func Control(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = setTransparent(int(fd), network)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func setTransparent(fd int, network string) error {
+	if network[len(network)-1] != '6' {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil && network[len(network)-1] == '4' {
+			return err
+		}
+	}
+	if network[len(network)-1] != '4' {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil && network[len(network)-1] == '6' {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListenUDP listens for the udp packets diverted by the iptables TPROXY target, the
+// original destinations are read with ReadFromUDP
+func ListenUDP(network, address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			if err = setTransparent(int(fd), network); err != nil {
+				return
+			}
+			// the reply sockets may be bound to the same address
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+				return
+			}
+			if network != "udp6" {
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil && network == "udp4" {
+					return
+				}
+			}
+			if network != "udp4" {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	pc, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// ReadFromUDP reads a packet and its source and original destination addresses
+func ReadFromUDP(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	var oob [64]byte
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob[:])
+	if err != nil {
+		return
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= unix.SizeofSockaddrInet4:
+			dst = &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= unix.SizeofSockaddrInet6:
+			dst = &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), msg.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+		}
+	}
+	if dst == nil {
+		err = ErrNoOriginalDst
+	}
+	return
+}
+
+// ListenReplyUDP returns a socket bound to the original destination laddr, which sends
+// the replies to the client with the source address expected by the client
+func ListenReplyUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if laddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			if err = setTransparent(int(fd), network); err != nil {
+				return
+			}
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	pc, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
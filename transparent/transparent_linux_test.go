@@ -0,0 +1,49 @@
+package transparent
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTProxyUDP(t *testing.T) {
+	conn, err := ListenUDP("udp4", "127.0.0.1:0")
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("IP_TRANSPARENT requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("ping"))
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, src, dst, err := ReadFromUDP(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || src.String() != client.LocalAddr().String() || dst.String() != conn.LocalAddr().String() {
+		t.Fatalf("unexpected packet %q from %s to %s", buf[:n], src, dst)
+	}
+
+	// the reply socket can be bound to the address of the listener
+	reply, err := ListenReplyUDP(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	reply.WriteToUDP([]byte("pong"), src)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err = client.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("reply: %q %v", buf[:n], err)
+	}
+}
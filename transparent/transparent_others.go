@@ -0,0 +1,28 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"net"
+	"syscall"
+)
+
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
+
+func Control(network, address string, c syscall.RawConn) error {
+	return ErrUnsupported
+}
+
+func ListenUDP(network, address string) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+func ReadFromUDP(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	return 0, nil, nil, ErrUnsupported
+}
+
+func ListenReplyUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,228 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// each direction starts with a random salt, followed by the chunks of
+// [sealed 2-byte length][sealed payload], the nonce is a counter of the sealed messages
+const (
+	saltSize     = 32
+	tagSize      = 16
+	nonceSize    = 12
+	maxChunkSize = 0x3FFF
+	subkeyInfo   = "gsocks5-aead-subkey"
+	// the master key is derived from the password with HKDF-SHA256 and the fixed salt
+	keySalt = "gsocks5-aead-salt"
+	keyInfo = "gsocks5-aead-key"
+	// saltFilterSize is the salts remembered by each of the two generations of the filter
+	saltFilterSize = 1 << 16
+)
+
+var (
+	ErrEmptyPassword  = errors.New("transport: aead requires a password")
+	ErrAuthentication = errors.New("transport: aead authentication failed")
+	ErrReplayed       = errors.New("transport: aead salt replayed")
+)
+
+type aeadTransport struct {
+	key   []byte
+	salts *saltFilter
+}
+
+// NewAEAD creates the AES-256-GCM transport keyed by the password, both sides must use
+// the same password. Every connection derives its own keys from the random salts, and
+// the salts seen recently are rejected, so that the recorded sessions can't be replayed.
+func NewAEAD(password string) (Transport, error) {
+	if password == "" {
+		return nil, ErrEmptyPassword
+	}
+	return &aeadTransport{
+		key:   hkdf([]byte(password), []byte(keySalt), keyInfo),
+		salts: newSaltFilter(saltFilterSize),
+	}, nil
+}
+
+func (t *aeadTransport) Wrap(conn net.Conn) net.Conn {
+	return &aeadConn{Conn: conn, key: t.key, salts: t.salts}
+}
+
+// saltFilter remembers the recent salts in two generations of size salts, the older
+// generation is dropped when the current one is full
+type saltFilter struct {
+	mu   sync.Mutex
+	size int
+	cur  map[[saltSize]byte]struct{}
+	prev map[[saltSize]byte]struct{}
+}
+
+func newSaltFilter(size int) *saltFilter {
+	return &saltFilter{size: size, cur: make(map[[saltSize]byte]struct{})}
+}
+
+// add adds the salt, it returns false if the salt has been seen
+func (f *saltFilter) add(salt []byte) bool {
+	key := [saltSize]byte(salt)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.cur[key]; ok {
+		return false
+	}
+	if _, ok := f.prev[key]; ok {
+		return false
+	}
+	if len(f.cur) >= f.size {
+		f.prev, f.cur = f.cur, make(map[[saltSize]byte]struct{})
+	}
+	f.cur[key] = struct{}{}
+	return true
+}
+
+// hkdf derives the 32-byte key of RFC 5869 with HMAC-SHA256
+func hkdf(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// newCipher derives the subkey of the salt with HKDF-SHA256
+func newCipher(key, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdf(key, salt, subkeyInfo))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+type aeadConn struct {
+	net.Conn
+	key   []byte
+	salts *saltFilter
+
+	rmu      sync.Mutex
+	reader   cipher.AEAD
+	rnonce   [nonceSize]byte
+	rbuf     []byte
+	leftover []byte
+
+	wmu    sync.Mutex
+	writer cipher.AEAD
+	wnonce [nonceSize]byte
+	wbuf   []byte
+}
+
+func (c *aeadConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.leftover) > 0 {
+		n := copy(b, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+	if c.reader == nil {
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		if !c.salts.add(salt) {
+			return 0, ErrReplayed
+		}
+		var err error
+		if c.reader, err = newCipher(c.key, salt); err != nil {
+			return 0, err
+		}
+		c.rbuf = make([]byte, maxChunkSize+tagSize)
+	}
+	size, err := c.open(2)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := c.open(int(binary.BigEndian.Uint16(size)) & maxChunkSize)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, payload)
+	c.leftover = payload[n:]
+	return n, nil
+}
+
+// open reads and decrypts a sealed message of n bytes
+func (c *aeadConn) open(n int) ([]byte, error) {
+	buf := c.rbuf[:n+tagSize]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	plain, err := c.reader.Open(buf[:0], c.rnonce[:], buf, nil)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	increment(c.rnonce[:])
+	return plain, nil
+}
+
+func (c *aeadConn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := c.wbuf[:0]
+	if c.writer == nil {
+		salt := make([]byte, saltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return 0, err
+		}
+		// the own salts are remembered too, so that a direction can't be reflected back
+		c.salts.add(salt)
+		if c.writer, err = newCipher(c.key, salt); err != nil {
+			return 0, err
+		}
+		c.wbuf = make([]byte, 0, saltSize+2+maxChunkSize+2*tagSize)
+		buf = append(c.wbuf, salt...)
+	}
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxChunkSize {
+			size = maxChunkSize
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(size))
+		buf = c.writer.Seal(buf, c.wnonce[:], length[:], nil)
+		increment(c.wnonce[:])
+		buf = c.writer.Seal(buf, c.wnonce[:], b[:size], nil)
+		increment(c.wnonce[:])
+		if _, err = c.Conn.Write(buf); err != nil {
+			return
+		}
+		n += size
+		b = b[size:]
+		buf = c.wbuf[:0]
+	}
+	return
+}
+
+// CloseWrite closes the write side of the underlying connection for the half-close relay
+func (c *aeadConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
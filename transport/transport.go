@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+const (
+	TypeTLS  = "tls"
+	TypeAEAD = "aead"
+)
+
+var ErrNoCertificate = errors.New("transport: tls server requires a certificate and a key")
+
+// Transport wraps the connections between a gsocks5 client and server, such as TLS or the
+// AEAD encryption with a pre-shared key. The handshake is done on the first read or write,
+// so Wrap doesn't block.
+type Transport interface {
+	Wrap(conn net.Conn) net.Conn
+}
+
+// Options describes a transport. Cert and Key are the files of the tls server certificate,
+// CA, ServerName and Insecure verify the tls server, and Password derives the AEAD key.
+type Options struct {
+	Type       string
+	Password   string
+	Cert       string
+	Key        string
+	CA         string
+	ServerName string
+	Insecure   bool
+}
+
+// NewServer creates the transport of the server side, nil if the type is empty
+func NewServer(o Options) (Transport, error) {
+	switch o.Type {
+	case "":
+		return nil, nil
+	case TypeAEAD:
+		return NewAEAD(o.Password)
+	case TypeTLS:
+		if o.Cert == "" || o.Key == "" {
+			return nil, ErrNoCertificate
+		}
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		return TLSServer(&tls.Config{Certificates: []tls.Certificate{cert}}), nil
+	}
+	return nil, fmt.Errorf("transport: unknown type %s", o.Type)
+}
+
+// NewClient creates the transport of the client side, nil if the type is empty
+func NewClient(o Options) (Transport, error) {
+	switch o.Type {
+	case "":
+		return nil, nil
+	case TypeAEAD:
+		return NewAEAD(o.Password)
+	case TypeTLS:
+		cfg := &tls.Config{ServerName: o.ServerName, InsecureSkipVerify: o.Insecure}
+		if o.CA != "" {
+			data, err := os.ReadFile(o.CA)
+			if err != nil {
+				return nil, err
+			}
+			cfg.RootCAs = x509.NewCertPool()
+			if !cfg.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("transport: no certificate in %s", o.CA)
+			}
+		}
+		return TLSClient(cfg), nil
+	}
+	return nil, fmt.Errorf("transport: unknown type %s", o.Type)
+}
+
+type tlsTransport struct {
+	config *tls.Config
+	server bool
+}
+
+func TLSServer(config *tls.Config) Transport {
+	return &tlsTransport{config: config, server: true}
+}
+
+func TLSClient(config *tls.Config) Transport {
+	return &tlsTransport{config: config}
+}
+
+// IsTLS reports whether t is a tls client transport
+func IsTLS(t Transport) bool {
+	tt, ok := t.(*tlsTransport)
+	return ok && !tt.server
+}
+
+func (t *tlsTransport) Wrap(conn net.Conn) net.Conn {
+	if t.server {
+		return tls.Server(conn, t.config)
+	}
+	cfg := t.config
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		// verify the ip address of the server like tls.Dial
+		cfg = cfg.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+	return tls.Client(conn, cfg)
+}
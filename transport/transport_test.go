@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newAEADPair returns the transports of the two sides, a transport rejects the salts it sent
+func newAEADPair(t *testing.T, password string) (Transport, Transport) {
+	tr1, err := NewAEAD(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, _ := NewAEAD(password)
+	return tr1, tr2
+}
+
+func TestAEAD(t *testing.T) {
+	tr1, tr2 := newAEADPair(t, "secret")
+	c1, c2 := net.Pipe()
+	client, server := tr1.Wrap(c1), tr2.Wrap(c2)
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+		client.Write([]byte("end"))
+	}()
+	got := make([]byte, len(data)+3)
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(data)], data) || string(got[len(data):]) != "end" {
+		t.Fatal("data mismatch")
+	}
+	go server.Write([]byte("reply"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "reply" {
+		t.Fatalf("reply: %q %v", buf, err)
+	}
+}
+
+func TestAEADWrongPassword(t *testing.T) {
+	tr1, _ := NewAEAD("secret")
+	tr2, _ := NewAEAD("wrong")
+	c1, c2 := net.Pipe()
+	client, server := tr1.Wrap(c1), tr2.Wrap(c2)
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("hello"))
+	if _, err := server.Read(make([]byte, 16)); err != ErrAuthentication {
+		t.Fatalf("got %v, want %v", err, ErrAuthentication)
+	}
+}
+
+func TestAEADReplay(t *testing.T) {
+	clientTr, tr := newAEADPair(t, "secret")
+	// record the bytes of a session sent by the client
+	c1, c2 := net.Pipe()
+	client := clientTr.Wrap(c1)
+	defer client.Close()
+	go func() {
+		client.Write([]byte("hello"))
+		c1.Close()
+	}()
+	record, _ := io.ReadAll(c2)
+
+	replay := func() error {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		server := tr.Wrap(c2)
+		defer server.Close()
+		go c1.Write(record)
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		return err
+	}
+	if err := replay(); err != nil {
+		t.Fatal(err)
+	}
+	if err := replay(); err != ErrReplayed {
+		t.Fatalf("replayed: got %v, want %v", err, ErrReplayed)
+	}
+
+	// the data sent by a side can't be reflected back to it
+	c3, c4 := net.Pipe()
+	server := tr.Wrap(c3)
+	defer server.Close()
+	go func() {
+		server.Write([]byte("reply"))
+		c3.Close()
+	}()
+	record, _ = io.ReadAll(c4)
+	if err := replay(); err != ErrReplayed {
+		t.Fatalf("reflected: got %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869 test case 1, the first 32 bytes of the OKM
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	want, _ := hex.DecodeString("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf")
+	if got := hkdf(ikm, salt, string(info)); !bytes.Equal(got, want) {
+		t.Fatalf("got %x", got)
+	}
+}
+
+func TestSaltFilter(t *testing.T) {
+	f := newSaltFilter(2)
+	salt := func(b byte) []byte { return bytes.Repeat([]byte{b}, saltSize) }
+	for i := byte(0); i < 5; i++ {
+		if !f.add(salt(i)) {
+			t.Fatalf("salt %d rejected", i)
+		}
+	}
+	// the two last generations are remembered
+	if f.add(salt(2)) || f.add(salt(4)) || !f.add(salt(0)) {
+		t.Fatal("filter generations")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go ServeWebSocket(c2, "/ws", time.Second, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	conn, err := WebSocketClient(c1, "example.com", "/ws", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsWebSocket(conn) || conn.RemoteAddr() != c1.RemoteAddr() {
+		t.Fatal("not the adapter of the pipe")
+	}
+	data := make([]byte, 100000)
+	rand.Read(data)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("echo: %v", err)
+	}
+
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	go ServeWebSocket(c4, "/ws", time.Second, func(net.Conn) {})
+	if _, err := WebSocketClient(c3, "example.com", "/other", false); err == nil {
+		t.Fatal("upgraded on the wrong path")
+	}
+}
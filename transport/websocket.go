@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn adapts the WebSocket connection to net.Conn, the data is carried by binary frames.
+// The addresses are the ones of the underlying connection instead of the WebSocket urls.
+type wsConn struct {
+	*websocket.Conn
+	raw net.Conn
+}
+
+func newWSConn(ws *websocket.Conn, raw net.Conn) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, raw: raw}
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.raw.RemoteAddr()
+}
+
+// IsWebSocket reports whether the connection is tunneled inside a WebSocket
+func IsWebSocket(conn net.Conn) bool {
+	_, ok := conn.(*wsConn)
+	return ok
+}
+
+// WebSocketClient runs the WebSocket handshake of the path over conn, host is the Host
+// header and secure selects the wss scheme when conn is a tls connection.
+func WebSocketClient(conn net.Conn, host, path string, secure bool) (net.Conn, error) {
+	scheme, origin := "ws://", "http://"
+	if secure {
+		scheme, origin = "wss://", "https://"
+	}
+	cfg, err := websocket.NewConfig(scheme+host+path, origin+host+"/")
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws, conn), nil
+}
+
+// ServeWebSocket serves HTTP on the accepted connection and calls handler with the WebSocket
+// connection upgraded on path, the other paths get 404. It returns after the handler returns
+// or the connection is closed, timeout limits the request header and the idle time.
+func ServeWebSocket(conn net.Conn, path string, timeout time.Duration, handler func(net.Conn)) {
+	done := make(chan struct{})
+	var once sync.Once
+	finish := func() { once.Do(func() { close(done) }) }
+
+	ws := websocket.Server{
+		// the clients are not browsers, so the origin isn't checked
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			handler(newWSConn(ws, conn))
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		// the connection is hijacked and closed when the upgrade fails or the handler returns
+		defer finish()
+		ws.ServeHTTP(w, r)
+	})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: timeout,
+		IdleTimeout:       timeout,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				finish()
+			}
+		},
+	}
+	go srv.Serve(&connListener{conn: conn, done: done})
+	<-done
+}
+
+// connListener accepts the connection once, then blocks until it's served
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *connListener) Accept() (conn net.Conn, err error) {
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
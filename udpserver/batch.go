@@ -0,0 +1,107 @@
+package udpserver
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+const defaultBatchSize = 32
+
+// batchConn reads and writes many datagrams with one syscall, the methods of
+// ipv4.PacketConn and ipv6.PacketConn, their messages are the same type
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Writer writes the datagrams to the clients, such as *net.UDPConn
+type Writer interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+// batchWriter queues the datagrams and writes the queued ones with one syscall, so the
+// replies of many flows share the syscalls under load
+type batchWriter struct {
+	conn  *net.UDPConn
+	bc    batchConn
+	size  int
+	inet6 bool
+	queue chan *Packet
+	done  <-chan struct{}
+}
+
+func newBatchWriter(conn *net.UDPConn, bc batchConn, size int, done <-chan struct{}) *batchWriter {
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	return &batchWriter{
+		conn:  conn,
+		bc:    bc,
+		size:  size,
+		inet6: addr == nil || addr.IP.To4() == nil,
+		queue: make(chan *Packet, size*4),
+		done:  done,
+	}
+}
+
+// WriteToUDP copies b to the queue. The ipv4 addresses can't be written in batches by
+// the dual-stack sockets, so they are written directly.
+func (w *batchWriter) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if w.inet6 && addr.IP.To4() != nil {
+		return w.conn.WriteToUDP(b, addr)
+	}
+	p := packetPool.Get()
+	if len(b) > len(p.buf) {
+		packetPool.Put(p)
+		return w.conn.WriteToUDP(b, addr)
+	}
+	// Dst is the destination of the queued datagram
+	p.Data, p.Dst = p.buf[:copy(p.buf, b)], addr
+	select {
+	case w.queue <- p:
+		return len(b), nil
+	case <-w.done:
+		releasePacket(p)
+		return 0, net.ErrClosed
+	}
+}
+
+func (w *batchWriter) run() {
+	ms := make([]ipv4.Message, w.size)
+	pkts := make([]*Packet, w.size)
+	for i := range ms {
+		ms[i].Buffers = make([][]byte, 1)
+	}
+	for {
+		select {
+		case pkts[0] = <-w.queue:
+		case <-w.done:
+			return
+		}
+		n := 1
+	fill:
+		for n < w.size {
+			select {
+			case pkts[n] = <-w.queue:
+				n++
+			default:
+				break fill
+			}
+		}
+		for i := 0; i < n; i++ {
+			ms[i].Buffers[0], ms[i].Addr = pkts[i].Data, pkts[i].Dst
+		}
+		for sent := 0; sent < n; {
+			k, err := w.bc.WriteBatch(ms[sent:n], 0)
+			if err != nil && k == 0 {
+				// drop the datagram which failed, such as an unreachable destination
+				k = 1
+			}
+			sent += k
+		}
+		for i := 0; i < n; i++ {
+			ms[i].Buffers[0], ms[i].Addr = nil, nil
+			releasePacket(pkts[i])
+			pkts[i] = nil
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package udpserver
+
+import "net"
+
+// newBatchConn returns nil, the datagrams are read and written one by one
+func newBatchConn(*net.UDPConn) batchConn {
+	return nil
+}
@@ -4,8 +4,20 @@ import (
 	"context"
 	"errors"
 	"net"
+	"net/netip"
+	"runtime"
 	"sync"
 	"sync/atomic"
+
+	"github.com/josexy/gsocks5/bufferpool"
+	"github.com/josexy/gsocks5/socks/constant"
+	"github.com/josexy/gsocks5/util"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	defaultQueueSize = 32
+	defaultMaxFlows  = 1024
 )
 
 var (
@@ -13,6 +25,16 @@ var (
 	ServerContextKey = &contextKey{name: "udp-server"}
 )
 
+var (
+	packetPool = bufferpool.NewBufferPool(func() *Packet {
+		return &Packet{buf: make([]byte, constant.MaxUdpBufferSize)}
+	})
+	stackTraceBufferPool = bufferpool.NewBufferPool(func() *[]byte {
+		buf := make([]byte, 2048)
+		return &buf
+	})
+)
+
 type contextKey struct {
 	name string
 }
@@ -21,24 +43,71 @@ func (ck *contextKey) String() string {
 	return ck.name
 }
 
+// Packet is a datagram received by the server. Dst is the original destination of the
+// datagrams diverted by the TPROXY target, nil otherwise. Data is only valid until
+// ServeUDP returns, and Writer writes the replies to the clients in batches if supported.
+type Packet struct {
+	Conn   *net.UDPConn
+	Src    *net.UDPAddr
+	Dst    *net.UDPAddr
+	Data   []byte
+	Writer Writer
+	buf    []byte
+}
+
 type UdpHandler interface {
-	ServeUDP(context.Context, *net.UDPConn)
+	ServeUDP(context.Context, *Packet)
 }
 
-type UdpHandlerFunc func(context.Context, *net.UDPConn)
+type UdpHandlerFunc func(context.Context, *Packet)
 
-func (f UdpHandlerFunc) ServeUDP(ctx context.Context, conn *net.UDPConn) {
-	f(ctx, conn)
+func (f UdpHandlerFunc) ServeUDP(ctx context.Context, p *Packet) {
+	f(ctx, p)
 }
 
+// ReadFunc reads a datagram with its source and original destination
+type ReadFunc func(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error)
+
+// Stats counts the datagrams of the server. QueueDrops are dropped because the queue of
+// their flow is full, FlowDrops because there are already MaxFlows busy flows.
+type Stats struct {
+	Packets    uint64
+	QueueDrops uint64
+	FlowDrops  uint64
+	Panics     uint64
+}
+
+// UdpServer reads the datagrams and dispatches them to the handler. The datagrams of each
+// source address are queued and handled in order by their own goroutine, so that a slow
+// flow doesn't stall the others. The goroutine exits when the queue is empty.
 type UdpServer struct {
 	Addr        string
 	Handler     UdpHandler
 	BaseContext context.Context
 	Conn        *net.UDPConn
-	mu          sync.Mutex
-	isShutdown  int32
-	doneChan    chan struct{}
+	// ReadFrom replaces ReadFromUDP, such as reading the original destination
+	ReadFrom ReadFunc
+	// QueueSize is the queued datagrams of a flow, and MaxFlows limits the busy flows
+	QueueSize int
+	MaxFlows  int
+	// BatchSize is the datagrams read or written with one syscall on Linux, 1 disables it
+	BatchSize int
+
+	writer     Writer
+	mu         sync.Mutex
+	flows      map[netip.AddrPort]*flow
+	isShutdown int32
+	doneChan   chan struct{}
+
+	packets    atomic.Uint64
+	queueDrops atomic.Uint64
+	flowDrops  atomic.Uint64
+	panics     atomic.Uint64
+}
+
+type flow struct {
+	key   netip.AddrPort
+	queue chan *Packet
 }
 
 func NewUdpServer(addr string, handler UdpHandler) (*UdpServer, error) {
@@ -54,13 +123,22 @@ func NewUdpServer(addr string, handler UdpHandler) (*UdpServer, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewUdpServerConn(conn, handler), nil
+}
+
+// NewUdpServerConn creates a udp server serving the listening connection conn
+func NewUdpServerConn(conn *net.UDPConn, handler UdpHandler) *UdpServer {
 	return &UdpServer{
 		Addr:        conn.LocalAddr().String(),
 		Handler:     handler,
 		BaseContext: context.Background(),
 		Conn:        conn,
+		QueueSize:   defaultQueueSize,
+		MaxFlows:    defaultMaxFlows,
+		BatchSize:   defaultBatchSize,
+		flows:       make(map[netip.AddrPort]*flow),
 		doneChan:    make(chan struct{}),
-	}, nil
+	}
 }
 
 func (s *UdpServer) LocalAddr() *net.UDPAddr {
@@ -71,6 +149,15 @@ func (s *UdpServer) IsShutdown() bool {
 	return atomic.LoadInt32(&s.isShutdown) != 0
 }
 
+func (s *UdpServer) Stats() Stats {
+	return Stats{
+		Packets:    s.packets.Load(),
+		QueueDrops: s.queueDrops.Load(),
+		FlowDrops:  s.flowDrops.Load(),
+		Panics:     s.panics.Load(),
+	}
+}
+
 func (s *UdpServer) Close() error {
 	if s.IsShutdown() {
 		return ErrServerClosed
@@ -83,28 +170,151 @@ func (s *UdpServer) Close() error {
 }
 
 func (s *UdpServer) Serve() error {
+	defer s.Close()
+
+	ctx := context.WithValue(s.BaseContext, ServerContextKey, s)
+	s.writer = s.Conn
+	if s.BatchSize > 1 && s.ReadFrom == nil {
+		if bc := newBatchConn(s.Conn); bc != nil {
+			w := newBatchWriter(s.Conn, bc, s.BatchSize, s.doneChan)
+			go w.run()
+			s.writer = w
+			return s.serveBatch(ctx, bc)
+		}
+	}
+	for {
+		p := packetPool.Get()
+		n, src, dst, err := s.read(p.buf)
+		if err != nil {
+			packetPool.Put(p)
+			if err = s.readError(err); err != nil {
+				return err
+			}
+			continue
+		}
+		p.Conn, p.Src, p.Dst, p.Data, p.Writer = s.Conn, src, dst, p.buf[:n], s.writer
+		s.packets.Add(1)
+		s.dispatch(ctx, p)
+	}
+}
+
+// serveBatch reads the datagrams into the pooled packets with recvmmsg
+func (s *UdpServer) serveBatch(ctx context.Context, bc batchConn) error {
+	ms := make([]ipv4.Message, s.BatchSize)
+	pkts := make([]*Packet, s.BatchSize)
+	for i := range ms {
+		pkts[i] = packetPool.Get()
+		ms[i].Buffers = [][]byte{pkts[i].buf}
+	}
 	defer func() {
-		recover()
-		s.Close()
+		for _, p := range pkts {
+			packetPool.Put(p)
+		}
 	}()
+	for {
+		n, err := bc.ReadBatch(ms, 0)
+		if err != nil {
+			if err = s.readError(err); err != nil {
+				return err
+			}
+			continue
+		}
+		for i := 0; i < n; i++ {
+			src, ok := ms[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			p := pkts[i]
+			p.Conn, p.Src, p.Data, p.Writer = s.Conn, src, p.buf[:ms[i].N], s.writer
+			s.packets.Add(1)
+			s.dispatch(ctx, p)
+			pkts[i] = packetPool.Get()
+			ms[i].Buffers[0] = pkts[i].buf
+		}
+	}
+}
 
-	ctx := context.WithValue(s.BaseContext, ServerContextKey, s)
+// readError returns nil if the server can keep reading after err
+func (s *UdpServer) readError(err error) error {
+	if s.IsShutdown() {
+		return ErrServerClosed
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	util.Logger.ErrorBy(err)
+	return nil
+}
+
+func (s *UdpServer) read(b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	if s.ReadFrom != nil {
+		return s.ReadFrom(s.Conn, b)
+	}
+	n, src, err := s.Conn.ReadFromUDP(b)
+	return n, src, nil, err
+}
+
+// dispatch queues the datagram to its flow, the datagram is dropped instead of blocking
+// the reader when the queue is full
+func (s *UdpServer) dispatch(ctx context.Context, p *Packet) {
+	key := p.Src.AddrPort()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.flows[key]
+	if f == nil {
+		if len(s.flows) >= s.MaxFlows {
+			s.flowDrops.Add(1)
+			releasePacket(p)
+			return
+		}
+		f = &flow{key: key, queue: make(chan *Packet, s.QueueSize)}
+		s.flows[key] = f
+		go s.serveFlow(ctx, f)
+	}
+	select {
+	case f.queue <- p:
+	default:
+		s.queueDrops.Add(1)
+		releasePacket(p)
+	}
+}
+
+// serveFlow handles the queued datagrams of the flow until the queue is empty
+func (s *UdpServer) serveFlow(ctx context.Context, f *flow) {
 	for {
 		select {
-		case <-s.getDoneChan():
-			// server closed
-			return ErrServerClosed
+		case p := <-f.queue:
+			s.handle(ctx, p)
+			continue
 		default:
-			// other error
 		}
-		if s.Handler != nil {
-			s.Handler.ServeUDP(ctx, s.Conn)
+		s.mu.Lock()
+		if len(f.queue) == 0 {
+			delete(s.flows, f.key)
+			s.mu.Unlock()
+			return
 		}
+		s.mu.Unlock()
 	}
 }
 
-func (s *UdpServer) getDoneChan() <-chan struct{} {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.doneChan
+func (s *UdpServer) handle(ctx context.Context, p *Packet) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.panics.Add(1)
+			buf := stackTraceBufferPool.Get()
+			n := runtime.Stack(*buf, false)
+			util.Logger.Errorf("%v\n%s", err, (*buf)[:n])
+			stackTraceBufferPool.Put(buf)
+		}
+		releasePacket(p)
+	}()
+	if s.Handler != nil && !s.IsShutdown() {
+		s.Handler.ServeUDP(ctx, p)
+	}
+}
+
+func releasePacket(p *Packet) {
+	p.Conn, p.Src, p.Dst, p.Data, p.Writer = nil, nil, nil, nil, nil
+	packetPool.Put(p)
 }
@@ -0,0 +1,138 @@
+package udpserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, queueSize, maxFlows int, handler UdpHandlerFunc) *UdpServer {
+	svr, err := NewUdpServer("127.0.0.1:0", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.QueueSize, svr.MaxFlows = queueSize, maxFlows
+	go svr.Serve()
+	t.Cleanup(func() { svr.Close() })
+	return svr
+}
+
+func dialServer(t *testing.T, svr *UdpServer) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, svr.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSlowFlow(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	svr := newTestServer(t, 2, defaultMaxFlows, func(_ context.Context, p *Packet) {
+		switch string(p.Data) {
+		case "slow":
+			<-block
+		case "panic":
+			panic("handler panic")
+		default:
+			p.Writer.WriteToUDP(p.Data, p.Src)
+		}
+	})
+
+	slow := dialServer(t, svr)
+	for i := 0; i < 8; i++ {
+		slow.Write([]byte("slow"))
+	}
+
+	// the other flows are served while the slow flow is blocked, and the panic is recovered
+	fast := dialServer(t, svr)
+	fast.Write([]byte("panic"))
+	buf := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		fast.Write([]byte("echo"))
+		fast.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := fast.Read(buf); err != nil || string(buf[:n]) != "echo" {
+			t.Fatalf("echo: %q %v", buf[:n], err)
+		}
+	}
+
+	stats := svr.Stats()
+	if stats.Packets != 12 || stats.QueueDrops == 0 || stats.Panics != 1 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestMaxFlows(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	svr := newTestServer(t, defaultQueueSize, 1, func(context.Context, *Packet) { <-block })
+
+	dialServer(t, svr).Write([]byte("first"))
+	time.Sleep(50 * time.Millisecond)
+	dialServer(t, svr).Write([]byte("second"))
+	deadline := time.Now().Add(time.Second)
+	for svr.Stats().FlowDrops != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats: %+v", svr.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func benchmarkEcho(b *testing.B, batchSize int) {
+	svr, err := NewUdpServer("127.0.0.1:0", UdpHandlerFunc(func(_ context.Context, p *Packet) {
+		p.Writer.WriteToUDP(p.Data, p.Src)
+	}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	svr.BatchSize = batchSize
+	go svr.Serve()
+	defer svr.Close()
+
+	// each client sends a window of datagrams and then reads the replies
+	const clients, window = 8, 16
+	payload := make([]byte, 512)
+	var lost atomic.Int64
+	var wg sync.WaitGroup
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < clients; i++ {
+		conn, err := net.DialUDP("udp", nil, svr.LocalAddr())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 2048)
+			for sent := 0; sent < b.N/clients; sent += window {
+				for j := 0; j < window; j++ {
+					conn.Write(payload)
+				}
+				for j := 0; j < window; j++ {
+					conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+					if _, err := conn.Read(buf); err != nil {
+						lost.Add(int64(window - j))
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.ReportMetric(float64(lost.Load())/float64(b.N), "lost/op")
+}
+
+func BenchmarkEchoSingle(b *testing.B) {
+	benchmarkEcho(b, 1)
+}
+
+func BenchmarkEchoBatch(b *testing.B) {
+	benchmarkEcho(b, defaultBatchSize)
+}